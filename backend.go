@@ -0,0 +1,181 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "regexp"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// eipconfが扱うインターフェイス名のパターン
+var (
+    gifNamePattern    = regexp.MustCompile(`^gif\d+$`)
+    bridgeNamePattern = regexp.MustCompile(`^bridge\d+$`)
+    vlanNamePattern   = regexp.MustCompile(`^\w+\.\d+$`)
+)
+
+// Operation はインターフェイスに対する1つの変更操作
+// Actionはifconfigのキーワードに揃えている
+//   create, destroy, up, link0: 引数なし
+//   tunnel: 送信元アドレス, 宛先アドレス
+//   mtu: MTU値
+//   description: 説明文
+//   -description: 説明文を削除（引数なし）
+//   vlan: VLAN ID, 親インターフェイス（設定後にupする）
+//   addm: bridgeに追加するメンバー
+type Operation struct {
+    Iface  string   `json:"iface"`
+    Action string   `json:"action"`
+    Args   []string `json:"args,omitempty"`
+}
+
+// String は "gif1 tunnel 2001:db8::1 2001:db8::2" の形式で操作を表す
+func (op Operation) String() string {
+    return strings.Join(append([]string{op.Iface, op.Action}, op.Args...), " ")
+}
+
+// InterfaceBackend はgif、VLAN、bridgeの状態取得と変更を行う実装
+type InterfaceBackend interface {
+    // Name はログ出力用のバックエンド名
+    Name() string
+    // List は現在のgif、bridge、VLANインターフェイスを取得
+    List() (map[string]InterfaceConfig, map[string]BridgeConfig, map[string]string, error)
+    // Apply は1つの変更操作を実行
+    Apply(op Operation) error
+    // InterfaceAddr は指定されたインターフェイスのアドレスを取得
+    InterfaceAddr(iface string, isIPv6 bool) (string, error)
+    // InterfaceNames は存在するすべてのインターフェイス名を取得
+    InterfaceNames() ([]string, error)
+    // LinkState は指定されたインターフェイスのリンク状態を "up"、"down"、"no-carrier" で返す
+    LinkState(iface string) (string, error)
+}
+
+// backend は状態取得と変更に使う実装。起動時にinterface_backendに従って差し替える
+var backend InterfaceBackend = &ifconfigBackend{}
+
+// newBackend はinterface_backendの設定値に対応するバックエンドを作成
+// autoの場合はネイティブ実装を優先し、使えなければifconfigにフォールバックする
+func newBackend(name string) (InterfaceBackend, error) {
+    switch name {
+    case "", "auto":
+        b, err := newNativeBackend()
+        if err != nil {
+            slog.Info("Native interface backend unavailable, falling back to ifconfig", "error", err)
+            return &ifconfigBackend{}, nil
+        }
+        return b, nil
+    case "native":
+        return newNativeBackend()
+    case "ifconfig":
+        return &ifconfigBackend{}, nil
+    default:
+        return nil, fmt.Errorf("unknown interface_backend: %s", name)
+    }
+}
+
+// applyOperation は現在のバックエンドで1つの変更操作を実行し、作成と削除を所有情報に記録する
+func applyOperation(op Operation) error {
+    if err := backend.Apply(op); err != nil {
+        return err
+    }
+    switch op.Action {
+    case "create":
+        ownership.Add(op.Iface)
+    case "destroy":
+        ownership.Remove(op.Iface)
+    }
+    return nil
+}
+
+// applyOp はapplyOperationの省略形
+func applyOp(iface, action string, args ...string) error {
+    return applyOperation(Operation{Iface: iface, Action: action, Args: args})
+}
+
+// applyWithRetry はfnで操作を実行し、失敗時はrunCommandと同じく再試行する
+// ifconfigを使わないバックエンドで使い、作成済みのインターフェイスへのcreateは成功として扱う
+func applyWithRetry(op Operation, fn func(Operation) error) error {
+    for attempt := 0; attempt < 3; attempt++ {
+        err := fn(op)
+        if err == nil {
+            slog.Info("Interface operation succeeded", "op", op.String())
+            return nil
+        }
+        if op.Action == "create" && errors.Is(err, syscall.EEXIST) {
+            slog.Info("Interface already exists, skipping creation", "op", op.String())
+            return nil
+        }
+        slog.Error("Interface operation failed", "op", op.String(), "error", err)
+        recordCommandFailure(backend.Name(), op.Action, attempt < 2)
+        if attempt < 2 {
+            slog.Info("Retrying", "delay", commandRetryDelay)
+            time.Sleep(commandRetryDelay)
+        }
+    }
+    return fmt.Errorf("interface operation failed after 3 attempts: %s", op)
+}
+
+// netInterfaceAddr はnetパッケージで取得したアドレスのうち最初に見つかったものを返す
+// IPv6のリンクローカルアドレスはifconfigの解析と同じく対象外
+func netInterfaceAddr(iface string, isIPv6 bool) (string, error) {
+    ifi, err := net.InterfaceByName(iface)
+    if err != nil {
+        return "", fmt.Errorf("failed to get interface address: %v", err)
+    }
+    addrs, err := ifi.Addrs()
+    if err != nil {
+        return "", fmt.Errorf("failed to get interface address: %v", err)
+    }
+    for _, addr := range addrs {
+        ipnet, ok := addr.(*net.IPNet)
+        if !ok {
+            continue
+        }
+        ip := ipnet.IP
+        if isIPv6 && ip.To4() == nil && !ip.IsLinkLocalUnicast() {
+            return ip.String(), nil
+        }
+        if !isIPv6 && ip.To4() != nil {
+            return ip.String(), nil
+        }
+    }
+    return "", fmt.Errorf("no suitable address found for interface %s (IPv6: %v)", iface, isIPv6)
+}
+
+// linkState はUPとRUNNINGのフラグからリンク状態を返す
+// UPでもRUNNINGでなければ、トンネルの宛先や親インターフェイスが使えない状態
+func linkState(up, running bool) string {
+    switch {
+    case !up:
+        return "down"
+    case !running:
+        return "no-carrier"
+    }
+    return "up"
+}
+
+// netLinkState はnetパッケージで取得したフラグからリンク状態を返す
+func netLinkState(iface string) (string, error) {
+    ifi, err := net.InterfaceByName(iface)
+    if err != nil {
+        return "", fmt.Errorf("failed to get link state: %v", err)
+    }
+    return linkState(ifi.Flags&net.FlagUp != 0, ifi.Flags&net.FlagRunning != 0), nil
+}
+
+// netInterfaceNames はnetパッケージでインターフェイス名の一覧を取得
+func netInterfaceNames() ([]string, error) {
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return nil, err
+    }
+    names := make([]string, 0, len(ifaces))
+    for _, iface := range ifaces {
+        names = append(names, iface.Name)
+    }
+    return names, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "regexp"
+    "strings"
+)
+
+// ifconfigBackend はifconfigコマンドの実行と出力の解析で状態を扱う
+type ifconfigBackend struct{}
+
+var (
+    ifconfigHeader  = regexp.MustCompile(`^([^\s:]+): flags=`)
+    ifconfigFlags   = regexp.MustCompile(`flags=[0-9a-f]+<([^>]*)>`)
+    ifconfigTunnel4 = regexp.MustCompile(`tunnel inet (\S+) --> (\S+)`)
+    ifconfigTunnel6 = regexp.MustCompile(`tunnel inet6 (\S+) --> (\S+)`)
+    ifconfigMember  = regexp.MustCompile(`member: (\S+)`)
+    ifconfigVLANTag = regexp.MustCompile(`vlan: (\d+)`)
+)
+
+func (b *ifconfigBackend) Name() string {
+    return "ifconfig"
+}
+
+// List はifconfig -aの出力を1回だけ取得し、インターフェイスごとのブロックを解析する
+func (b *ifconfigBackend) List() (map[string]InterfaceConfig, map[string]BridgeConfig, map[string]string, error) {
+    output, err := executor.Output("ifconfig", "-a")
+    if err != nil {
+        return make(map[string]InterfaceConfig), make(map[string]BridgeConfig), make(map[string]string), err
+    }
+    gifs, bridges, vlans := parseIfconfig(string(output))
+    return gifs, bridges, vlans, nil
+}
+
+// parseIfconfig はifconfig -aの出力からgif、bridge、VLANの設定を取り出す
+func parseIfconfig(output string) (map[string]InterfaceConfig, map[string]BridgeConfig, map[string]string) {
+    gifInterfaces := make(map[string]InterfaceConfig)
+    bridgeInterfaces := make(map[string]BridgeConfig)
+    vlanInterfaces := make(map[string]string)
+
+    for name, block := range splitIfconfigBlocks(output) {
+        switch {
+        case gifNamePattern.MatchString(name):
+            var desc string
+            for _, l := range strings.Split(block, "\n") {
+                l = strings.TrimSpace(l)
+                if strings.HasPrefix(l, "description:") {
+                    desc = strings.TrimSpace(strings.TrimPrefix(l, "description:"))
+                    break
+                }
+            }
+            tunnelID := strings.TrimPrefix(name, "gif")
+            if m := ifconfigTunnel4.FindStringSubmatch(block); len(m) == 3 {
+                gifInterfaces[name] = InterfaceConfig{Src: m[1], Dst: m[2], Vlan: "", IsIPv6: false, TunnelID: tunnelID, Description: desc}
+            } else if m := ifconfigTunnel6.FindStringSubmatch(block); len(m) == 3 {
+                gifInterfaces[name] = InterfaceConfig{Src: m[1], Dst: m[2], Vlan: "", IsIPv6: true, TunnelID: tunnelID, Description: desc}
+            } else {
+                gifInterfaces[name] = InterfaceConfig{Src: "", Dst: "", Vlan: "", IsIPv6: false, TunnelID: tunnelID, Description: desc}
+            }
+        case bridgeNamePattern.MatchString(name):
+            memberList := []string{}
+            for _, m := range ifconfigMember.FindAllStringSubmatch(block, -1) {
+                memberList = append(memberList, m[1])
+            }
+            bridgeInterfaces[name] = BridgeConfig{Members: memberList, TunnelID: strings.TrimPrefix(name, "bridge")}
+        case vlanNamePattern.MatchString(name):
+            if m := ifconfigVLANTag.FindStringSubmatch(block); len(m) == 2 {
+                vlanInterfaces[name] = m[1]
+            }
+        }
+    }
+    return gifInterfaces, bridgeInterfaces, vlanInterfaces
+}
+
+// splitIfconfigBlocks はifconfigの出力を "name: flags=" の行ごとにインターフェイス単位へ分割
+func splitIfconfigBlocks(output string) map[string]string {
+    blocks := make(map[string]string)
+    var name string
+    var block strings.Builder
+    flush := func() {
+        if name != "" {
+            blocks[name] = block.String()
+        }
+        block.Reset()
+    }
+    for _, line := range strings.Split(output, "\n") {
+        if m := ifconfigHeader.FindStringSubmatch(line); m != nil {
+            flush()
+            name = m[1]
+        }
+        block.WriteString(line)
+        block.WriteString("\n")
+    }
+    flush()
+    return blocks
+}
+
+// Apply は操作をifconfigの引数に変換して実行
+func (b *ifconfigBackend) Apply(op Operation) error {
+    return runCommand(op.Action, "ifconfig", ifconfigArgs(op)...)
+}
+
+// ifconfigArgs は操作に対応するifconfigの引数を返す
+func ifconfigArgs(op Operation) []string {
+    switch op.Action {
+    case "tunnel":
+        args := []string{op.Iface}
+        if len(op.Args) > 0 && strings.Contains(op.Args[0], ":") {
+            args = append(args, "inet6")
+        }
+        return append(append(args, "tunnel"), op.Args...)
+    case "vlan":
+        if len(op.Args) == 2 {
+            return []string{op.Iface, "vlan", op.Args[0], "vlandev", op.Args[1], "up"}
+        }
+    }
+    return append([]string{op.Iface, op.Action}, op.Args...)
+}
+
+// InterfaceAddr はifconfig <iface>の出力から最初に見つかったアドレスを返す
+func (b *ifconfigBackend) InterfaceAddr(iface string, isIPv6 bool) (string, error) {
+    output, err := executor.Output("ifconfig", iface)
+    if err != nil {
+        return "", fmt.Errorf("failed to get interface address: %v", err)
+    }
+
+    lines := strings.Split(string(output), "\n")
+    for _, line := range lines {
+        if strings.Contains(line, "inet") {
+            if isIPv6 && strings.Contains(line, "inet6") {
+                fields := strings.Fields(line)
+                for _, field := range fields {
+                    if net.ParseIP(field) != nil && strings.Contains(field, ":") {
+                        return field, nil
+                    }
+                }
+            } else if !isIPv6 && strings.Contains(line, "inet") && !strings.Contains(line, "inet6") {
+                fields := strings.Fields(line)
+                for _, field := range fields {
+                    if net.ParseIP(field) != nil && !strings.Contains(field, ":") {
+                        return field, nil
+                    }
+                }
+            }
+        }
+    }
+    return "", fmt.Errorf("no suitable address found for interface %s (IPv6: %v)", iface, isIPv6)
+}
+
+// InterfaceNames はifconfig -lでインターフェイス名の一覧を取得
+func (b *ifconfigBackend) InterfaceNames() ([]string, error) {
+    output, err := executor.Output("ifconfig", "-l")
+    if err != nil {
+        return nil, err
+    }
+    return strings.Fields(string(output)), nil
+}
+
+// LinkState はifconfig <iface>の1行目のフラグからリンク状態を返す
+func (b *ifconfigBackend) LinkState(iface string) (string, error) {
+    output, err := executor.Output("ifconfig", iface)
+    if err != nil {
+        return "", fmt.Errorf("failed to get link state: %v", err)
+    }
+    m := ifconfigFlags.FindStringSubmatch(string(output))
+    if m == nil {
+        return "", fmt.Errorf("no flags found for interface %s", iface)
+    }
+    flags := strings.Split(m[1], ",")
+    return linkState(containsString(flags, "UP"), containsString(flags, "RUNNING")), nil
+}
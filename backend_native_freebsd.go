@@ -0,0 +1,433 @@
+//go:build freebsd && (amd64 || arm64)
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "strconv"
+    "strings"
+    "syscall"
+    "unsafe"
+)
+
+// nativeBackend はioctlとルーティングソケットで状態を扱う
+// ifconfigのプロセスを起動しないため、トンネル数が多くても1サイクルあたりのコストが小さい
+type nativeBackend struct{}
+
+// newNativeBackend はioctl用のソケットが開けることを確認してネイティブ実装を返す
+func newNativeBackend() (InterfaceBackend, error) {
+    fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open ioctl socket: %v", err)
+    }
+    syscall.Close(fd)
+    return &nativeBackend{}, nil
+}
+
+// <net/if.h>、<net/if_vlan_var.h>、<net/if_bridgevar.h>、<netinet6/in6_var.h> の構造体
+// 64ビット環境のレイアウトに合わせている
+type ifreqFlags struct {
+    Name      [syscall.IFNAMSIZ]byte
+    Flags     int16
+    FlagsHigh uint16
+    _         [12]byte
+}
+
+type ifreqMTU struct {
+    Name [syscall.IFNAMSIZ]byte
+    MTU  int32
+    _    [12]byte
+}
+
+type ifreqData struct {
+    Name [syscall.IFNAMSIZ]byte
+    Data unsafe.Pointer
+    _    [8]byte
+}
+
+type ifreqBuffer struct {
+    Name   [syscall.IFNAMSIZ]byte
+    Length uint64
+    Buffer unsafe.Pointer
+}
+
+type ifreqAddr struct {
+    Name [syscall.IFNAMSIZ]byte
+    Addr syscall.RawSockaddrInet4
+}
+
+// in6Ifreq のunionはicmp6_ifstatが最大で272バイト
+type in6Ifreq struct {
+    Name [syscall.IFNAMSIZ]byte
+    Addr syscall.RawSockaddrInet6
+    _    [272 - syscall.SizeofSockaddrInet6]byte
+}
+
+type ifAliasreq struct {
+    Name    [syscall.IFNAMSIZ]byte
+    Addr    syscall.RawSockaddrInet4
+    Dstaddr syscall.RawSockaddrInet4
+    Mask    syscall.RawSockaddrInet4
+    Vhid    int32
+}
+
+type in6Addrlifetime struct {
+    Expire    int64
+    Preferred int64
+    Vltime    uint32
+    Pltime    uint32
+}
+
+type in6Aliasreq struct {
+    Name       [syscall.IFNAMSIZ]byte
+    Addr       syscall.RawSockaddrInet6
+    Dstaddr    syscall.RawSockaddrInet6
+    Prefixmask syscall.RawSockaddrInet6
+    Flags      int32
+    Lifetime   in6Addrlifetime
+    Vhid       int32
+}
+
+type vlanreq struct {
+    Parent [syscall.IFNAMSIZ]byte
+    Tag    uint16
+    Proto  uint16
+}
+
+type ifdrv struct {
+    Name [syscall.IFNAMSIZ]byte
+    Cmd  uint64
+    Len  uint64
+    Data unsafe.Pointer
+}
+
+type ifbreq struct {
+    Ifsname      [syscall.IFNAMSIZ]byte
+    Ifsflags     uint32
+    Stpflags     uint32
+    PathCost     uint32
+    Portno       uint8
+    Priority     uint8
+    Proto        uint8
+    Role         uint8
+    State        uint8
+    _            [3]byte
+    Addrcnt      uint32
+    Addrmax      uint32
+    Addrexceeded uint32
+    _            [32]byte
+}
+
+type ifbifconf struct {
+    Len uint32
+    _   [4]byte
+    Buf unsafe.Pointer
+}
+
+// bridgeのSIOCGDRVSPEC/SIOCSDRVSPECで使うコマンド番号
+const (
+    brdgAdd  = 0
+    brdgGifs = 6
+)
+
+// syscallパッケージの定数は古いヘッダから生成されておりifra_vhidを含まないため、
+// アドレスを扱うioctlの番号は構造体の大きさから組み立てる
+var (
+    siocSIFPHYADDR     = iow('i', 70, unsafe.Sizeof(ifAliasreq{}))
+    siocSIFPHYADDRIn6  = iow('i', 70, unsafe.Sizeof(in6Aliasreq{}))
+    siocGIFPSRCADDRIn6 = iowr('i', 71, unsafe.Sizeof(in6Ifreq{}))
+    siocGIFPDSTADDRIn6 = iowr('i', 72, unsafe.Sizeof(in6Ifreq{}))
+)
+
+// 構造体の大きさをヘッダの構造体と照合する。1つでも違えば定数の添字が範囲外になり、コンパイルできない
+// amd64とarm64はどちらもLP64なので同じ大きさになる
+//   struct ifreq (<net/if.h>)                    32
+//   struct in6_ifreq (<netinet6/in6_var.h>)      288  unionで最大のicmp6_ifstatが272
+//   struct ifaliasreq (<net/if.h>)               68   ifra_vhidを含む
+//   struct in6_aliasreq (<netinet6/in6_var.h>)   136  ifra_vhidを含み、8バイト境界に揃える
+//   struct vlanreq (<net/if_vlan_var.h>)         20
+//   struct ifdrv (<net/if.h>)                    40
+//   struct ifbreq (<net/if_bridgevar.h>)         80
+//   struct ifbifconf (<net/if_bridgevar.h>)      16
+// ifreqとifdrvはsyscallパッケージのioctl番号に埋め込まれた大きさとも照合する
+var (
+    _ = [1]struct{}{}[unsafe.Sizeof(ifreqFlags{})-32]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifreqMTU{})-32]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifreqData{})-32]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifreqBuffer{})-32]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifreqAddr{})-32]
+    _ = [1]struct{}{}[unsafe.Sizeof(in6Ifreq{})-288]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifAliasreq{})-68]
+    _ = [1]struct{}{}[unsafe.Sizeof(in6Aliasreq{})-136]
+    _ = [1]struct{}{}[unsafe.Sizeof(vlanreq{})-20]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifdrv{})-40]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifbreq{})-80]
+    _ = [1]struct{}{}[unsafe.Sizeof(ifbifconf{})-16]
+    _ = [1]struct{}{}[syscall.SIOCSIFFLAGS>>16&0x1fff-unsafe.Sizeof(ifreqFlags{})]
+    _ = [1]struct{}{}[syscall.SIOCSDRVSPEC>>16&0x1fff-unsafe.Sizeof(ifdrv{})]
+    _ = [1]struct{}{}[syscall.SIOCGDRVSPEC>>16&0x1fff-unsafe.Sizeof(ifdrv{})]
+)
+
+func iow(group byte, num, size uintptr) uintptr {
+    return 0x80000000 | (size&0x1fff)<<16 | uintptr(group)<<8 | num
+}
+
+func iowr(group byte, num, size uintptr) uintptr {
+    return 0xc0000000 | (size&0x1fff)<<16 | uintptr(group)<<8 | num
+}
+
+// ioctl はfamilyのデータグラムソケットを開いて1回ioctlを発行する
+func ioctl(family int, req uintptr, arg unsafe.Pointer) error {
+    fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, 0)
+    if err != nil {
+        return err
+    }
+    defer syscall.Close(fd)
+    if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+        return errno
+    }
+    return nil
+}
+
+func ifName(name string) [syscall.IFNAMSIZ]byte {
+    var b [syscall.IFNAMSIZ]byte
+    copy(b[:syscall.IFNAMSIZ-1], name)
+    return b
+}
+
+func cString(b []byte) string {
+    if i := strings.IndexByte(string(b), 0); i >= 0 {
+        return string(b[:i])
+    }
+    return string(b)
+}
+
+func (b *nativeBackend) Name() string {
+    return "native"
+}
+
+// List はルーティングソケットでインターフェイス一覧を取得し、gif、bridge、VLANの設定をioctlで読む
+func (b *nativeBackend) List() (map[string]InterfaceConfig, map[string]BridgeConfig, map[string]string, error) {
+    gifInterfaces := make(map[string]InterfaceConfig)
+    bridgeInterfaces := make(map[string]BridgeConfig)
+    vlanInterfaces := make(map[string]string)
+
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return gifInterfaces, bridgeInterfaces, vlanInterfaces, err
+    }
+
+    for _, iface := range ifaces {
+        name := iface.Name
+        switch {
+        case gifNamePattern.MatchString(name):
+            desc, err := getDescription(name)
+            if err != nil {
+                slog.Debug("Failed to get description", "iface", name, "error", err)
+            }
+            config := InterfaceConfig{TunnelID: strings.TrimPrefix(name, "gif"), Description: desc}
+            config.Src, config.Dst, config.IsIPv6 = getTunnelAddrs(name)
+            gifInterfaces[name] = config
+        case bridgeNamePattern.MatchString(name):
+            members, err := getBridgeMembers(name)
+            if err != nil {
+                slog.Debug("Failed to get bridge members", "iface", name, "error", err)
+            }
+            bridgeInterfaces[name] = BridgeConfig{Members: members, TunnelID: strings.TrimPrefix(name, "bridge")}
+        case vlanNamePattern.MatchString(name):
+            var vreq vlanreq
+            req := ifreqData{Name: ifName(name), Data: unsafe.Pointer(&vreq)}
+            if err := ioctl(syscall.AF_INET, syscall.SIOCGIFGENERIC, unsafe.Pointer(&req)); err != nil {
+                slog.Debug("Failed to get VLAN configuration", "iface", name, "error", err)
+                continue
+            }
+            vlanInterfaces[name] = strconv.Itoa(int(vreq.Tag))
+        }
+    }
+    return gifInterfaces, bridgeInterfaces, vlanInterfaces, nil
+}
+
+// getTunnelAddrs はgifの送信元と宛先を返す。未設定の場合は空文字列
+func getTunnelAddrs(name string) (string, string, bool) {
+    var src, dst ifreqAddr
+    src.Name, dst.Name = ifName(name), ifName(name)
+    if ioctl(syscall.AF_INET, syscall.SIOCGIFPSRCADDR, unsafe.Pointer(&src)) == nil &&
+        ioctl(syscall.AF_INET, syscall.SIOCGIFPDSTADDR, unsafe.Pointer(&dst)) == nil {
+        return net.IP(src.Addr.Addr[:]).String(), net.IP(dst.Addr.Addr[:]).String(), false
+    }
+
+    var src6, dst6 in6Ifreq
+    src6.Name, dst6.Name = ifName(name), ifName(name)
+    if ioctl(syscall.AF_INET6, siocGIFPSRCADDRIn6, unsafe.Pointer(&src6)) == nil &&
+        ioctl(syscall.AF_INET6, siocGIFPDSTADDRIn6, unsafe.Pointer(&dst6)) == nil {
+        return net.IP(src6.Addr.Addr[:]).String(), net.IP(dst6.Addr.Addr[:]).String(), true
+    }
+    return "", "", false
+}
+
+// getDescription はSIOCGIFDESCRで説明文を取得する。説明文がなければ空文字列
+func getDescription(name string) (string, error) {
+    buf := make([]byte, 64)
+    for {
+        req := ifreqBuffer{Name: ifName(name), Length: uint64(len(buf)), Buffer: unsafe.Pointer(&buf[0])}
+        err := ioctl(syscall.AF_INET, syscall.SIOCGIFDESCR, unsafe.Pointer(&req))
+        if errors.Is(err, syscall.ENOMSG) {
+            return "", nil
+        }
+        if err != nil {
+            return "", err
+        }
+        // バッファが足りない場合、カーネルはBufferをNULLにして必要な長さを返す
+        if req.Buffer == nil && req.Length > uint64(len(buf)) {
+            buf = make([]byte, req.Length)
+            continue
+        }
+        return strings.TrimSpace(cString(buf)), nil
+    }
+}
+
+// getBridgeMembers はBRDGGIFSでbridgeのメンバー名を取得する
+func getBridgeMembers(name string) ([]string, error) {
+    size := 8 * int(unsafe.Sizeof(ifbreq{}))
+    for {
+        buf := make([]ifbreq, size/int(unsafe.Sizeof(ifbreq{})))
+        bifc := ifbifconf{Len: uint32(size), Buf: unsafe.Pointer(&buf[0])}
+        drv := ifdrv{Name: ifName(name), Cmd: brdgGifs, Len: uint64(unsafe.Sizeof(bifc)), Data: unsafe.Pointer(&bifc)}
+        if err := ioctl(syscall.AF_INET, syscall.SIOCGDRVSPEC, unsafe.Pointer(&drv)); err != nil {
+            return []string{}, err
+        }
+        if int(bifc.Len)+int(unsafe.Sizeof(ifbreq{})) < size {
+            members := []string{}
+            for i := 0; i < int(bifc.Len)/int(unsafe.Sizeof(ifbreq{})); i++ {
+                members = append(members, cString(buf[i].Ifsname[:]))
+            }
+            return members, nil
+        }
+        size *= 2
+    }
+}
+
+// Apply は操作をioctlに変換して実行する
+func (b *nativeBackend) Apply(op Operation) error {
+    return applyWithRetry(op, applyNative)
+}
+
+func applyNative(op Operation) error {
+    name := ifName(op.Iface)
+    switch op.Action {
+    case "create":
+        req := ifreqData{Name: name}
+        return ioctl(syscall.AF_INET, syscall.SIOCIFCREATE2, unsafe.Pointer(&req))
+    case "destroy":
+        req := ifreqData{Name: name}
+        return ioctl(syscall.AF_INET, syscall.SIOCIFDESTROY, unsafe.Pointer(&req))
+    case "up":
+        return setFlags(op.Iface, syscall.IFF_UP)
+    case "link0":
+        return setFlags(op.Iface, syscall.IFF_LINK0)
+    case "mtu":
+        if len(op.Args) != 1 {
+            return fmt.Errorf("mtu requires 1 argument")
+        }
+        mtu, err := strconv.Atoi(op.Args[0])
+        if err != nil {
+            return fmt.Errorf("invalid mtu: %s", op.Args[0])
+        }
+        req := ifreqMTU{Name: name, MTU: int32(mtu)}
+        return ioctl(syscall.AF_INET, syscall.SIOCSIFMTU, unsafe.Pointer(&req))
+    case "description":
+        if len(op.Args) != 1 {
+            return fmt.Errorf("description requires 1 argument")
+        }
+        buf := append([]byte(op.Args[0]), 0)
+        req := ifreqBuffer{Name: name, Length: uint64(len(buf)), Buffer: unsafe.Pointer(&buf[0])}
+        return ioctl(syscall.AF_INET, syscall.SIOCSIFDESCR, unsafe.Pointer(&req))
+    case "-description":
+        req := ifreqBuffer{Name: name}
+        return ioctl(syscall.AF_INET, syscall.SIOCSIFDESCR, unsafe.Pointer(&req))
+    case "tunnel":
+        if len(op.Args) != 2 {
+            return fmt.Errorf("tunnel requires 2 arguments")
+        }
+        return setTunnel(op.Iface, op.Args[0], op.Args[1])
+    case "vlan":
+        if len(op.Args) != 2 {
+            return fmt.Errorf("vlan requires 2 arguments")
+        }
+        tag, err := strconv.Atoi(op.Args[0])
+        if err != nil || tag < 0 || tag > 4095 {
+            return fmt.Errorf("invalid vlan tag: %s", op.Args[0])
+        }
+        vreq := vlanreq{Parent: ifName(op.Args[1]), Tag: uint16(tag)}
+        req := ifreqData{Name: name, Data: unsafe.Pointer(&vreq)}
+        if err := ioctl(syscall.AF_INET, syscall.SIOCSIFGENERIC, unsafe.Pointer(&req)); err != nil {
+            return err
+        }
+        return setFlags(op.Iface, syscall.IFF_UP)
+    case "addm":
+        if len(op.Args) != 1 {
+            return fmt.Errorf("addm requires 1 argument")
+        }
+        breq := ifbreq{Ifsname: ifName(op.Args[0])}
+        drv := ifdrv{Name: name, Cmd: brdgAdd, Len: uint64(unsafe.Sizeof(breq)), Data: unsafe.Pointer(&breq)}
+        return ioctl(syscall.AF_INET, syscall.SIOCSDRVSPEC, unsafe.Pointer(&drv))
+    default:
+        return fmt.Errorf("unsupported action: %s", op.Action)
+    }
+}
+
+// setFlags は現在のフラグにflagを加えて設定する
+func setFlags(iface string, flag int) error {
+    req := ifreqFlags{Name: ifName(iface)}
+    if err := ioctl(syscall.AF_INET, syscall.SIOCGIFFLAGS, unsafe.Pointer(&req)); err != nil {
+        return err
+    }
+    req.Flags |= int16(flag)
+    return ioctl(syscall.AF_INET, syscall.SIOCSIFFLAGS, unsafe.Pointer(&req))
+}
+
+// setTunnel はgifの送信元と宛先を設定する。アドレスファミリは送信元アドレスで判別
+func setTunnel(iface, src, dst string) error {
+    srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+    if srcIP == nil || dstIP == nil {
+        return fmt.Errorf("invalid tunnel address: %s --> %s", src, dst)
+    }
+    if srcIP.To4() != nil {
+        if dstIP.To4() == nil {
+            return fmt.Errorf("source and destination address families do not match")
+        }
+        req := ifAliasreq{Name: ifName(iface)}
+        req.Addr = syscall.RawSockaddrInet4{Len: syscall.SizeofSockaddrInet4, Family: syscall.AF_INET}
+        req.Dstaddr = req.Addr
+        copy(req.Addr.Addr[:], srcIP.To4())
+        copy(req.Dstaddr.Addr[:], dstIP.To4())
+        return ioctl(syscall.AF_INET, siocSIFPHYADDR, unsafe.Pointer(&req))
+    }
+    if dstIP.To4() != nil {
+        return fmt.Errorf("source and destination address families do not match")
+    }
+    req := in6Aliasreq{Name: ifName(iface)}
+    req.Addr = syscall.RawSockaddrInet6{Len: syscall.SizeofSockaddrInet6, Family: syscall.AF_INET6}
+    req.Dstaddr = req.Addr
+    copy(req.Addr.Addr[:], srcIP.To16())
+    copy(req.Dstaddr.Addr[:], dstIP.To16())
+    return ioctl(syscall.AF_INET6, siocSIFPHYADDRIn6, unsafe.Pointer(&req))
+}
+
+// InterfaceAddr はルーティングソケットから取得したアドレスを返す
+func (b *nativeBackend) InterfaceAddr(iface string, isIPv6 bool) (string, error) {
+    return netInterfaceAddr(iface, isIPv6)
+}
+
+// InterfaceNames はルーティングソケットでインターフェイス名の一覧を取得
+func (b *nativeBackend) InterfaceNames() ([]string, error) {
+    return netInterfaceNames()
+}
+
+// LinkState はルーティングソケットから取得したフラグからリンク状態を返す
+func (b *nativeBackend) LinkState(iface string) (string, error) {
+    return netLinkState(iface)
+}
@@ -0,0 +1,89 @@
+//go:build freebsd && (amd64 || arm64)
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "testing"
+)
+
+// TestIoctlNumbers は構造体の大きさから組み立てたioctl番号をヘッダの値と照合する
+func TestIoctlNumbers(t *testing.T) {
+    tests := []struct {
+        name string
+        got  uintptr
+        want uintptr
+    }{
+        {"SIOCSIFPHYADDR", siocSIFPHYADDR, 0x80446946},
+        {"SIOCSIFPHYADDR_IN6", siocSIFPHYADDRIn6, 0x80886946},
+        {"SIOCGIFPSRCADDR_IN6", siocGIFPSRCADDRIn6, 0xc1206947},
+        {"SIOCGIFPDSTADDR_IN6", siocGIFPDSTADDRIn6, 0xc1206948},
+    }
+    for _, tt := range tests {
+        if tt.got != tt.want {
+            t.Errorf("%s = %#x, want %#x", tt.name, tt.got, tt.want)
+        }
+    }
+}
+
+// TestNativeBackendSmoke はネイティブ実装でgifとbridgeを作成し、読み戻してから削除する
+// インターフェイスを作るためrootでのみ実行する
+func TestNativeBackendSmoke(t *testing.T) {
+    b, err := newNativeBackend()
+    if err != nil {
+        t.Skipf("native backend unavailable: %v", err)
+    }
+    if _, _, _, err := b.List(); err != nil {
+        t.Fatalf("List: %v", err)
+    }
+    if os.Geteuid() != 0 {
+        t.Skip("creating interfaces requires root")
+    }
+
+    // 既存の設定と重ならない番号を使う
+    id := fmt.Sprintf("%d", 60000+os.Getpid()%5000)
+    gif, bridge := "gif"+id, "bridge"+id
+    t.Cleanup(func() {
+        applyNative(Operation{Iface: bridge, Action: "destroy"})
+        applyNative(Operation{Iface: gif, Action: "destroy"})
+    })
+
+    for _, op := range []Operation{
+        {Iface: gif, Action: "create"},
+        {Iface: gif, Action: "tunnel", Args: []string{"2001:db8::1", "2001:db8::2"}},
+        {Iface: gif, Action: "mtu", Args: []string{"1500"}},
+        {Iface: gif, Action: "link0"},
+        {Iface: gif, Action: "up"},
+        {Iface: gif, Action: "description", Args: []string{"eipconf smoke test"}},
+        {Iface: bridge, Action: "create"},
+        {Iface: bridge, Action: "addm", Args: []string{gif}},
+        {Iface: bridge, Action: "up"},
+    } {
+        if err := applyNative(op); err != nil {
+            t.Fatalf("%s: %v", op, err)
+        }
+    }
+
+    gifs, bridges, _, err := b.List()
+    if err != nil {
+        t.Fatalf("List: %v", err)
+    }
+    got := gifs[gif]
+    if got.Src != "2001:db8::1" || got.Dst != "2001:db8::2" || !got.IsIPv6 || got.Description != "eipconf smoke test" {
+        t.Errorf("%s = %+v", gif, got)
+    }
+    if members := bridges[bridge].Members; len(members) != 1 || members[0] != gif {
+        t.Errorf("%s members = %v, want [%s]", bridge, members, gif)
+    }
+    if state, err := b.LinkState(gif); err != nil || state == "down" {
+        t.Errorf("%s link state = %q, %v", gif, state, err)
+    }
+
+    if err := applyNative(Operation{Iface: gif, Action: "tunnel", Args: []string{"192.0.2.1", "192.0.2.2"}}); err != nil {
+        t.Fatalf("tunnel IPv4: %v", err)
+    }
+    if src, dst, isIPv6 := getTunnelAddrs(gif); src != "192.0.2.1" || dst != "192.0.2.2" || isIPv6 {
+        t.Errorf("tunnel after change = %s %s IPv6=%v", src, dst, isIPv6)
+    }
+}
@@ -0,0 +1,13 @@
+//go:build !linux && (!freebsd || !(amd64 || arm64))
+
+package main
+
+import (
+    "fmt"
+    "runtime"
+)
+
+// newNativeBackend はネイティブ実装のないOSではエラーを返す
+func newNativeBackend() (InterfaceBackend, error) {
+    return nil, fmt.Errorf("native interface backend is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
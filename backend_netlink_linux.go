@@ -0,0 +1,459 @@
+//go:build linux
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// netlinkBackend はrtnetlinkでLinuxのインターフェイスを扱う
+// FreeBSDと同じ名前で、gifNはgretap（IPv6ではip6gretap）、<physical_iface>.<VLAN ID>は802.1Q VLAN、
+// bridgeNはLinux bridgeとして作成する
+type netlinkBackend struct{}
+
+// newNativeBackend はrtnetlinkのソケットが開けることを確認してnetlink実装を返す
+func newNativeBackend() (InterfaceBackend, error) {
+    fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open netlink socket: %v", err)
+    }
+    syscall.Close(fd)
+    return &netlinkBackend{}, nil
+}
+
+// <linux/if_link.h> の属性番号のうちsyscallパッケージにないもの
+const (
+    iflaInfoKind  = 1
+    iflaInfoData  = 2
+    iflaVlanID    = 1
+    iflaGreLocal  = 6
+    iflaGreRemote = 7
+    nlaFNested    = 0x8000
+    nlaTypeMask   = 0x3fff
+)
+
+// netlinkLink はRTM_NEWLINKの1エントリから必要な属性を取り出したもの
+type netlinkLink struct {
+    Index  int32
+    Name   string
+    Flags  uint32
+    MTU    uint32
+    Master int32
+    Link   int32
+    Alias  string
+    Kind   string
+    Local  net.IP
+    Remote net.IP
+    VlanID int
+}
+
+func (b *netlinkBackend) Name() string {
+    return "netlink"
+}
+
+// List はRTM_GETLINKのダンプを1回だけ取得し、gif、bridge、VLANの設定を取り出す
+func (b *netlinkBackend) List() (map[string]InterfaceConfig, map[string]BridgeConfig, map[string]string, error) {
+    gifInterfaces := make(map[string]InterfaceConfig)
+    bridgeInterfaces := make(map[string]BridgeConfig)
+    vlanInterfaces := make(map[string]string)
+
+    links, err := listLinks()
+    if err != nil {
+        return gifInterfaces, bridgeInterfaces, vlanInterfaces, err
+    }
+
+    for _, link := range links {
+        switch {
+        case gifNamePattern.MatchString(link.Name):
+            config := InterfaceConfig{TunnelID: strings.TrimPrefix(link.Name, "gif"), Description: strings.TrimSpace(link.Alias)}
+            if len(link.Local) > 0 && !link.Local.IsUnspecified() {
+                config.Src, config.Dst = link.Local.String(), link.Remote.String()
+                config.IsIPv6 = link.Kind == "ip6gretap"
+            }
+            gifInterfaces[link.Name] = config
+        case bridgeNamePattern.MatchString(link.Name):
+            members := []string{}
+            for _, member := range links {
+                if member.Master == link.Index {
+                    members = append(members, member.Name)
+                }
+            }
+            bridgeInterfaces[link.Name] = BridgeConfig{Members: members, TunnelID: strings.TrimPrefix(link.Name, "bridge")}
+        case vlanNamePattern.MatchString(link.Name) && link.Kind == "vlan":
+            vlanInterfaces[link.Name] = strconv.Itoa(link.VlanID)
+        }
+    }
+    return gifInterfaces, bridgeInterfaces, vlanInterfaces, nil
+}
+
+// listLinks はすべてのインターフェイスをRTM_GETLINKのダンプで取得する
+func listLinks() ([]netlinkLink, error) {
+    rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+    if err != nil {
+        return nil, fmt.Errorf("failed to dump links: %v", err)
+    }
+    msgs, err := syscall.ParseNetlinkMessage(rib)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse links: %v", err)
+    }
+
+    var links []netlinkLink
+    for _, m := range msgs {
+        if m.Header.Type != syscall.RTM_NEWLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+            continue
+        }
+        link := netlinkLink{
+            Index: int32(binary.NativeEndian.Uint32(m.Data[4:8])),
+            Flags: binary.NativeEndian.Uint32(m.Data[8:12]),
+        }
+        attrs := parseNlAttrs(m.Data[syscall.SizeofIfInfomsg:])
+        link.Name = nlString(attrs[syscall.IFLA_IFNAME])
+        link.Alias = nlString(attrs[syscall.IFLA_IFALIAS])
+        if v := attrs[syscall.IFLA_MTU]; len(v) == 4 {
+            link.MTU = binary.NativeEndian.Uint32(v)
+        }
+        if v := attrs[syscall.IFLA_MASTER]; len(v) == 4 {
+            link.Master = int32(binary.NativeEndian.Uint32(v))
+        }
+        if v := attrs[syscall.IFLA_LINK]; len(v) == 4 {
+            link.Link = int32(binary.NativeEndian.Uint32(v))
+        }
+        info := parseNlAttrs(attrs[syscall.IFLA_LINKINFO])
+        link.Kind = nlString(info[iflaInfoKind])
+        data := parseNlAttrs(info[iflaInfoData])
+        switch link.Kind {
+        case "gretap", "ip6gretap":
+            link.Local = net.IP(data[iflaGreLocal])
+            link.Remote = net.IP(data[iflaGreRemote])
+        case "vlan":
+            if v := data[iflaVlanID]; len(v) == 2 {
+                link.VlanID = int(binary.NativeEndian.Uint16(v))
+            }
+        }
+        links = append(links, link)
+    }
+    return links, nil
+}
+
+// findLink は名前でインターフェイスを探す。存在しない場合はnil
+func findLink(name string) (*netlinkLink, error) {
+    links, err := listLinks()
+    if err != nil {
+        return nil, err
+    }
+    for i := range links {
+        if links[i].Name == name {
+            return &links[i], nil
+        }
+    }
+    return nil, nil
+}
+
+// Apply は操作をrtnetlinkのメッセージに変換して実行する
+func (b *netlinkBackend) Apply(op Operation) error {
+    return applyWithRetry(op, applyNetlink)
+}
+
+func applyNetlink(op Operation) error {
+    switch op.Action {
+    case "create":
+        switch {
+        case gifNamePattern.MatchString(op.Iface):
+            // gretapとip6gretapは作成後に種類を変えられないため、tunnelで送信元が決まるまで作成しない
+            slog.Debug("Deferring gif creation until tunnel is configured", "gif", op.Iface)
+            return nil
+        case bridgeNamePattern.MatchString(op.Iface):
+            return newLink(op.Iface, "bridge", nil)
+        case vlanNamePattern.MatchString(op.Iface):
+            i := strings.LastIndex(op.Iface, ".")
+            return createVLAN(op.Iface, op.Iface[i+1:], op.Iface[:i])
+        default:
+            return fmt.Errorf("unsupported interface name: %s", op.Iface)
+        }
+    case "destroy":
+        err := netlinkRequest(syscall.RTM_DELLINK, 0, 0, nlAttr(syscall.IFLA_IFNAME, nlCString(op.Iface)))
+        if gifNamePattern.MatchString(op.Iface) && errors.Is(err, syscall.ENODEV) {
+            // createを遅らせているため、tunnelの前にロールバックされたgifは存在しない
+            return nil
+        }
+        return err
+    case "up":
+        return setLinkUp(op.Iface)
+    case "link0":
+        // gretapは常にEthernetフレームを運ぶため、EtherIPモードに相当する設定はない
+        return nil
+    case "mtu":
+        if len(op.Args) != 1 {
+            return fmt.Errorf("mtu requires 1 argument")
+        }
+        mtu, err := strconv.Atoi(op.Args[0])
+        if err != nil || mtu <= 0 {
+            return fmt.Errorf("invalid mtu: %s", op.Args[0])
+        }
+        return setLink(op.Iface, nlAttr(syscall.IFLA_MTU, nlUint32(uint32(mtu))))
+    case "description":
+        if len(op.Args) != 1 {
+            return fmt.Errorf("description requires 1 argument")
+        }
+        return setLink(op.Iface, nlAttr(syscall.IFLA_IFALIAS, []byte(op.Args[0])))
+    case "-description":
+        return setLink(op.Iface, nlAttr(syscall.IFLA_IFALIAS, nil))
+    case "tunnel":
+        if len(op.Args) != 2 {
+            return fmt.Errorf("tunnel requires 2 arguments")
+        }
+        return setTunnel(op.Iface, op.Args[0], op.Args[1])
+    case "vlan":
+        if len(op.Args) != 2 {
+            return fmt.Errorf("vlan requires 2 arguments")
+        }
+        return configureVLAN(op.Iface, op.Args[0], op.Args[1])
+    case "addm":
+        if len(op.Args) != 1 {
+            return fmt.Errorf("addm requires 1 argument")
+        }
+        bridge, err := findLink(op.Iface)
+        if err != nil {
+            return err
+        }
+        if bridge == nil {
+            return syscall.ENODEV
+        }
+        return setLink(op.Args[0], nlAttr(syscall.IFLA_MASTER, nlUint32(uint32(bridge.Index))))
+    default:
+        return fmt.Errorf("unsupported action: %s", op.Action)
+    }
+}
+
+// setTunnel はgretapまたはip6gretapの送信元と宛先を設定する
+// 存在しなければ作成し、アドレスファミリが変わる場合はMTU、説明文、所属bridgeを引き継いで作り直す
+func setTunnel(iface, src, dst string) error {
+    srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+    if srcIP == nil || dstIP == nil {
+        return fmt.Errorf("invalid tunnel address: %s --> %s", src, dst)
+    }
+    if (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+        return fmt.Errorf("source and destination address families do not match")
+    }
+    kind := "ip6gretap"
+    if srcIP.To4() != nil {
+        kind = "gretap"
+        srcIP, dstIP = srcIP.To4(), dstIP.To4()
+    }
+    data := [][]byte{nlAttr(iflaGreLocal, srcIP), nlAttr(iflaGreRemote, dstIP)}
+
+    current, err := findLink(iface)
+    if err != nil {
+        return err
+    }
+    if current == nil {
+        return newLink(iface, kind, data)
+    }
+    if current.Kind == kind {
+        return setLink(iface, nlLinkInfo(kind, data))
+    }
+
+    slog.Info("Recreating tunnel for address family change", "gif", iface, "from", current.Kind, "to", kind)
+    if err := netlinkRequest(syscall.RTM_DELLINK, 0, 0, nlAttr(syscall.IFLA_IFNAME, nlCString(iface))); err != nil {
+        return err
+    }
+    extra := [][]byte{nlAttr(syscall.IFLA_MTU, nlUint32(current.MTU))}
+    if current.Alias != "" {
+        extra = append(extra, nlAttr(syscall.IFLA_IFALIAS, []byte(current.Alias)))
+    }
+    if current.Master > 0 {
+        extra = append(extra, nlAttr(syscall.IFLA_MASTER, nlUint32(uint32(current.Master))))
+    }
+    if err := newLink(iface, kind, data, extra...); err != nil {
+        return err
+    }
+    if current.Flags&syscall.IFF_UP != 0 {
+        return setLinkUp(iface)
+    }
+    return nil
+}
+
+// configureVLAN はVLAN IDと親インターフェイスを設定してupする
+// LinuxではVLAN IDを後から変えられないため、異なる場合は作り直す
+func configureVLAN(iface, tag, parent string) error {
+    current, err := findLink(iface)
+    if err != nil {
+        return err
+    }
+    if current != nil {
+        parentLink, err := findLink(parent)
+        if err != nil {
+            return err
+        }
+        if current.Kind != "vlan" || strconv.Itoa(current.VlanID) != tag || parentLink == nil || current.Link != parentLink.Index {
+            if err := netlinkRequest(syscall.RTM_DELLINK, 0, 0, nlAttr(syscall.IFLA_IFNAME, nlCString(iface))); err != nil {
+                return err
+            }
+            current = nil
+        }
+    }
+    if current == nil {
+        if err := createVLAN(iface, tag, parent); err != nil {
+            return err
+        }
+    }
+    return setLinkUp(iface)
+}
+
+// createVLAN はparent上にVLAN IDがtagのVLANインターフェイスを作成する
+func createVLAN(iface, tag, parent string) error {
+    id, err := strconv.Atoi(tag)
+    if err != nil || id < 0 || id > 4095 {
+        return fmt.Errorf("invalid vlan tag: %s", tag)
+    }
+    parentLink, err := findLink(parent)
+    if err != nil {
+        return err
+    }
+    if parentLink == nil {
+        return fmt.Errorf("parent interface %s does not exist", parent)
+    }
+    vlanID := make([]byte, 2)
+    binary.NativeEndian.PutUint16(vlanID, uint16(id))
+    return newLink(iface, "vlan", [][]byte{nlAttr(iflaVlanID, vlanID)}, nlAttr(syscall.IFLA_LINK, nlUint32(uint32(parentLink.Index))))
+}
+
+// newLink はkindのインターフェイスを作成する。dataはIFLA_INFO_DATAに入れる属性
+func newLink(iface, kind string, data [][]byte, extra ...[]byte) error {
+    attrs := append([][]byte{nlAttr(syscall.IFLA_IFNAME, nlCString(iface)), nlLinkInfo(kind, data)}, extra...)
+    return netlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, 0, attrs...)
+}
+
+// setLink は既存のインターフェイスの属性を変更する
+func setLink(iface string, attrs ...[]byte) error {
+    return netlinkRequest(syscall.RTM_NEWLINK, 0, 0, append([][]byte{nlAttr(syscall.IFLA_IFNAME, nlCString(iface))}, attrs...)...)
+}
+
+func setLinkUp(iface string) error {
+    return netlinkRequest(syscall.RTM_NEWLINK, 0, syscall.IFF_UP, nlAttr(syscall.IFLA_IFNAME, nlCString(iface)))
+}
+
+// netlinkRequest はifinfomsgと属性からなる要求を送り、ACKを待つ
+// upにはifi_flagsとifi_changeに設定するフラグを指定する
+func netlinkRequest(msgType, flags uint16, up uint32, attrs ...[]byte) error {
+    fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+    if err != nil {
+        return err
+    }
+    defer syscall.Close(fd)
+    sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+    if err := syscall.Bind(fd, sa); err != nil {
+        return err
+    }
+
+    // ifinfomsg: family, pad, type, index, flags, change
+    ifi := make([]byte, syscall.SizeofIfInfomsg)
+    binary.NativeEndian.PutUint32(ifi[8:12], up)
+    binary.NativeEndian.PutUint32(ifi[12:16], up)
+    body := bytes.Join(append([][]byte{ifi}, attrs...), nil)
+
+    msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+    binary.NativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(body)))
+    binary.NativeEndian.PutUint16(msg[4:6], msgType)
+    binary.NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+    binary.NativeEndian.PutUint32(msg[8:12], 1)
+    msg = append(msg, body...)
+    if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+        return err
+    }
+
+    buf := make([]byte, os.Getpagesize())
+    for {
+        n, _, err := syscall.Recvfrom(fd, buf, 0)
+        if err != nil {
+            return err
+        }
+        msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+        if err != nil {
+            return err
+        }
+        for _, m := range msgs {
+            if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+                continue
+            }
+            if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+                return syscall.Errno(-errno)
+            }
+            return nil
+        }
+    }
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+    l := syscall.SizeofRtAttr + len(data)
+    b := make([]byte, nlAlign(l))
+    binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+    binary.NativeEndian.PutUint16(b[2:4], typ)
+    copy(b[syscall.SizeofRtAttr:], data)
+    return b
+}
+
+// nlLinkInfo はIFLA_LINKINFOにkindとIFLA_INFO_DATAを入れた属性を作る
+func nlLinkInfo(kind string, data [][]byte) []byte {
+    info := [][]byte{nlAttr(iflaInfoKind, []byte(kind))}
+    if len(data) > 0 {
+        info = append(info, nlAttr(iflaInfoData|nlaFNested, bytes.Join(data, nil)))
+    }
+    return nlAttr(syscall.IFLA_LINKINFO|nlaFNested, bytes.Join(info, nil))
+}
+
+func nlUint32(v uint32) []byte {
+    b := make([]byte, 4)
+    binary.NativeEndian.PutUint32(b, v)
+    return b
+}
+
+func nlCString(s string) []byte {
+    return append([]byte(s), 0)
+}
+
+func nlString(b []byte) string {
+    return strings.TrimRight(string(b), "\x00")
+}
+
+func nlAlign(l int) int {
+    return (l + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// parseNlAttrs は属性の並びを種類ごとのmapにする。ネストした属性はもう一度この関数で解析する
+func parseNlAttrs(b []byte) map[uint16][]byte {
+    attrs := make(map[uint16][]byte)
+    for len(b) >= syscall.SizeofRtAttr {
+        l := int(binary.NativeEndian.Uint16(b[0:2]))
+        if l < syscall.SizeofRtAttr || l > len(b) {
+            break
+        }
+        attrs[binary.NativeEndian.Uint16(b[2:4])&nlaTypeMask] = b[syscall.SizeofRtAttr:l]
+        b = b[min(nlAlign(l), len(b)):]
+    }
+    return attrs
+}
+
+// InterfaceAddr はnetlinkから取得したアドレスを返す
+func (b *netlinkBackend) InterfaceAddr(iface string, isIPv6 bool) (string, error) {
+    return netInterfaceAddr(iface, isIPv6)
+}
+
+// InterfaceNames はnetlinkでインターフェイス名の一覧を取得
+func (b *netlinkBackend) InterfaceNames() ([]string, error) {
+    return netInterfaceNames()
+}
+
+// LinkState はnetlinkから取得したフラグからリンク状態を返す
+func (b *netlinkBackend) LinkState(iface string) (string, error) {
+    return netLinkState(iface)
+}
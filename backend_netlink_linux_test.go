@@ -0,0 +1,151 @@
+//go:build linux
+
+package main
+
+import (
+    "errors"
+    "os"
+    "reflect"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// useNetlinkHost はnetlinkバックエンドで実際にインターフェイスを作るテストの準備をする
+// rootで、loしかない新しいネットワーク名前空間で実行した場合だけ動かす。例:
+//   sudo unshare -n go test -run Netlink ./...
+//
+// VLANの親としてdummyインターフェイスem2を作る。dummyを使えないカーネルではbridgeで代用する
+func useNetlinkHost(t *testing.T) {
+    t.Helper()
+    if os.Geteuid() != 0 {
+        t.Skip("requires root in a fresh network namespace")
+    }
+    links, err := listLinks()
+    if err != nil {
+        t.Fatalf("listLinks: %v", err)
+    }
+    for _, link := range links {
+        if link.Name != "lo" {
+            t.Skipf("requires a fresh network namespace, found %s", link.Name)
+        }
+    }
+    if err := newLink("em2", "dummy", nil); err != nil {
+        if err := newLink("em2", "bridge", nil); err != nil {
+            t.Skipf("no interface kind for the VLAN parent: %v", err)
+        }
+    }
+    t.Cleanup(func() {
+        for _, link := range mustListLinks(t) {
+            if link.Name != "lo" {
+                netlinkRequest(syscall.RTM_DELLINK, 0, 0, nlAttr(syscall.IFLA_IFNAME, nlCString(link.Name)))
+            }
+        }
+    })
+    if err := setLinkUp("em2"); err != nil {
+        t.Fatalf("em2 up: %v", err)
+    }
+
+    savedBackend, savedOwnership := backend, ownership
+    t.Cleanup(func() { backend, ownership = savedBackend, savedOwnership })
+    backend = &netlinkBackend{}
+    ownership = &OwnershipRegistry{Interfaces: make(map[string]time.Time)}
+}
+
+func mustListLinks(t *testing.T) map[string]netlinkLink {
+    t.Helper()
+    links, err := listLinks()
+    if err != nil {
+        t.Fatalf("listLinks: %v", err)
+    }
+    byName := make(map[string]netlinkLink)
+    for _, link := range links {
+        byName[link.Name] = link
+    }
+    return byName
+}
+
+// TestNetlinkRoundTrip はgretap、ip6gretap、VLAN、bridgeを作成、変更、削除し、Listで読み戻す
+func TestNetlinkRoundTrip(t *testing.T) {
+    useNetlinkHost(t)
+    if err := newLink("gretap-probe", "gretap", [][]byte{nlAttr(iflaGreLocal, []byte{192, 0, 2, 1}), nlAttr(iflaGreRemote, []byte{192, 0, 2, 2})}); err != nil {
+        if errors.Is(err, syscall.EOPNOTSUPP) {
+            t.Skipf("gretap unavailable: %v", err)
+        }
+        t.Fatalf("gretap probe: %v", err)
+    }
+    netlinkRequest(syscall.RTM_DELLINK, 0, 0, nlAttr(syscall.IFLA_IFNAME, nlCString("gretap-probe")))
+
+    tunnel1 := TunnelConfig{TunnelID: "1", SrcAddr: "192.0.2.1", DstAddr: "198.51.100.1", VlanID: "100", Description: "Customer A"}
+    tunnel2 := TunnelConfig{TunnelID: "2", SrcAddr: "2001:db8::1", DstAddr: "2001:db8::2", VlanID: "101"}
+    tunnel1v6 := tunnel1
+    tunnel1v6.SrcAddr, tunnel1v6.DstAddr = "2001:db8::1", "2001:db8::11"
+    tunnel1vlan := tunnel1v6
+    tunnel1vlan.VlanID = "200"
+
+    steps := []struct {
+        name      string
+        configs   []TunnelConfig
+        wantState map[string]string
+        wantKinds map[string]string
+    }{
+        {
+            name:    "create gretap and ip6gretap",
+            configs: []TunnelConfig{tunnel1, tunnel2},
+            wantState: map[string]string{
+                "gif1": "192.0.2.1 198.51.100.1 Customer A", "em2.100": "100", "bridge1": "em2.100,gif1",
+                "gif2": "2001:db8::1 2001:db8::2", "em2.101": "101", "bridge2": "em2.101,gif2",
+            },
+            wantKinds: map[string]string{"gif1": "gretap", "gif2": "ip6gretap", "em2.100": "vlan", "bridge1": "bridge"},
+        },
+        {
+            name:    "recreate gif on address family change",
+            configs: []TunnelConfig{tunnel1v6, tunnel2},
+            wantState: map[string]string{
+                "gif1": "2001:db8::1 2001:db8::11 Customer A", "em2.100": "100", "bridge1": "em2.100,gif1",
+                "gif2": "2001:db8::1 2001:db8::2", "em2.101": "101", "bridge2": "em2.101,gif2",
+            },
+            wantKinds: map[string]string{"gif1": "ip6gretap"},
+        },
+        {
+            name:    "change vlan_id",
+            configs: []TunnelConfig{tunnel1vlan, tunnel2},
+            wantState: map[string]string{
+                "gif1": "2001:db8::1 2001:db8::11 Customer A", "em2.200": "200", "bridge1": "em2.200,gif1",
+                "gif2": "2001:db8::1 2001:db8::2", "em2.101": "101", "bridge2": "em2.101,gif2",
+            },
+            wantKinds: map[string]string{"em2.200": "vlan"},
+        },
+        {
+            name:      "remove tunnel",
+            configs:   []TunnelConfig{tunnel1vlan},
+            wantState: map[string]string{"gif1": "2001:db8::1 2001:db8::11 Customer A", "em2.200": "200", "bridge1": "em2.200,gif1"},
+        },
+    }
+
+    for _, step := range steps {
+        if _, result := planAndExecute(t, step.configs); result.Failed > 0 {
+            t.Fatalf("%s: apply failed: %+v", step.name, result)
+        }
+        if got := hostState(t); !reflect.DeepEqual(got, step.wantState) {
+            t.Errorf("%s: state:\n got %v\nwant %v", step.name, got, step.wantState)
+        }
+        links := mustListLinks(t)
+        for name, kind := range step.wantKinds {
+            if links[name].Kind != kind {
+                t.Errorf("%s: %s kind = %q, want %q", step.name, name, links[name].Kind, kind)
+            }
+        }
+        for name, link := range links {
+            if name != "lo" && link.Flags&syscall.IFF_UP == 0 {
+                t.Errorf("%s: %s is down", step.name, name)
+            }
+        }
+        if vlan, ok := links["em2.100"]; ok && vlan.Link != links["em2"].Index {
+            t.Errorf("%s: em2.100 parent index = %d, want em2 %d", step.name, vlan.Link, links["em2"].Index)
+        }
+        if again, _ := planAndExecute(t, step.configs); !again.Empty() {
+            t.Errorf("%s: second plan not empty: %v", step.name, again.Operations())
+        }
+    }
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// ConfigCache は最後に取得と検証ができた設定の内容
+// config_sourceに到達できない場合はこれを使って起動する
+type ConfigCache struct {
+    Source    string    `json:"source"`
+    FetchedAt time.Time `json:"fetched_at"`
+    SHA256    string    `json:"sha256"`
+    Data      string    `json:"data"`
+    Signature string    `json:"signature,omitempty"` // signature_sourceから読み込んだ署名
+    Format    string    `json:"format,omitempty"`    // 設定の形式。空ならJSON
+}
+
+// configFetchState は設定の取得状況
+type configFetchState struct {
+    failures       int              // 連続して取得に失敗した回数
+    succeeded      bool             // 起動後に一度でも取得できたか
+    usingCache     bool             // キャッシュで動作中か
+    serial         int64            // 適用する設定のシリアル番号。封筒のない設定では0
+    source         string           // 適用する設定を取得したソース
+    configs        []TunnelConfig   // 適用する設定。config_sourceが変わっていない場合に使う
+    validators     sourceValidators // sourceから最後に受け入れた設定のETagとLast-Modified
+    body           []byte           // sourceから最後に受け入れた設定。断片だけが変わった場合に結合し直すのに使う
+    signature      []byte           // bodyの署名
+    format         string           // bodyの形式
+    fragments      string           // bodyと結合したconfig_dirとconfig_overrideのハッシュ
+    driftCheckedAt time.Time        // 最後に現在の状態を設定と突き合わせた時刻
+}
+
+var fetchState configFetchState
+
+// sourceValidators はHTTPの条件付きリクエストに使うETagとLast-Modified
+type sourceValidators struct {
+    etag         string
+    lastModified string
+}
+
+// errNotModified は条件付きリクエストに304が返り、設定が前回受け入れたものから変わっていないことを表す
+var errNotModified = errors.New("config not modified")
+
+// configFetch は1回の設定の取得結果
+type configFetch struct {
+    source      string
+    body        []byte
+    signature   []byte
+    format      string // bodyの形式。json、yaml、toml
+    validators  sourceValidators
+    notModified bool
+    fragments   string // 取得時のconfig_dirとconfig_overrideのハッシュ
+    err         error
+    elapsed     time.Duration
+}
+
+// fetchSource は1つのソースから設定と署名を読み込む
+// conditionalがtrueの場合は前回受け入れた設定のETagとLast-Modifiedで条件付きリクエストを送る
+func fetchSource(settings *Settings, source string, conditional bool) configFetch {
+    fetch := configFetch{source: source}
+    var validators sourceValidators
+    if conditional {
+        validators = fetchState.validators
+    }
+    fetch.body, fetch.validators, fetch.format, fetch.err = readConfigSourceIfModified(source, validators)
+    if errors.Is(fetch.err, errNotModified) {
+        fetch.notModified, fetch.err = true, nil
+    } else if fetch.err == nil {
+        fetch.signature, fetch.err = readSignature(settings, source)
+    }
+    return fetch
+}
+
+// configCachePath はキャッシュのファイル名を返す
+func configCachePath(settings *Settings) string {
+    return filepath.Join(settings.StateDir, "config-cache.json")
+}
+
+// saveConfigCache は取得できた設定を取得元、取得日時とハッシュ、署名と形式とともに保存する
+func saveConfigCache(settings *Settings, fetch configFetch) error {
+    sum := sha256.Sum256(fetch.body)
+    cache := ConfigCache{
+        Source:    fetch.source,
+        FetchedAt: time.Now(),
+        SHA256:    hex.EncodeToString(sum[:]),
+        Data:      string(fetch.body),
+        Signature: string(fetch.signature),
+        Format:    fetch.format,
+    }
+    data, err := json.MarshalIndent(cache, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to marshal config cache: %v", err)
+    }
+    return writeStateFile(configCachePath(settings), data)
+}
+
+// loadConfigCache は保存された設定を読み込み、ハッシュが一致することを確認する
+func loadConfigCache(settings *Settings) (*ConfigCache, error) {
+    data, err := os.ReadFile(configCachePath(settings))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read config cache: %v", err)
+    }
+    var cache ConfigCache
+    if err := json.Unmarshal(data, &cache); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal config cache: %v", err)
+    }
+    sum := sha256.Sum256([]byte(cache.Data))
+    if hex.EncodeToString(sum[:]) != cache.SHA256 {
+        return nil, fmt.Errorf("config cache is corrupted: sha256 mismatch")
+    }
+    return &cache, nil
+}
+
+// loadConfig は取得した設定を解釈し、成功すればキャッシュを更新する
+// 設定が変わっていない場合は解釈せずに前回の設定を返す
+// 起動後まだ一度も取得できていない場合、またはcache_after_failures回続けて失敗した場合はキャッシュを使う
+// fetchedはソースから取得した設定か、304で変わっていないことを確かめた設定ならtrue、キャッシュの設定ならfalse
+func loadConfig(settings *Settings, fetch configFetch, currentGifs map[string]InterfaceConfig) ([]TunnelConfig, bool, error) {
+    var configs []TunnelConfig
+    var serial int64
+    err := fetch.err
+    if err == nil && !fetch.notModified {
+        serial, configs, err = acceptConfig(settings, fetch, currentGifs)
+    }
+    recordFetch(err, fetch.notModified, fetch.elapsed)
+    if err == nil {
+        if fetch.notModified {
+            slog.Debug("Config not modified", "source", fetch.source, "serial", fetchState.serial)
+            configs, serial = fetchState.configs, fetchState.serial
+        } else {
+            if err := saveConfigCache(settings, fetch); err != nil {
+                slog.Error("Failed to save config cache", "path", configCachePath(settings), "error", err)
+            }
+            fetchState.validators = fetch.validators
+            fetchState.body, fetchState.signature, fetchState.format, fetchState.fragments = fetch.body, fetch.signature, fetch.format, fetch.fragments
+        }
+        if fetchState.usingCache {
+            slog.Warn("Config source recovered, leaving cached config", "source", fetch.source)
+        }
+        fetchState.failures, fetchState.succeeded, fetchState.usingCache = 0, true, false
+        fetchState.serial, fetchState.configs, fetchState.source = serial, configs, fetch.source
+        sources.activate(settings, fetch.source)
+        health.recordFetch(nil, time.Now(), false)
+        metrics.Set("eipconf_config_from_cache", "", 0)
+        return configs, true, nil
+    }
+
+    fetchState.failures++
+    health.recordFetch(err, time.Time{}, false)
+    if fetchState.succeeded && fetchState.failures < settings.CacheAfterFailures {
+        return nil, false, err
+    }
+
+    cache, cerr := loadConfigCache(settings)
+    if cerr != nil {
+        slog.Error("Cached config unavailable", "path", configCachePath(settings), "error", cerr)
+        return nil, false, err
+    }
+    serial, configs, cerr = acceptConfig(settings, cache.fetched(), currentGifs)
+    if cerr != nil {
+        slog.Error("Failed to parse cached config", "path", configCachePath(settings), "error", cerr)
+        return nil, false, err
+    }
+    if !fetchState.usingCache {
+        // 署名の検証に失敗した設定は改ざんのおそれがあるのでERRORとする
+        level := slog.LevelWarn
+        if isSignatureError(err) {
+            level = slog.LevelError
+        }
+        slog.Log(context.Background(), level, "Config source unavailable, running from cached config", "sources", settings.ConfigSources, "failures", fetchState.failures,
+            "cached_source", cache.Source, "fetched_at", cache.FetchedAt, "sha256", cache.SHA256, "serial", serial, "error", err)
+    } else {
+        slog.Info("Still running from cached config", "sources", settings.ConfigSources, "failures", fetchState.failures, "fetched_at", cache.FetchedAt, "error", err)
+    }
+    fetchState.usingCache = true
+    fetchState.serial, fetchState.configs, fetchState.source = serial, configs, cache.Source
+    health.recordFetch(err, cache.FetchedAt, true)
+    metrics.Set("eipconf_config_from_cache", "", 1)
+    return configs, false, nil
+}
+
+// fetched はキャッシュした設定を取得結果として返す。署名がなければsignatureはnil
+func (c *ConfigCache) fetched() configFetch {
+    fetch := configFetch{source: c.Source, body: []byte(c.Data), format: c.Format}
+    if c.Signature != "" {
+        fetch.signature = []byte(c.Signature)
+    }
+    return fetch
+}
+
+// openConfig は取得した設定の署名を検証してJSONに変換する
+// signature_sourceの署名は取得した内容そのものを、封筒の署名はJSONの封筒を検証する
+func openConfig(settings *Settings, fetch configFetch) (*configDocument, error) {
+    if fetch.signature != nil {
+        if err := verifyConfig(settings, fetch.body, fetch.signature); err != nil {
+            return nil, err
+        }
+    }
+    doc, err := parseConfigDocument(fetch.body, fetch.format)
+    if err != nil {
+        return nil, err
+    }
+    if fetch.signature == nil {
+        if doc.format != formatJSON && len(settings.TrustedKeys) > 0 {
+            return nil, &signatureError{reason: fmt.Sprintf("envelope signatures are only supported in JSON, use signature_source for %s config", strings.ToUpper(doc.format))}
+        }
+        if err := verifyConfig(settings, doc.data, nil); err != nil {
+            return nil, err
+        }
+    }
+    return doc, nil
+}
+
+// acceptConfig は設定の署名を検証し、シリアル番号が適用済みのものより古くないことを確かめてから、断片を結合して解釈する
+func acceptConfig(settings *Settings, fetch configFetch, currentGifs map[string]InterfaceConfig) (int64, []TunnelConfig, error) {
+    doc, err := openConfig(settings, fetch)
+    if err != nil {
+        return 0, nil, err
+    }
+    envelope, err := decodeConfig(doc)
+    if err != nil {
+        return 0, nil, err
+    }
+    if err := checkSerial(settings, envelope.Serial); err != nil {
+        return 0, nil, err
+    }
+    if doc, err = mergeConfig(settings, fetch.source, doc); err != nil {
+        return 0, nil, err
+    }
+    configs, err := parseConfig(doc, currentGifs, *settings)
+    return envelope.Serial, configs, err
+}
+
+// writeStateFile はstate_dirのファイルを一時ファイルに書き込んでから置き換える
+func writeStateFile(path string, data []byte) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("failed to create state directory: %v", err)
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return fmt.Errorf("failed to write %s: %v", tmp, err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return fmt.Errorf("failed to write %s: %v", path, err)
+    }
+    return nil
+}
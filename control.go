@@ -0,0 +1,333 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// CycleResult は1回の再設定の計画と適用結果
+type CycleResult struct {
+    At         time.Time      `json:"at"`
+    Trigger    string         `json:"trigger"` // "loop", "SIGHUP", "control" など
+    Serial     int64          `json:"serial,omitempty"` // 設定のシリアル番号
+    Source     string         `json:"source,omitempty"` // 設定を取得したソース
+    Skipped    bool           `json:"skipped,omitempty"` // 設定が変わらず、インターフェイスの確認も省いた
+    Plan       *ReconcilePlan `json:"plan"`
+    Result     *ApplyResult   `json:"result,omitempty"` // セーフガードで止めた場合はnil
+    HeldReason string         `json:"held_reason,omitempty"`
+}
+
+// controller は再設定とリセットを1つずつ実行し、ループの一時停止と直近の結果を管理する
+// 監視ループ、シグナル、制御ソケットはすべてこれを通して操作する
+type controller struct {
+    mu     sync.Mutex // 再設定とリセットの実行中に取る
+    state  sync.Mutex // pausedとlastを守る
+    paused bool
+    last   *CycleResult
+}
+
+var control = &controller{}
+
+// run はfnを他の操作と重ならないように実行し、成功した場合は結果を直近の結果として記録する
+func (c *controller) run(trigger string, fn func() (CycleResult, error)) (CycleResult, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    result, err := fn()
+    if err != nil {
+        return result, err
+    }
+    result.Trigger = trigger
+    // 何もしなかったサイクルで直近の計画と結果を上書きしない
+    if result.Skipped {
+        return result, nil
+    }
+    c.state.Lock()
+    c.last = &result
+    c.state.Unlock()
+    return result, nil
+}
+
+// Reconcile は設定を取得して差分を適用する
+func (c *controller) Reconcile(settings *Settings, trigger string) (CycleResult, error) {
+    return c.run(trigger, func() (CycleResult, error) {
+        // 定期的な再設定だけが、変わっていない設定の解釈とインターフェイスの確認を省く
+        return reconcile(settings, trigger == "loop")
+    })
+}
+
+// ResetVLANs は物理インターフェイスのVLANを削除してから再設定する
+func (c *controller) ResetVLANs(settings *Settings, trigger string) (CycleResult, error) {
+    return c.run(trigger, func() (CycleResult, error) {
+        currentGifs, _, currentVLANs := getCurrentInterfaces()
+        if err := resetVLANs(settings.PhysicalIface, currentVLANs); err != nil {
+            return CycleResult{}, err
+        }
+        return reconfigureAfterReset(trigger, currentGifs, settings)
+    })
+}
+
+// ResetAll はトンネル、VLAN、ブリッジを削除してから再設定する
+func (c *controller) ResetAll(settings *Settings, trigger string) (CycleResult, error) {
+    return c.run(trigger, func() (CycleResult, error) {
+        currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
+        if err := resetAllInterfaces(currentGifs, currentVLANs, currentBridges); err != nil {
+            return CycleResult{}, err
+        }
+        return reconfigureAfterReset(trigger, currentGifs, settings)
+    })
+}
+
+// ResetTunnel は1つのトンネルのgif、bridge、VLANを削除してから再設定する
+func (c *controller) ResetTunnel(settings *Settings, tunnelID, trigger string) (CycleResult, error) {
+    return c.run(trigger, func() (CycleResult, error) {
+        currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
+        if err := resetTunnel(settings.PhysicalIface, tunnelID, currentGifs, currentBridges, currentVLANs); err != nil {
+            return CycleResult{}, err
+        }
+        return reconfigureAfterReset(trigger, currentGifs, settings)
+    })
+}
+
+// SetPaused は監視ループの一時停止と再開を切り替える。制御ソケットとシグナルからの操作は止めない
+func (c *controller) SetPaused(paused bool) {
+    c.state.Lock()
+    defer c.state.Unlock()
+    if c.paused != paused {
+        if paused {
+            slog.Warn("Reconcile loop paused")
+        } else {
+            slog.Info("Reconcile loop resumed")
+        }
+    }
+    c.paused = paused
+}
+
+func (c *controller) Paused() bool {
+    c.state.Lock()
+    defer c.state.Unlock()
+    return c.paused
+}
+
+// Last は直近の再設定の結果を返す。まだ一度も実行していなければnil
+func (c *controller) Last() *CycleResult {
+    c.state.Lock()
+    defer c.state.Unlock()
+    return c.last
+}
+
+// ControlStatus は制御ソケットのGET /statusの応答
+type ControlStatus struct {
+    Paused       bool          `json:"paused"`
+    Backend      string        `json:"backend"`
+    ConfigSource string        `json:"config_source"` // 最後に設定を受け入れたソース
+    Sources      []SourceState `json:"sources"`
+    FromCache    bool          `json:"from_cache"`
+    LastCycleAt  *time.Time    `json:"last_cycle_at,omitempty"`
+    Health       HealthReport  `json:"health"`
+}
+
+// writeControlJSON はvをJSONで返す
+func writeControlJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(v)
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+    writeControlJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// controlHandler は制御ソケットのAPIを返す
+//   GET  /status              一時停止中か、キャッシュで動作中か、/readyzと同じ確認結果
+//   GET  /plan                直近の再設定の計画と結果
+//   POST /reconcile           設定を取得して適用（SIGHUP）
+//   POST /reset/vlans         VLANを削除して再設定（SIGUSR1）
+//   POST /reset/all           すべて削除して再設定（SIGUSR2）
+//   POST /tunnels/<ID>/reset  1つのトンネルを削除して再設定
+//   POST /pause, /resume      監視ループの一時停止と再開
+//   POST /approve[?id=ID]     セーフガードで止めた変更を承認
+func controlHandler(settings *Settings) http.Handler {
+    mux := http.NewServeMux()
+    post := func(path string, fn func(w http.ResponseWriter, r *http.Request)) {
+        mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != http.MethodPost {
+                writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST for %s", r.URL.Path))
+                return
+            }
+            slog.Info("Control request", "path", r.URL.Path)
+            fn(w, r)
+        })
+    }
+    cycle := func(w http.ResponseWriter, result CycleResult, err error) {
+        if err != nil {
+            writeControlError(w, http.StatusInternalServerError, err)
+            return
+        }
+        writeControlJSON(w, http.StatusOK, result)
+    }
+
+    mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+        status := ControlStatus{
+            Paused:       control.Paused(),
+            Backend:      backend.Name(),
+            ConfigSource: sources.Active(settings),
+            Sources:      sources.States(settings),
+            Health:       health.report(settings, []string{"loop", "config_age", "apply", "tunnels"}),
+        }
+        status.FromCache = status.Health.Checks["config_age"].FromCache
+        if last := control.Last(); last != nil {
+            status.LastCycleAt = &last.At
+        }
+        writeControlJSON(w, http.StatusOK, status)
+    })
+    mux.HandleFunc("/plan", func(w http.ResponseWriter, r *http.Request) {
+        last := control.Last()
+        if last == nil {
+            writeControlError(w, http.StatusNotFound, fmt.Errorf("no reconcile has completed yet"))
+            return
+        }
+        writeControlJSON(w, http.StatusOK, last)
+    })
+    post("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+        result, err := control.Reconcile(settings, "control")
+        cycle(w, result, err)
+    })
+    post("/reset/vlans", func(w http.ResponseWriter, r *http.Request) {
+        result, err := control.ResetVLANs(settings, "control")
+        cycle(w, result, err)
+    })
+    post("/reset/all", func(w http.ResponseWriter, r *http.Request) {
+        result, err := control.ResetAll(settings, "control")
+        cycle(w, result, err)
+    })
+    post("/tunnels/", func(w http.ResponseWriter, r *http.Request) {
+        id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/tunnels/"), "/reset")
+        if !ok || id == "" || strings.Contains(id, "/") {
+            writeControlError(w, http.StatusNotFound, fmt.Errorf("unknown path: %s", r.URL.Path))
+            return
+        }
+        result, err := control.ResetTunnel(settings, id, "control")
+        cycle(w, result, err)
+    })
+    post("/pause", func(w http.ResponseWriter, r *http.Request) {
+        control.SetPaused(true)
+        writeControlJSON(w, http.StatusOK, map[string]bool{"paused": true})
+    })
+    post("/resume", func(w http.ResponseWriter, r *http.Request) {
+        control.SetPaused(false)
+        writeControlJSON(w, http.StatusOK, map[string]bool{"paused": false})
+    })
+    post("/approve", func(w http.ResponseWriter, r *http.Request) {
+        var out strings.Builder
+        if err := approveHeldPlan(&out, settings, r.URL.Query().Get("id")); err != nil {
+            writeControlError(w, http.StatusConflict, err)
+            return
+        }
+        writeControlJSON(w, http.StatusOK, map[string]string{"message": out.String()})
+    })
+    return mux
+}
+
+// startControlServer はcontrol_socketで制御APIを公開する。ソケットはrootだけが使える
+func startControlServer(settings *Settings) {
+    path := settings.ControlSocket
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+        slog.Error("Failed to remove stale control socket", "path", path, "error", err)
+        return
+    }
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        slog.Error("Failed to listen on control socket", "path", path, "error", err)
+        return
+    }
+    if err := os.Chmod(path, 0600); err != nil {
+        slog.Error("Failed to set control socket permissions", "path", path, "error", err)
+        l.Close()
+        return
+    }
+    go func() {
+        slog.Info("Serving control API", "socket", path)
+        if err := http.Serve(l, controlHandler(settings)); err != nil {
+            slog.Error("Control server stopped", "socket", path, "error", err)
+        }
+    }()
+}
+
+// controlCommands は "eipconf ctl" のコマンドとHTTPメソッド、パス
+var controlCommands = map[string][2]string{
+    "status":      {http.MethodGet, "/status"},
+    "plan":        {http.MethodGet, "/plan"},
+    "reconcile":   {http.MethodPost, "/reconcile"},
+    "reset-vlans": {http.MethodPost, "/reset/vlans"},
+    "reset-all":   {http.MethodPost, "/reset/all"},
+    "pause":       {http.MethodPost, "/pause"},
+    "resume":      {http.MethodPost, "/resume"},
+}
+
+// controlRequest は制御ソケットにリクエストを送る
+func controlRequest(settings *Settings, method, path string) (*http.Response, error) {
+    client := &http.Client{Transport: &http.Transport{
+        DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+            return (&net.Dialer{}).DialContext(ctx, "unix", settings.ControlSocket)
+        },
+    }}
+    req, err := http.NewRequest(method, "http://eipconf"+path, nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to control socket %s: %v", settings.ControlSocket, err)
+    }
+    return resp, nil
+}
+
+// runControlCommand は "eipconf ctl <command> [args]" を制御ソケットに送り、応答をwに書く
+func runControlCommand(w io.Writer, settings *Settings, args []string) error {
+    if len(args) == 0 {
+        return fmt.Errorf("usage: eipconf ctl status|plan|reconcile|reset-vlans|reset-all|reset-tunnel <ID>|pause|resume|approve [ID]")
+    }
+    method, path := http.MethodPost, ""
+    switch args[0] {
+    case "reset-tunnel":
+        if len(args) != 2 {
+            return fmt.Errorf("usage: eipconf ctl reset-tunnel <ID>")
+        }
+        path = "/tunnels/" + args[1] + "/reset"
+    case "approve":
+        path = "/approve"
+        if len(args) == 2 {
+            path += "?id=" + args[1]
+        }
+    default:
+        command, ok := controlCommands[args[0]]
+        if !ok {
+            return fmt.Errorf("unknown control command: %s", args[0])
+        }
+        method, path = command[0], command[1]
+    }
+
+    resp, err := controlRequest(settings, method, path)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if _, err := io.Copy(w, resp.Body); err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("control request failed: %s", resp.Status)
+    }
+    return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ConfigEnvelope はバージョンとシリアル番号つきの設定
+// トンネルの配列だけの設定も受け付け、その場合はVersionとSerialが0になる
+type ConfigEnvelope struct {
+    Version     int            `json:"version" jsonschema:"required;minimum=1;maximum=1"`
+    Serial      int64          `json:"serial" jsonschema:"required;minimum=1"`
+    GeneratedAt time.Time      `json:"generated_at,omitempty"`
+    Tunnels     []TunnelConfig `json:"tunnels" jsonschema:"required"`
+    Signature   string         `json:"signature,omitempty"` // trusted_keysの鍵による署名。signature.goを参照
+}
+
+// AppliedSerial は最後に適用した設定のシリアル番号。state_dirに保存し、これより古い設定は適用しない
+type AppliedSerial struct {
+    Serial    int64     `json:"serial"`
+    UpdatedAt time.Time `json:"updated_at"`
+    Forced    bool      `json:"forced,omitempty"` // eipconf accept-serialで書き換えた
+}
+
+func appliedSerialPath(settings *Settings) string {
+    return filepath.Join(settings.StateDir, "serial.json")
+}
+
+// decodeConfig は設定の内容を読み込む。先頭が "{" なら封筒、それ以外はトンネルの配列として扱う
+// 型が合わない値のエラーには元のファイルでの行と桁をつける
+func decodeConfig(doc *configDocument) (*ConfigEnvelope, error) {
+    var envelope ConfigEnvelope
+    if trimmed := bytes.TrimSpace(doc.data); len(trimmed) == 0 || trimmed[0] != '{' {
+        if err := doc.unmarshal(&envelope.Tunnels); err != nil {
+            return nil, fmt.Errorf("failed to unmarshal %s: %v", strings.ToUpper(doc.format), err)
+        }
+        return &envelope, nil
+    }
+    if err := doc.unmarshal(&envelope); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal %s: %v", strings.ToUpper(doc.format), err)
+    }
+    // TOMLの文書は常にテーブルなので、[[tunnels]]だけのファイルもここで拒否する
+    if envelope.Version == 0 {
+        return nil, fmt.Errorf("config envelope has no version")
+    }
+    if envelope.Version != 1 {
+        return nil, fmt.Errorf("unsupported config version: %d", envelope.Version)
+    }
+    if envelope.Serial <= 0 {
+        return nil, fmt.Errorf("config envelope has no serial")
+    }
+    if envelope.Tunnels == nil {
+        return nil, fmt.Errorf("config envelope has no tunnels")
+    }
+    return &envelope, nil
+}
+
+// loadAppliedSerial は適用済みのシリアル番号を読み込む。まだない場合はSerialが0
+func loadAppliedSerial(settings *Settings) (AppliedSerial, error) {
+    var applied AppliedSerial
+    data, err := os.ReadFile(appliedSerialPath(settings))
+    if os.IsNotExist(err) {
+        return applied, nil
+    }
+    if err != nil {
+        return applied, err
+    }
+    if err := json.Unmarshal(data, &applied); err != nil {
+        return applied, fmt.Errorf("failed to unmarshal applied serial: %v", err)
+    }
+    return applied, nil
+}
+
+// checkSerial は設定のシリアル番号が適用済みのものより古くないかを確認する。シリアル番号のない設定は確認しない
+func checkSerial(settings *Settings, serial int64) error {
+    if serial == 0 {
+        return nil
+    }
+    applied, err := loadAppliedSerial(settings)
+    if err != nil {
+        slog.Error("Failed to load applied serial, accepting config", "path", appliedSerialPath(settings), "serial", serial, "error", err)
+        return nil
+    }
+    if serial < applied.Serial {
+        return fmt.Errorf("config serial %d is older than applied serial %d, run 'eipconf accept-serial %d' to apply it", serial, applied.Serial, serial)
+    }
+    return nil
+}
+
+// recordAppliedSerial は適用した設定のシリアル番号を保存する。変わらない場合は書き込まない
+func recordAppliedSerial(settings *Settings, serial int64) {
+    if serial == 0 {
+        return
+    }
+    metrics.Set("eipconf_config_serial", "", float64(serial))
+    applied, _ := loadAppliedSerial(settings)
+    if applied.Serial == serial && !applied.Forced {
+        return
+    }
+    data, err := json.MarshalIndent(AppliedSerial{Serial: serial, UpdatedAt: time.Now()}, "", "  ")
+    if err == nil {
+        err = writeStateFile(appliedSerialPath(settings), data)
+    }
+    if err != nil {
+        slog.Error("Failed to save applied serial", "path", appliedSerialPath(settings), "serial", serial, "error", err)
+        return
+    }
+    slog.Info("Applied config serial", "serial", serial, "previous", applied.Serial)
+}
+
+// acceptSerial は古いシリアル番号の設定を受け入れるよう、適用済みのシリアル番号を書き換える
+// eipconf accept-serialから呼ばれ、実行中のeipconfは次のサイクルでその設定を適用する
+func acceptSerial(w io.Writer, settings *Settings, arg string) error {
+    serial, err := strconv.ParseInt(arg, 10, 64)
+    if err != nil || serial <= 0 {
+        return fmt.Errorf("usage: eipconf accept-serial SERIAL")
+    }
+    applied, err := loadAppliedSerial(settings)
+    if err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(AppliedSerial{Serial: serial, UpdatedAt: time.Now(), Forced: true}, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := writeStateFile(appliedSerialPath(settings), data); err != nil {
+        return err
+    }
+    fmt.Fprintf(w, "Accepting config serial %d and newer (applied serial was %d)\n", serial, applied.Serial)
+    fmt.Fprintln(w, "The config is applied on the next cycle; run 'eipconf ctl reconcile' to apply it now.")
+    return nil
+}
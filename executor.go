@@ -0,0 +1,28 @@
+package main
+
+import (
+    "os/exec"
+)
+
+// CommandExecutor は外部コマンドの実行を抽象化する
+// ifconfigによる状態取得と変更はすべてこのインターフェイスを経由する
+type CommandExecutor interface {
+    // Output はコマンドを実行し、標準出力を返す
+    Output(name string, args ...string) ([]byte, error)
+    // CombinedOutput はコマンドを実行し、標準出力と標準エラー出力をまとめて返す
+    CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+// execExecutor はos/execで実際にコマンドを実行する
+type execExecutor struct{}
+
+func (execExecutor) Output(name string, args ...string) ([]byte, error) {
+    return exec.Command(name, args...).Output()
+}
+
+func (execExecutor) CombinedOutput(name string, args ...string) ([]byte, error) {
+    return exec.Command(name, args...).CombinedOutput()
+}
+
+// executor はコマンド実行に使う実装。テストではFakeExecutorに差し替える
+var executor CommandExecutor = execExecutor{}
@@ -0,0 +1,502 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// FakeInterface はFakeExecutorが保持するインターフェイスの状態
+type FakeInterface struct {
+    Name        string
+    Kind        string // "physical", "gif", "vlan", "bridge"
+    Index       int
+    Up          bool
+    MTU         int
+    Description string
+    Groups      []string
+    Addrs       []string
+    TunnelSrc   string
+    TunnelDst   string
+    Link0       bool
+    VlanTag     string
+    VlanDev     string
+    Members     []string
+}
+
+type fakeFailure struct {
+    prefix    string
+    remaining int
+    message   string
+}
+
+// FakeExecutor はFreeBSDのgif、VLAN、bridgeの状態をメモリ上に保持し、
+// ifconfigの引数を解釈して実機に近い出力を返すCommandExecutor
+// 実機のないLinux上でcalculatePlan、executePlanや監視ループをテストするために使う
+type FakeExecutor struct {
+    mu        sync.Mutex
+    ifaces    map[string]*FakeInterface
+    nextIndex int
+    failures  []*fakeFailure
+    calls     []string
+}
+
+// fakeExitError はコマンドが非ゼロで終了したことを表す
+type fakeExitError struct {
+    code int
+}
+
+func (e *fakeExitError) Error() string {
+    return fmt.Sprintf("exit status %d", e.code)
+}
+
+var (
+    fakeGifName    = regexp.MustCompile(`^gif\d+$`)
+    fakeBridgeName = regexp.MustCompile(`^bridge\d+$`)
+    fakeVLANName   = regexp.MustCompile(`^(\w+)\.(\d+)$`)
+)
+
+// NewFakeExecutor は物理インターフェイスのない空のFakeExecutorを作成
+func NewFakeExecutor() *FakeExecutor {
+    return &FakeExecutor{
+        ifaces:    make(map[string]*FakeInterface),
+        nextIndex: 1,
+    }
+}
+
+// AddPhysical は物理インターフェイスを追加する。addrsにはIPv4/IPv6アドレスを指定
+func (f *FakeExecutor) AddPhysical(name string, addrs ...string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    iface := f.newInterface(name, "physical")
+    iface.Up = true
+    iface.MTU = 1500
+    iface.Addrs = append(iface.Addrs, addrs...)
+}
+
+// FailOn は引数を空白で連結した文字列がprefixで始まるifconfigコマンドを失敗させる
+// timesが0以下の場合は常に失敗させる
+func (f *FakeExecutor) FailOn(prefix string, times int, message string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if message == "" {
+        message = "ifconfig: injected failure"
+    }
+    if times < 0 {
+        times = 0
+    }
+    f.failures = append(f.failures, &fakeFailure{prefix: prefix, remaining: times, message: message})
+}
+
+// Commands はこれまでに実行されたコマンドを実行順に返す
+func (f *FakeExecutor) Commands() []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return append([]string(nil), f.calls...)
+}
+
+// ResetCommands は実行履歴を消去する
+func (f *FakeExecutor) ResetCommands() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.calls = nil
+}
+
+// Interface は指定したインターフェイスの状態のコピーを返す
+func (f *FakeExecutor) Interface(name string) (FakeInterface, bool) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    iface, exists := f.ifaces[name]
+    if !exists {
+        return FakeInterface{}, false
+    }
+    c := *iface
+    c.Groups = append([]string(nil), iface.Groups...)
+    c.Addrs = append([]string(nil), iface.Addrs...)
+    c.Members = append([]string(nil), iface.Members...)
+    return c, true
+}
+
+// InterfaceNames は存在するインターフェイス名をインデックス順に返す
+func (f *FakeExecutor) InterfaceNames() []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.sortedNames()
+}
+
+func (f *FakeExecutor) Output(name string, args ...string) ([]byte, error) {
+    stdout, _, err := f.run(name, args)
+    return []byte(stdout), err
+}
+
+func (f *FakeExecutor) CombinedOutput(name string, args ...string) ([]byte, error) {
+    stdout, stderr, err := f.run(name, args)
+    return []byte(stdout + stderr), err
+}
+
+func (f *FakeExecutor) run(name string, args []string) (string, string, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    f.calls = append(f.calls, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+
+    if name != "ifconfig" {
+        return "", fmt.Sprintf("%s: command not found\n", name), &fakeExitError{code: 127}
+    }
+
+    joined := strings.Join(args, " ")
+    for _, failure := range f.failures {
+        if failure.remaining == -1 || !strings.HasPrefix(joined, failure.prefix) {
+            continue
+        }
+        if failure.remaining > 0 {
+            failure.remaining--
+            if failure.remaining == 0 {
+                failure.remaining = -1
+            }
+        }
+        return "", failure.message + "\n", &fakeExitError{code: 1}
+    }
+
+    if len(args) == 0 || args[0] == "-a" {
+        var out strings.Builder
+        for _, n := range f.sortedNames() {
+            out.WriteString(f.format(f.ifaces[n]))
+        }
+        return out.String(), "", nil
+    }
+    if args[0] == "-l" {
+        return strings.Join(f.sortedNames(), " ") + "\n", "", nil
+    }
+
+    ifname := args[0]
+    if len(args) == 1 {
+        iface, exists := f.ifaces[ifname]
+        if !exists {
+            return "", fmt.Sprintf("ifconfig: interface %s does not exist\n", ifname), &fakeExitError{code: 1}
+        }
+        return f.format(iface), "", nil
+    }
+
+    if err := f.modify(ifname, args[1:]); err != nil {
+        return "", "ifconfig: " + err.Error() + "\n", &fakeExitError{code: 1}
+    }
+    return "", "", nil
+}
+
+// modify はifconfigのキーワードを先頭から順に解釈して状態を変更する
+func (f *FakeExecutor) modify(ifname string, args []string) error {
+    iface, exists := f.ifaces[ifname]
+    if args[0] == "create" {
+        if exists {
+            return fmt.Errorf("SIOCIFCREATE2: File exists")
+        }
+        switch {
+        case fakeGifName.MatchString(ifname):
+            iface = f.newInterface(ifname, "gif")
+            iface.MTU = 1280
+        case fakeBridgeName.MatchString(ifname):
+            iface = f.newInterface(ifname, "bridge")
+            iface.MTU = 1500
+        case fakeVLANName.MatchString(ifname):
+            m := fakeVLANName.FindStringSubmatch(ifname)
+            parent, parentExists := f.ifaces[m[1]]
+            if !parentExists {
+                return fmt.Errorf("SIOCIFCREATE2: Invalid argument")
+            }
+            iface = f.newInterface(ifname, "vlan")
+            iface.MTU = parent.MTU
+            iface.VlanTag = m[2]
+            iface.VlanDev = parent.Name
+        default:
+            return fmt.Errorf("SIOCIFCREATE2: Invalid argument")
+        }
+        args = args[1:]
+    } else if !exists {
+        return fmt.Errorf("interface %s does not exist", ifname)
+    }
+
+    for i := 0; i < len(args); i++ {
+        next := func() (string, error) {
+            if i+1 >= len(args) {
+                return "", fmt.Errorf("%s: missing argument", args[i])
+            }
+            i++
+            return args[i], nil
+        }
+
+        switch args[i] {
+        case "destroy":
+            if iface.Kind == "physical" {
+                return fmt.Errorf("SIOCIFDESTROY: Invalid argument")
+            }
+            f.destroy(iface)
+            return nil
+        case "inet", "inet6":
+            // アドレスファミリ指定。tunnelのアドレスから判別するため読み捨てる
+        case "tunnel":
+            if iface.Kind != "gif" {
+                return fmt.Errorf("SIOCSIFPHYADDR: Invalid argument")
+            }
+            src, err := next()
+            if err != nil {
+                return err
+            }
+            dst, err := next()
+            if err != nil {
+                return err
+            }
+            srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+            if srcIP == nil || dstIP == nil {
+                return fmt.Errorf("%s: bad value", src)
+            }
+            if (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+                return fmt.Errorf("source and destination address families do not match")
+            }
+            iface.TunnelSrc, iface.TunnelDst = src, dst
+        case "-tunnel":
+            iface.TunnelSrc, iface.TunnelDst = "", ""
+        case "link0":
+            iface.Link0 = true
+        case "-link0":
+            iface.Link0 = false
+        case "up":
+            iface.Up = true
+        case "down":
+            iface.Up = false
+        case "mtu":
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            mtu, err := strconv.Atoi(v)
+            if err != nil || mtu <= 0 {
+                return fmt.Errorf("mtu: bad value")
+            }
+            iface.MTU = mtu
+        case "description", "descr":
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            iface.Description = v
+        case "-description", "-descr":
+            iface.Description = ""
+        case "group":
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            if !containsString(iface.Groups, v) {
+                iface.Groups = append(iface.Groups, v)
+            }
+        case "-group":
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            iface.Groups = removeString(iface.Groups, v)
+        case "vlan":
+            if iface.Kind != "vlan" {
+                return fmt.Errorf("SIOCGETVLAN: Invalid argument")
+            }
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            tag, err := strconv.Atoi(v)
+            if err != nil || tag < 0 || tag > 4095 {
+                return fmt.Errorf("vlan: bad value")
+            }
+            iface.VlanTag = v
+        case "vlandev":
+            if iface.Kind != "vlan" {
+                return fmt.Errorf("SIOCGETVLAN: Invalid argument")
+            }
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            if _, parentExists := f.ifaces[v]; !parentExists {
+                return fmt.Errorf("SIOCSETVLAN: No such file or directory")
+            }
+            iface.VlanDev = v
+        case "-vlandev":
+            iface.VlanDev = ""
+        case "addm":
+            if iface.Kind != "bridge" {
+                return fmt.Errorf("BRDGADD: Invalid argument")
+            }
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            if _, memberExists := f.ifaces[v]; !memberExists {
+                return fmt.Errorf("BRDGADD %s: No such file or directory", v)
+            }
+            for _, other := range f.ifaces {
+                if other.Kind == "bridge" && containsString(other.Members, v) {
+                    return fmt.Errorf("BRDGADD %s: Device busy", v)
+                }
+            }
+            iface.Members = append(iface.Members, v)
+        case "deletem":
+            if iface.Kind != "bridge" {
+                return fmt.Errorf("BRDGDEL: Invalid argument")
+            }
+            v, err := next()
+            if err != nil {
+                return err
+            }
+            if !containsString(iface.Members, v) {
+                return fmt.Errorf("BRDGDEL %s: Invalid argument", v)
+            }
+            iface.Members = removeString(iface.Members, v)
+        default:
+            return fmt.Errorf("%s: bad value", args[i])
+        }
+    }
+    return nil
+}
+
+func (f *FakeExecutor) newInterface(name, kind string) *FakeInterface {
+    iface := &FakeInterface{Name: name, Kind: kind, Index: f.nextIndex}
+    f.nextIndex++
+    if kind != "physical" {
+        iface.Groups = []string{kind}
+    }
+    f.ifaces[name] = iface
+    return iface
+}
+
+// destroy はインターフェイスを削除し、所属していたbridgeからも取り除く
+func (f *FakeExecutor) destroy(iface *FakeInterface) {
+    delete(f.ifaces, iface.Name)
+    for _, other := range f.ifaces {
+        if other.Kind == "bridge" {
+            other.Members = removeString(other.Members, iface.Name)
+        }
+        if other.Kind == "vlan" && other.VlanDev == iface.Name {
+            other.VlanDev = ""
+        }
+    }
+}
+
+func (f *FakeExecutor) sortedNames() []string {
+    names := make([]string, 0, len(f.ifaces))
+    for n := range f.ifaces {
+        names = append(names, n)
+    }
+    sort.Slice(names, func(i, j int) bool {
+        return f.ifaces[names[i]].Index < f.ifaces[names[j]].Index
+    })
+    return names
+}
+
+// ifFlagNames はFreeBSDのif_flagsのビットと表示名
+var ifFlagNames = []struct {
+    bit  int
+    name string
+}{
+    {0x1, "UP"},
+    {0x2, "BROADCAST"},
+    {0x10, "POINTOPOINT"},
+    {0x40, "RUNNING"},
+    {0x800, "SIMPLEX"},
+    {0x1000, "LINK0"},
+    {0x8000, "MULTICAST"},
+}
+
+// format はifconfig <name>と同じ形式でインターフェイスの状態を出力
+func (f *FakeExecutor) format(iface *FakeInterface) string {
+    flags := 0x8000
+    running := iface.Up
+    switch iface.Kind {
+    case "gif":
+        flags |= 0x10
+        running = iface.Up && iface.TunnelSrc != ""
+        if iface.Link0 {
+            flags |= 0x1000
+        }
+    case "vlan":
+        flags |= 0x2 | 0x800
+        running = iface.Up && iface.VlanDev != ""
+    default:
+        flags |= 0x2 | 0x800
+    }
+    if iface.Up {
+        flags |= 0x1
+    }
+    if running {
+        flags |= 0x40
+    }
+    var names []string
+    for _, fl := range ifFlagNames {
+        if flags&fl.bit != 0 {
+            names = append(names, fl.name)
+        }
+    }
+
+    mac := fmt.Sprintf("58:9c:fc:00:%02x:%02x", iface.Index>>8&0xff, iface.Index&0xff)
+
+    var out strings.Builder
+    fmt.Fprintf(&out, "%s: flags=%x<%s> metric 0 mtu %d\n", iface.Name, flags, strings.Join(names, ","), iface.MTU)
+    if iface.Description != "" {
+        fmt.Fprintf(&out, "\tdescription: %s\n", iface.Description)
+    }
+    switch iface.Kind {
+    case "gif":
+        out.WriteString("\toptions=80000<IGNORE_SOURCE>\n")
+        if iface.TunnelSrc != "" {
+            family := "inet"
+            if strings.Contains(iface.TunnelSrc, ":") {
+                family = "inet6"
+            }
+            fmt.Fprintf(&out, "\ttunnel %s %s --> %s\n", family, iface.TunnelSrc, iface.TunnelDst)
+        }
+    case "bridge":
+        fmt.Fprintf(&out, "\tether %s\n", mac)
+        out.WriteString("\tid 00:00:00:00:00:00 priority 32768 hellotime 2 fwddelay 15\n")
+        out.WriteString("\tmaxage 20 holdcnt 6 proto rstp maxaddr 2000 timeout 1200\n")
+        out.WriteString("\troot id 00:00:00:00:00:00 priority 32768 ifcost 0 port 0\n")
+        // FreeBSDは後から追加したメンバーから順に表示する
+        for i := len(iface.Members) - 1; i >= 0; i-- {
+            port := 0
+            if member, exists := f.ifaces[iface.Members[i]]; exists {
+                port = member.Index
+            }
+            fmt.Fprintf(&out, "\tmember: %s flags=143<LEARNING,DISCOVER,AUTOEDGE,AUTOPTP>\n", iface.Members[i])
+            fmt.Fprintf(&out, "\t        ifmaxaddr 0 port %d priority 128 path cost 2000000\n", port)
+        }
+    default:
+        out.WriteString("\toptions=4e524bb<RXCSUM,TXCSUM,VLAN_MTU,VLAN_HWTAGGING,JUMBO_MTU,VLAN_HWCSUM,LRO,WOL_MAGIC,VLAN_HWFILTER,VLAN_HWTSO,RXCSUM_IPV6,TXCSUM_IPV6,HWSTATS,MEXTPG>\n")
+        fmt.Fprintf(&out, "\tether %s\n", mac)
+    }
+    for _, addr := range iface.Addrs {
+        ip := net.ParseIP(addr)
+        if ip == nil {
+            continue
+        }
+        if ip.To4() != nil {
+            fmt.Fprintf(&out, "\tinet %s netmask 0xffffff00 broadcast %s\n", addr, strings.Join(append(strings.Split(addr, ".")[:3], "255"), "."))
+        } else {
+            fmt.Fprintf(&out, "\tinet6 %s prefixlen 64\n", addr)
+        }
+    }
+    if len(iface.Groups) > 0 {
+        fmt.Fprintf(&out, "\tgroups: %s\n", strings.Join(iface.Groups, " "))
+    }
+    if iface.Kind == "vlan" {
+        fmt.Fprintf(&out, "\tvlan: %s vlanproto: 802.1q vlanpcp: 0 parent interface: %s\n", iface.VlanTag, iface.VlanDev)
+    }
+    if iface.Kind == "physical" || iface.Kind == "vlan" {
+        out.WriteString("\tmedia: Ethernet autoselect (1000baseT <full-duplex>)\n")
+        out.WriteString("\tstatus: active\n")
+    }
+    out.WriteString("\tnd6 options=29<PERFORMNUD,IFDISABLED,AUTO_LINKLOCAL>\n")
+    return out.String()
+}
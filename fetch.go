@@ -0,0 +1,226 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+)
+
+// configFetcher はconfig_sourceとsignature_sourceのURLを取得するHTTPクライアント
+type configFetcher struct {
+    client         *http.Client
+    connectTimeout time.Duration
+    timeout        time.Duration
+    maxBytes       int64
+    proxy          string
+    settings       *Settings // 認証情報はトークンの更新に追従するため、リクエストごとにファイルか環境変数から読む
+}
+
+// fetcher は設定の取得に使うクライアント。起動時にsettings.jsonのfetch_*に従って差し替える
+var fetcher = mustConfigFetcher(&Settings{FetchConnectTimeout: 10, FetchTimeout: 30, FetchMaxBytes: 10 << 20})
+
+func mustConfigFetcher(settings *Settings) *configFetcher {
+    f, err := newConfigFetcher(settings)
+    if err != nil {
+        panic(err)
+    }
+    return f
+}
+
+// newConfigFetcher はfetch_*の設定からクライアントを作成する。CAバンドルとクライアント証明書はここで読み込めることを確認する
+func newConfigFetcher(settings *Settings) (*configFetcher, error) {
+    f := &configFetcher{
+        connectTimeout: time.Duration(settings.FetchConnectTimeout) * time.Second,
+        timeout:        time.Duration(settings.FetchTimeout) * time.Second,
+        maxBytes:       int64(settings.FetchMaxBytes),
+        proxy:          settings.FetchProxy,
+        settings:       settings,
+    }
+
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.DialContext = (&net.Dialer{Timeout: f.connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+    transport.TLSHandshakeTimeout = f.connectTimeout
+    switch settings.FetchProxy {
+    case "":
+        transport.Proxy = http.ProxyFromEnvironment
+    case "none":
+        transport.Proxy = nil
+    default:
+        proxyURL, err := url.Parse(settings.FetchProxy)
+        if err != nil || proxyURL.Host == "" {
+            return nil, fmt.Errorf("invalid fetch_proxy: %s", settings.FetchProxy)
+        }
+        transport.Proxy = http.ProxyURL(proxyURL)
+    }
+
+    transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+    if settings.FetchCAFile != "" {
+        pem, err := os.ReadFile(settings.FetchCAFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read fetch_ca_file: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no PEM certificates found in fetch_ca_file %s", settings.FetchCAFile)
+        }
+        transport.TLSClientConfig.RootCAs = pool
+    }
+    if (settings.FetchClientCert == "") != (settings.FetchClientKey == "") {
+        return nil, fmt.Errorf("fetch_client_cert and fetch_client_key must be set together")
+    }
+    if settings.FetchClientCert != "" {
+        if _, err := tls.LoadX509KeyPair(settings.FetchClientCert, settings.FetchClientKey); err != nil {
+            return nil, fmt.Errorf("failed to load fetch_client_cert: %v", err)
+        }
+        // 証明書の更新に追従するため、接続ごとに読み込む
+        transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+            cert, err := tls.LoadX509KeyPair(settings.FetchClientCert, settings.FetchClientKey)
+            if err != nil {
+                return nil, fmt.Errorf("failed to load fetch_client_cert: %v", err)
+            }
+            return &cert, nil
+        }
+    }
+
+    bearer := settings.FetchBearerTokenFile != "" || settings.FetchBearerTokenEnv != ""
+    basic := settings.FetchBasicAuthFile != "" || settings.FetchBasicAuthEnv != ""
+    if bearer && basic {
+        return nil, fmt.Errorf("bearer token and basic auth cannot be used together")
+    }
+    if (settings.FetchBearerTokenFile != "" && settings.FetchBearerTokenEnv != "") || (settings.FetchBasicAuthFile != "" && settings.FetchBasicAuthEnv != "") {
+        return nil, fmt.Errorf("credentials must be read either from a file or from an environment variable")
+    }
+
+    f.client = &http.Client{Transport: transport, Timeout: f.timeout}
+    return f, nil
+}
+
+// credential はファイルか環境変数から認証情報を読み込む
+func credential(file, env string) (string, error) {
+    if file != "" {
+        data, err := os.ReadFile(file)
+        if err != nil {
+            return "", fmt.Errorf("failed to read credentials from %s: %v", file, err)
+        }
+        if value := strings.TrimSpace(string(data)); value != "" {
+            return value, nil
+        }
+        return "", fmt.Errorf("credentials file %s is empty", file)
+    }
+    if value := strings.TrimSpace(os.Getenv(env)); value != "" {
+        return value, nil
+    }
+    return "", fmt.Errorf("environment variable %s for credentials is not set", env)
+}
+
+// authorize はbearerトークンかbasic認証のヘッダを付ける
+func (f *configFetcher) authorize(req *http.Request) error {
+    s := f.settings
+    switch {
+    case s.FetchBearerTokenFile != "" || s.FetchBearerTokenEnv != "":
+        token, err := credential(s.FetchBearerTokenFile, s.FetchBearerTokenEnv)
+        if err != nil {
+            return err
+        }
+        req.Header.Set("Authorization", "Bearer "+token)
+    case s.FetchBasicAuthFile != "" || s.FetchBasicAuthEnv != "":
+        userpass, err := credential(s.FetchBasicAuthFile, s.FetchBasicAuthEnv)
+        if err != nil {
+            return err
+        }
+        user, password, ok := strings.Cut(userpass, ":")
+        if !ok {
+            return fmt.Errorf("basic auth credentials must be USER:PASSWORD")
+        }
+        req.SetBasicAuth(user, password)
+    }
+    return nil
+}
+
+// get はURLを取得し、本文とContent-Typeを返す。validatorsがあれば条件付きリクエストを送り、304の場合はerrNotModifiedを返す
+// 2xx以外の応答と、fetch_max_bytesを超える本文はエラーとする
+func (f *configFetcher) get(source string, validators sourceValidators) ([]byte, sourceValidators, string, error) {
+    req, err := http.NewRequest(http.MethodGet, source, nil)
+    if err != nil {
+        return nil, validators, "", fmt.Errorf("invalid config URL %s: %v", source, err)
+    }
+    req.Header.Set("User-Agent", "eipconf")
+    if validators.etag != "" {
+        req.Header.Set("If-None-Match", validators.etag)
+    }
+    if validators.lastModified != "" {
+        req.Header.Set("If-Modified-Since", validators.lastModified)
+    }
+    if err := f.authorize(req); err != nil {
+        return nil, validators, "", err
+    }
+
+    resp, err := f.client.Do(req)
+    if err != nil {
+        return nil, validators, "", f.describeError(source, err)
+    }
+    defer resp.Body.Close()
+
+    switch {
+    case resp.StatusCode == http.StatusNotModified && validators != (sourceValidators{}):
+        return nil, validators, "", errNotModified
+    case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+        return nil, validators, "", fmt.Errorf("config source %s rejected the credentials: %s", source, resp.Status)
+    case resp.StatusCode >= 400 && resp.StatusCode < 500:
+        return nil, validators, "", fmt.Errorf("config source %s returned client error: %s", source, resp.Status)
+    case resp.StatusCode >= 500:
+        return nil, validators, "", fmt.Errorf("config source %s returned server error: %s", source, resp.Status)
+    case resp.StatusCode < 200 || resp.StatusCode >= 300:
+        return nil, validators, "", fmt.Errorf("config source %s returned unexpected status: %s", source, resp.Status)
+    }
+
+    if resp.ContentLength > f.maxBytes {
+        return nil, validators, "", fmt.Errorf("config from %s is %d bytes, larger than fetch_max_bytes %d", source, resp.ContentLength, f.maxBytes)
+    }
+    body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+    if err != nil {
+        if os.IsTimeout(err) {
+            return nil, validators, "", fmt.Errorf("timed out reading config from %s after fetch_timeout %s", source, f.timeout)
+        }
+        return nil, validators, "", fmt.Errorf("failed to read response body from %s: %v", source, err)
+    }
+    if int64(len(body)) > f.maxBytes {
+        return nil, validators, "", fmt.Errorf("config from %s is larger than fetch_max_bytes %d", source, f.maxBytes)
+    }
+    return body, sourceValidators{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}, resp.Header.Get("Content-Type"), nil
+}
+
+// describeError はリクエストの失敗を、名前解決、接続、プロキシ、TLS、タイムアウトのどれかがわかるエラーにする
+func (f *configFetcher) describeError(source string, err error) error {
+    var dnsErr *net.DNSError
+    var opErr *net.OpError
+    var unknownAuthority x509.UnknownAuthorityError
+    var hostnameErr x509.HostnameError
+    var invalidCert x509.CertificateInvalidError
+    var recordErr tls.RecordHeaderError
+    switch {
+    case errors.As(err, &dnsErr):
+        return fmt.Errorf("failed to resolve config source host %s: %v", dnsErr.Name, dnsErr.Err)
+    case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+        return fmt.Errorf("failed to connect to proxy for %s: %v", source, opErr.Err)
+    case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+        return fmt.Errorf("timed out connecting to %s after fetch_connect_timeout %s", source, f.connectTimeout)
+    case errors.As(err, &opErr) && opErr.Op == "dial":
+        return fmt.Errorf("failed to connect to %s: %v", source, opErr.Err)
+    case errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+        return fmt.Errorf("TLS certificate of %s is not trusted: %v", source, err)
+    case errors.As(err, &recordErr), strings.Contains(err.Error(), "tls: "):
+        return fmt.Errorf("TLS handshake with %s failed: %v", source, err)
+    case os.IsTimeout(err):
+        return fmt.Errorf("timed out fetching %s after fetch_timeout %s", source, f.timeout)
+    }
+    return fmt.Errorf("failed to fetch config from %s: %v", source, err)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/url"
+    "path"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// settings.jsonとトンネルの設定はJSON、YAML、TOMLのいずれかで書ける
+// 形式はHTTPのContent-Typeか拡張子で判定し、YAMLとTOMLはJSONに変換してから、以降はJSONと同じように検証して読み込む
+// 変換の際に値ごとの元のファイルでの位置を記録し、検証の問題に行と桁をつける
+
+const (
+    formatJSON = "json"
+    formatYAML = "yaml"
+    formatTOML = "toml"
+)
+
+// configFormat はHTTPのContent-Typeか、ファイル名やURLの拡張子から形式を判定する。どちらでも判定できなければJSON
+func configFormat(source, contentType string) string {
+    mediaType, _, _ := mime.ParseMediaType(contentType)
+    switch {
+    case strings.HasSuffix(mediaType, "/yaml"), strings.HasSuffix(mediaType, "/x-yaml"), strings.HasSuffix(mediaType, "+yaml"):
+        return formatYAML
+    case strings.HasSuffix(mediaType, "/toml"), strings.HasSuffix(mediaType, "+toml"):
+        return formatTOML
+    case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+        return formatJSON
+    }
+
+    name := source
+    if u, err := url.Parse(source); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+        name = u.Path
+    }
+    switch strings.ToLower(path.Ext(name)) {
+    case ".yaml", ".yml":
+        return formatYAML
+    case ".toml":
+        return formatTOML
+    }
+    return formatJSON
+}
+
+// position はファイルの中の位置。行と桁は1から数える
+type position struct {
+    Line   int
+    Column int
+}
+
+// documentError は設定ファイルの構文の誤り
+type documentError struct {
+    format string
+    pos    position
+    msg    string
+}
+
+func (e *documentError) Error() string {
+    return fmt.Sprintf("failed to parse %s at line %d, column %d: %s", strings.ToUpper(e.format), e.pos.Line, e.pos.Column, e.msg)
+}
+
+// sourceText はバイト位置を行と桁に変換する
+type sourceText struct {
+    src        string
+    lineStarts []int
+}
+
+func newSourceText(src string) *sourceText {
+    t := &sourceText{src: src, lineStarts: []int{0}}
+    for i := 0; i < len(src); i++ {
+        if src[i] == '\n' {
+            t.lineStarts = append(t.lineStarts, i+1)
+        }
+    }
+    return t
+}
+
+func (t *sourceText) position(offset int) position {
+    if offset > len(t.src) {
+        offset = len(t.src)
+    }
+    line := sort.Search(len(t.lineStarts), func(i int) bool { return t.lineStarts[i] > offset }) - 1
+    return position{Line: line + 1, Column: utf8.RuneCountInString(t.src[t.lineStarts[line]:offset]) + 1}
+}
+
+// configDocument はJSONに変換した設定ファイルと、値ごとの元のファイルでの位置
+type configDocument struct {
+    format    string
+    data      []byte              // JSON。元がJSONの場合は読み込んだ内容そのもの
+    positions map[string]position // "/tunnels/0/vlan_id" のようなJSONポインタごとの値の位置。結合した設定などではnil
+    root      *docNode            // YAMLとTOMLを読み込んだ値。JSONではnil
+}
+
+// parseDocument はformatの形式で書かれた設定ファイルをJSONに変換する。構文の誤りは行と桁つきのdocumentErrorとする
+func parseDocument(body []byte, format string) (*configDocument, error) {
+    doc := &configDocument{format: format, positions: make(map[string]position)}
+    var root *docNode
+    var err error
+    switch format {
+    case formatYAML:
+        root, err = parseYAML(normalizeSource(body))
+    case formatTOML:
+        root, err = parseTOML(normalizeSource(body))
+    default:
+        doc.format, doc.data = formatJSON, body
+        return doc, doc.scanJSON()
+    }
+    if err != nil {
+        return nil, err
+    }
+    doc.root = root
+    doc.encode()
+    return doc, nil
+}
+
+// parseConfigDocument はトンネルの設定をparseDocumentで読み込み、引用符なしの数値を文字列のフィールドに合わせる
+// TOMLの文書は常にテーブルなので、tunnelsだけのテーブルはJSONのトンネルの配列と同じに扱う
+func parseConfigDocument(body []byte, format string) (*configDocument, error) {
+    doc, err := parseDocument(body, format)
+    if err != nil {
+        return nil, err
+    }
+    if doc.format == formatTOML && doc.root.isMap && len(doc.root.keys) == 1 && doc.root.keys[0] == "tunnels" {
+        doc.root = doc.root.items[0]
+    }
+    if doc.root != nil && doc.root.isSeq {
+        doc.coerceStrings(reflect.TypeOf([]TunnelConfig{}))
+    } else {
+        doc.coerceStrings(reflect.TypeOf(ConfigEnvelope{}))
+    }
+    return doc, nil
+}
+
+// encode はrootをJSONに書き出し、dataとpositionsを作り直す
+func (d *configDocument) encode() {
+    var buf bytes.Buffer
+    d.positions = make(map[string]position)
+    d.root.encode(&buf, "", d.positions)
+    d.data = buf.Bytes()
+}
+
+// coerceStrings はYAMLとTOMLで引用符なしに書いた数値を、tで文字列のフィールドでは書かれたとおりの文字列にする
+// tunnel_id: 10 はJSONの "10" と同じになる。0x1Fのような表記も変換後の値ではなく書かれたとおりに残し、検証で扱う
+func (d *configDocument) coerceStrings(t reflect.Type) {
+    if d.root != nil {
+        d.root.coerceStrings(t)
+        d.encode()
+    }
+}
+
+// normalizeSource はBOMを除き、改行をLFに揃える
+func normalizeSource(body []byte) string {
+    return strings.ReplaceAll(strings.TrimPrefix(string(body), "\ufeff"), "\r\n", "\n")
+}
+
+// position はpathの値の位置を返す。pathの値がなければ、それを含む最も近い値の位置を返す
+func (d *configDocument) position(path []string) (position, bool) {
+    if d == nil || d.positions == nil {
+        return position{}, false
+    }
+    for n := len(path); n >= 0; n-- {
+        if pos, ok := d.positions[jsonPointer(path[:n])]; ok {
+            return pos, true
+        }
+    }
+    return position{}, false
+}
+
+// unmarshal はJSONを読み込む。型が合わない値のエラーには位置をつける
+func (d *configDocument) unmarshal(v any) error {
+    err := json.Unmarshal(d.data, v)
+    var typeErr *json.UnmarshalTypeError
+    if errors.As(err, &typeErr) {
+        if pos, ok := d.position(valuePathAt(d.data, typeErr.Offset)); ok {
+            return fmt.Errorf("line %d, column %d: %v", pos.Line, pos.Column, err)
+        }
+    }
+    return err
+}
+
+// valuePathAt はJSONのoffsetの直前で読んだ値のパスを返す
+// UnmarshalTypeErrorのOffsetはスカラーの直後か、オブジェクトと配列の開き括弧の直後を指す
+// Fieldは配列の添字を含まないGoのバージョンがあるため、位置はOffsetから求める
+func valuePathAt(data []byte, offset int64) []string {
+    dec := json.NewDecoder(bytes.NewReader(data))
+    var found []string
+    var walk func(path []string) bool
+    walk = func(path []string) bool {
+        if dec.InputOffset() >= offset {
+            return false
+        }
+        found = append([]string{}, path...)
+        tok, err := dec.Token()
+        if err != nil {
+            return false
+        }
+        switch tok {
+        case json.Delim('{'):
+            for dec.More() {
+                key, err := dec.Token()
+                if err != nil || !walk(append(path, key.(string))) {
+                    return false
+                }
+            }
+        case json.Delim('['):
+            for i := 0; dec.More(); i++ {
+                if !walk(append(path, strconv.Itoa(i))) {
+                    return false
+                }
+            }
+        default:
+            return true
+        }
+        _, err = dec.Token()
+        return err == nil
+    }
+    walk(nil)
+    return found
+}
+
+func jsonPointer(path []string) string {
+    var b strings.Builder
+    for _, p := range path {
+        b.WriteByte('/')
+        b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(p))
+    }
+    return b.String()
+}
+
+// scanJSON はJSONの構文を確かめ、値ごとの位置を記録する
+func (d *configDocument) scanJSON() error {
+    text := newSourceText(string(d.data))
+    dec := json.NewDecoder(bytes.NewReader(d.data))
+    dec.UseNumber()
+    fail := func(err error) error {
+        offset := int(dec.InputOffset())
+        var syntaxErr *json.SyntaxError
+        if errors.As(err, &syntaxErr) {
+            offset = int(syntaxErr.Offset)
+        }
+        msg := err.Error()
+        if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+            msg, offset = "unexpected end of JSON input", len(d.data)
+        }
+        return &documentError{format: formatJSON, pos: text.position(offset), msg: msg}
+    }
+
+    var walk func(path string) error
+    walk = func(path string) error {
+        start := int(dec.InputOffset())
+        for start < len(d.data) && strings.IndexByte(" \t\r\n:,", d.data[start]) >= 0 {
+            start++
+        }
+        tok, err := dec.Token()
+        if err != nil {
+            return fail(err)
+        }
+        d.positions[path] = text.position(start)
+        delim, _ := tok.(json.Delim)
+        switch delim {
+        case '{':
+            for dec.More() {
+                key, err := dec.Token()
+                if err != nil {
+                    return fail(err)
+                }
+                if err := walk(path + jsonPointer([]string{key.(string)})); err != nil {
+                    return err
+                }
+            }
+        case '[':
+            for i := 0; dec.More(); i++ {
+                if err := walk(path + "/" + strconv.Itoa(i)); err != nil {
+                    return err
+                }
+            }
+        default:
+            return nil
+        }
+        if _, err := dec.Token(); err != nil {
+            return fail(err)
+        }
+        return nil
+    }
+    if err := walk(""); err != nil {
+        return err
+    }
+    if _, err := dec.Token(); err != io.EOF {
+        if err == nil {
+            err = fmt.Errorf("invalid character after top-level value")
+        }
+        return fail(err)
+    }
+    return nil
+}
+
+// docNode はYAMLとTOMLを読み込んだ値。スカラーはJSONの表現で保持する
+type docNode struct {
+    pos    position
+    scalar string     // スカラーのJSONの表現
+    raw    string     // 引用符なしで書いたスカラーの元の表記
+    keys   []string   // マッピングのキー
+    items  []*docNode // マッピングの値、または配列の要素
+    isMap  bool
+    isSeq  bool
+}
+
+func stringNode(pos position, s string) *docNode {
+    data, _ := json.Marshal(s)
+    return &docNode{pos: pos, scalar: string(data)}
+}
+
+// get はマッピングのキーの値を返す。なければnil
+func (n *docNode) get(key string) *docNode {
+    for i, k := range n.keys {
+        if k == key {
+            return n.items[i]
+        }
+    }
+    return nil
+}
+
+func (n *docNode) set(key string, value *docNode) {
+    n.keys = append(n.keys, key)
+    n.items = append(n.items, value)
+}
+
+// coerceStrings はtで文字列の値に書いた数値を、元の表記の文字列にする
+func (n *docNode) coerceStrings(t reflect.Type) {
+    for t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    switch {
+    case n.isSeq && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array):
+        for _, item := range n.items {
+            item.coerceStrings(t.Elem())
+        }
+    case n.isMap && t.Kind() == reflect.Map:
+        for _, item := range n.items {
+            item.coerceStrings(t.Elem())
+        }
+    case n.isMap && t.Kind() == reflect.Struct:
+        for i := 0; i < t.NumField(); i++ {
+            name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+            if item := n.get(name); item != nil && name != "" && name != "-" {
+                item.coerceStrings(t.Field(i).Type)
+            }
+        }
+    case t.Kind() == reflect.String && n.raw != "" && strings.IndexByte("-0123456789", n.scalar[0]) >= 0:
+        *n = *stringNode(n.pos, n.raw)
+    }
+}
+
+// encode はJSONに書き出し、値ごとの位置をpositionsに記録する。マッピングのキーは書かれた順に出力する
+func (n *docNode) encode(buf *bytes.Buffer, path string, positions map[string]position) {
+    positions[path] = n.pos
+    switch {
+    case n.isMap:
+        buf.WriteByte('{')
+        for i, key := range n.keys {
+            if i > 0 {
+                buf.WriteByte(',')
+            }
+            data, _ := json.Marshal(key)
+            buf.Write(data)
+            buf.WriteByte(':')
+            n.items[i].encode(buf, path+jsonPointer([]string{key}), positions)
+        }
+        buf.WriteByte('}')
+    case n.isSeq:
+        buf.WriteByte('[')
+        for i, item := range n.items {
+            if i > 0 {
+                buf.WriteByte(',')
+            }
+            item.encode(buf, path+"/"+strconv.Itoa(i), positions)
+        }
+        buf.WriteByte(']')
+    default:
+        buf.WriteString(n.scalar)
+    }
+}
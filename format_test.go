@@ -0,0 +1,183 @@
+package main
+
+import (
+    "errors"
+    "strings"
+    "testing"
+)
+
+// parseCase は設定ファイルの読み込みのテストケース。wantErrが空なら変換したJSONを、そうでなければエラーの位置と内容を確かめる
+type parseCase struct {
+    name    string
+    src     string
+    want    string // 変換したJSON
+    line    int
+    column  int
+    wantErr string // エラーのメッセージに含まれる文字列
+}
+
+func runParseCases(t *testing.T, format string, tests []parseCase) {
+    t.Helper()
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            doc, err := parseDocument([]byte(tt.src), format)
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Fatalf("parseDocument: %v", err)
+                }
+                if string(doc.data) != tt.want {
+                    t.Errorf("JSON:\n got %s\nwant %s", doc.data, tt.want)
+                }
+                return
+            }
+            var docErr *documentError
+            if !errors.As(err, &docErr) {
+                t.Fatalf("error = %v, want a documentError", err)
+            }
+            if docErr.pos.Line != tt.line || docErr.pos.Column != tt.column || !strings.Contains(docErr.msg, tt.wantErr) {
+                t.Errorf("error = %v, want line %d, column %d: %s", err, tt.line, tt.column, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestDecodeConfigTypeErrorPosition(t *testing.T) {
+    tests := []struct {
+        name   string
+        format string
+        src    string
+        want   string
+    }{
+        {
+            name:   "JSON",
+            format: formatJSON,
+            src:    "[\n  {\"tunnel_id\": \"1\", \"vlan_id\": \"100\"},\n  {\"tunnel_id\": 2, \"vlan_id\": \"101\"}\n]\n",
+            want:   "failed to unmarshal JSON: line 3, column 17: ",
+        },
+        {
+            name:   "YAML list",
+            format: formatYAML,
+            src:    "- tunnel_id: \"1\"\n  vlan_id: \"100\"\n- tunnel_id: \"2\"\n  vlan_id: true\n",
+            want:   "failed to unmarshal YAML: line 4, column 12: ",
+        },
+        {
+            name:   "YAML envelope",
+            format: formatYAML,
+            src:    "version: 1\nserial: 3\ntunnels:\n  - tunnel_id: false\n    vlan_id: \"100\"\n",
+            want:   "failed to unmarshal YAML: line 4, column 16: ",
+        },
+        {
+            name:   "YAML mapping for a string",
+            format: formatYAML,
+            src:    "version: 1\nserial: 3\ntunnels:\n  - tunnel_id: \"1\"\n    vlan_id: {id: 100}\n",
+            want:   "failed to unmarshal YAML: line 5, column 14: ",
+        },
+        {
+            name:   "TOML",
+            format: formatTOML,
+            src:    "version = 1\r\nserial = 3\r\n\r\n[[tunnels]]\r\ntunnel_id = \"1\"\r\n\r\n[[tunnels]]\r\ntunnel_id = \"2\"\r\nvlan_id = true\r\n",
+            want:   "failed to unmarshal TOML: line 9, column 11: ",
+        },
+        {
+            name:   "TOML envelope field",
+            format: formatTOML,
+            src:    "version = \"1\"\nserial = 3\n",
+            want:   "failed to unmarshal TOML: line 1, column 11: ",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            doc, err := parseConfigDocument([]byte(tt.src), tt.format)
+            if err != nil {
+                t.Fatalf("parseConfigDocument: %v", err)
+            }
+            _, err = decodeConfig(doc)
+            if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+                t.Errorf("error = %v, want %q...", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestParseConfigDocument(t *testing.T) {
+    tests := []struct {
+        name   string
+        format string
+        src    string
+        want   string // 変換したJSON
+    }{
+        {
+            name:   "YAML unquoted numbers for strings",
+            format: formatYAML,
+            src:    "- tunnel_id: 10\n  vlan_id: 100\n  ip_version: 4\n  labels: {rack: 12}\n",
+            want:   `[{"tunnel_id":"10","vlan_id":"100","ip_version":"4","labels":{"rack":"12"}}]`,
+        },
+        {
+            name:   "YAML keeps the written notation",
+            format: formatYAML,
+            src:    "- tunnel_id: 010\n  vlan_id: 0x1F\n",
+            want:   `[{"tunnel_id":"010","vlan_id":"0x1F"}]`,
+        },
+        {
+            name:   "YAML envelope keeps numbers for numbers",
+            format: formatYAML,
+            src:    "version: 1\nserial: 3\ntunnels:\n  - tunnel_id: 1\n    vlan_id: true\n",
+            want:   `{"version":1,"serial":3,"tunnels":[{"tunnel_id":"1","vlan_id":true}]}`,
+        },
+        {
+            name:   "TOML without envelope",
+            format: formatTOML,
+            src:    "[[tunnels]]\ntunnel_id = 1\nvlan_id = 1_00\n",
+            want:   `[{"tunnel_id":"1","vlan_id":"1_00"}]`,
+        },
+        {
+            name:   "TOML envelope",
+            format: formatTOML,
+            src:    "version = 1\nserial = 3\n\n[[tunnels]]\ntunnel_id = 1\nvlan_id = \"100\"\n",
+            want:   `{"version":1,"serial":3,"tunnels":[{"tunnel_id":"1","vlan_id":"100"}]}`,
+        },
+        {
+            name:   "JSON is not converted",
+            format: formatJSON,
+            src:    `[{"tunnel_id": 1}]`,
+            want:   `[{"tunnel_id": 1}]`,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            doc, err := parseConfigDocument([]byte(tt.src), tt.format)
+            if err != nil {
+                t.Fatalf("parseConfigDocument: %v", err)
+            }
+            if string(doc.data) != tt.want {
+                t.Errorf("JSON:\n got %s\nwant %s", doc.data, tt.want)
+            }
+        })
+    }
+}
+
+func TestDecodeConfigTOMLWithoutEnvelope(t *testing.T) {
+    doc, err := parseConfigDocument([]byte("[[tunnels]]\ntunnel_id = 1\nvlan_id = 100\n"), formatTOML)
+    if err != nil {
+        t.Fatalf("parseConfigDocument: %v", err)
+    }
+    envelope, err := decodeConfig(doc)
+    if err != nil {
+        t.Fatalf("decodeConfig: %v", err)
+    }
+    if envelope.Serial != 0 || len(envelope.Tunnels) != 1 || envelope.Tunnels[0].TunnelID != "1" || envelope.Tunnels[0].VlanID != "100" {
+        t.Errorf("envelope = %+v, want tunnel 1 on VLAN 100 without a serial", envelope)
+    }
+    if pos, ok := doc.position([]string{"0", "vlan_id"}); !ok || pos.Line != 3 || pos.Column != 11 {
+        t.Errorf("position of vlan_id = %v, want line 3, column 11", pos)
+    }
+
+    // 変換後の値ではなく書かれたとおりの表記を検証する
+    doc, err = parseConfigDocument([]byte("[[tunnels]]\ntunnel_id = 1\nsrc_addr = \"192.0.2.10\"\ndst_addr = \"198.51.100.1\"\nvlan_id = 0x64\n"), formatTOML)
+    if err != nil {
+        t.Fatalf("parseConfigDocument: %v", err)
+    }
+    if problems := validateConfigData(doc, nil); len(problems) != 1 || problems[0].Field != "vlan_id" {
+        t.Errorf("problems = %v, want one for vlan_id", problems)
+    }
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strings"
+    "text/tabwriter"
+)
+
+// 設定は config_sources から取得した設定に、config_dirの *.json、*.yaml、*.yml、*.toml を名前順に加え、最後にconfig_overrideを適用して作る
+// 同じtunnel_idを複数の断片で定義した場合は先に読んだものを使い、後のものは競合とする
+
+// ConfigOverride はconfig_overrideのファイルの内容。ホストごとにトンネルを追加、変更、無効化する
+type ConfigOverride struct {
+    Add     []json.RawMessage `json:"add,omitempty"`     // 追加するトンネル
+    Patch   []json.RawMessage `json:"patch,omitempty"`   // tunnel_idで指定したトンネルのフィールドを置き換える
+    Disable []string          `json:"disable,omitempty"` // 適用しないトンネルのtunnel_id
+}
+
+// MergedTunnel は結合した設定の1つのトンネルと、それを定義した断片
+type MergedTunnel struct {
+    TunnelID  string          `json:"tunnel_id"`
+    Origin    string          `json:"origin"`
+    PatchedBy string          `json:"patched_by,omitempty"`
+    Config    json.RawMessage `json:"config"`
+}
+
+// MergeConflict は結合に使わなかった断片の設定と、その理由
+type MergeConflict struct {
+    TunnelID string `json:"tunnel_id,omitempty"`
+    Origin   string `json:"origin"`
+    Reason   string `json:"reason"`
+}
+
+func (c MergeConflict) String() string {
+    if c.TunnelID == "" {
+        return fmt.Sprintf("%s: %s", c.Origin, c.Reason)
+    }
+    return fmt.Sprintf("%s: tunnel_id=%s: %s", c.Origin, c.TunnelID, c.Reason)
+}
+
+// MergeReport は設定の断片を結合した結果
+type MergeReport struct {
+    Source    string          `json:"source"`
+    Tunnels   []MergedTunnel  `json:"tunnels"`
+    Disabled  []MergedTunnel  `json:"disabled"`
+    Conflicts []MergeConflict `json:"conflicts"`
+}
+
+// hasFragments はconfig_dirかconfig_overrideを指定しているかを返す
+func hasFragments(settings *Settings) bool {
+    return settings.ConfigDir != "" || settings.ConfigOverride != ""
+}
+
+// rawTunnels はトンネルの配列か封筒から、トンネルの設定をそのままの形で取り出す
+func rawTunnels(body []byte) ([]json.RawMessage, error) {
+    var entries []json.RawMessage
+    if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+        var envelope struct {
+            Tunnels []json.RawMessage `json:"tunnels"`
+        }
+        err := json.Unmarshal(body, &envelope)
+        return envelope.Tunnels, err
+    }
+    err := json.Unmarshal(body, &entries)
+    return entries, err
+}
+
+// tunnelIDOf はトンネルの設定のtunnel_idを返す。読めなければ空
+func tunnelIDOf(raw json.RawMessage) string {
+    var config struct {
+        TunnelID string `json:"tunnel_id"`
+    }
+    json.Unmarshal(raw, &config)
+    return config.TunnelID
+}
+
+// fragmentFiles はconfig_dirの設定ファイルを名前順に返す。"." で始まるファイルは除く
+func fragmentFiles(dir string) ([]string, error) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var files []string
+    for _, entry := range entries {
+        switch strings.ToLower(filepath.Ext(entry.Name())) {
+        case ".json", ".yaml", ".yml", ".toml":
+            if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+                files = append(files, filepath.Join(dir, entry.Name()))
+            }
+        }
+    }
+    sort.Strings(files)
+    return files, nil
+}
+
+// readFragment は断片のファイルを拡張子の形式で読み込み、JSONに変換する
+func readFragment(file string) ([]byte, error) {
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    doc, err := parseConfigDocument(data, configFormat(file, ""))
+    if err != nil {
+        return nil, err
+    }
+    return doc.data, nil
+}
+
+// readOverride はconfig_overrideのファイルを拡張子の形式で読み込み、JSONに変換する
+// addとpatchの引用符なしの数値は、トンネルの設定の文字列のフィールドに合わせる
+func readOverride(file string) ([]byte, error) {
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    doc, err := parseDocument(data, configFormat(file, ""))
+    if err != nil {
+        return nil, err
+    }
+    doc.coerceStrings(reflect.TypeOf(struct {
+        Add     []TunnelConfig `json:"add"`
+        Patch   []TunnelConfig `json:"patch"`
+        Disable []string       `json:"disable"`
+    }{}))
+    return doc.data, nil
+}
+
+// mergeFragments はsourceから取得した設定にconfig_dirとconfig_overrideを結合する。bodyはJSONに変換した設定
+// config_dirや断片、config_overrideを読めない場合はエラーとし、サイクルを失敗させて前回の設定のまま動かす
+// 競合として扱うのはトンネル単位で結合できなかったものだけ
+func mergeFragments(settings *Settings, source string, body []byte) (*MergeReport, error) {
+    base, err := rawTunnels(body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to unmarshal JSON: %v", err)
+    }
+    report := &MergeReport{Source: source, Tunnels: []MergedTunnel{}, Disabled: []MergedTunnel{}, Conflicts: []MergeConflict{}}
+    conflict := func(tunnelID, origin, format string, args ...any) {
+        report.Conflicts = append(report.Conflicts, MergeConflict{TunnelID: tunnelID, Origin: origin, Reason: fmt.Sprintf(format, args...)})
+    }
+    find := func(tunnelID string) int {
+        for i, t := range report.Tunnels {
+            if tunnelID != "" && t.TunnelID == tunnelID {
+                return i
+            }
+        }
+        return -1
+    }
+    // 同じ断片の中の重複はparseConfigが重複として扱う
+    add := func(origin string, entries []json.RawMessage) {
+        for _, raw := range entries {
+            id := tunnelIDOf(raw)
+            if i := find(id); i >= 0 && report.Tunnels[i].Origin != origin {
+                conflict(id, origin, "tunnel_id is already defined in %s", report.Tunnels[i].Origin)
+                continue
+            }
+            report.Tunnels = append(report.Tunnels, MergedTunnel{TunnelID: id, Origin: origin, Config: raw})
+        }
+    }
+    add(source, base)
+
+    if settings.ConfigDir != "" {
+        files, err := fragmentFiles(settings.ConfigDir)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read config_dir: %v", err)
+        }
+        for _, file := range files {
+            data, err := readFragment(file)
+            if err != nil {
+                return nil, fmt.Errorf("failed to read config fragment %s: %v", file, err)
+            }
+            entries, err := rawTunnels(data)
+            if err != nil {
+                return nil, fmt.Errorf("failed to unmarshal config fragment %s: %v", file, err)
+            }
+            add(file, entries)
+        }
+    }
+
+    if settings.ConfigOverride != "" {
+        origin := settings.ConfigOverride
+        var override ConfigOverride
+        data, err := readOverride(origin)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read config_override: %v", err)
+        }
+        dec := json.NewDecoder(bytes.NewReader(data))
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&override); err != nil {
+            return nil, fmt.Errorf("failed to unmarshal config_override %s: %v", origin, err)
+        }
+
+        add(origin, override.Add)
+        fields := structSchema(reflect.TypeOf(TunnelConfig{}))["properties"].(map[string]any)
+        for _, raw := range override.Patch {
+            var patch map[string]json.RawMessage
+            if err := json.Unmarshal(raw, &patch); err != nil {
+                conflict("", origin, "patch ignored: %v", err)
+                continue
+            }
+            id := tunnelIDOf(raw)
+            i := find(id)
+            if i < 0 {
+                conflict(id, origin, "patch ignored: tunnel_id is not defined")
+                continue
+            }
+            var config map[string]json.RawMessage
+            if err := json.Unmarshal(report.Tunnels[i].Config, &config); err != nil {
+                conflict(id, origin, "patch ignored: %v", err)
+                continue
+            }
+            var unknown []string
+            for _, name := range sortedKeys(patch) {
+                if _, known := fields[name]; !known {
+                    unknown = append(unknown, name)
+                }
+                config[name] = patch[name]
+            }
+            if len(unknown) > 0 {
+                conflict(id, origin, "patch ignored: unknown field %s", strings.Join(unknown, ", "))
+                continue
+            }
+            patched, _ := json.Marshal(config)
+            report.Tunnels[i].Config, report.Tunnels[i].PatchedBy = patched, origin
+        }
+        for _, id := range override.Disable {
+            i := find(id)
+            if i < 0 {
+                conflict(id, origin, "disable ignored: tunnel_id is not defined")
+                continue
+            }
+            report.Disabled = append(report.Disabled, report.Tunnels[i])
+            report.Tunnels = append(report.Tunnels[:i], report.Tunnels[i+1:]...)
+        }
+    }
+    return report, nil
+}
+
+// body は結合した設定をトンネルの配列として返す
+func (r *MergeReport) body() []byte {
+    entries := make([]json.RawMessage, 0, len(r.Tunnels))
+    for _, t := range r.Tunnels {
+        entries = append(entries, t.Config)
+    }
+    data, _ := json.Marshal(entries)
+    return data
+}
+
+// mergeConfig はconfig_dirとconfig_overrideを指定している場合、それらを結合した設定をトンネルの配列として返す
+// 結合した設定には元のファイルでの位置はない。競合はERRORとして記録し、strict_configでは設定全体を拒否する
+func mergeConfig(settings *Settings, source string, doc *configDocument) (*configDocument, error) {
+    if !hasFragments(settings) {
+        return doc, nil
+    }
+    report, err := mergeFragments(settings, source, doc.data)
+    if err != nil {
+        return nil, err
+    }
+    if settings.StrictConfig && len(report.Conflicts) > 0 {
+        lines := make([]string, 0, len(report.Conflicts))
+        for _, c := range report.Conflicts {
+            lines = append(lines, c.String())
+        }
+        return nil, fmt.Errorf("config rejected by strict_config, %d fragment conflict(s):\n%s", len(report.Conflicts), strings.Join(lines, "\n"))
+    }
+    for _, c := range report.Conflicts {
+        slog.Error("Config fragment conflict", "tunnel_id", c.TunnelID, "origin", c.Origin, "reason", c.Reason)
+    }
+    for _, t := range report.Disabled {
+        slog.Debug("Tunnel disabled by config_override", "tunnel_id", t.TunnelID, "origin", t.Origin)
+    }
+    return &configDocument{format: formatJSON, data: report.body()}, nil
+}
+
+// fragmentsDigest はconfig_dirとconfig_overrideの内容のハッシュ。変わっていればconfig_sourceが変わっていなくても結合し直す
+func fragmentsDigest(settings *Settings) string {
+    if !hasFragments(settings) {
+        return ""
+    }
+    h := sha256.New()
+    var files []string
+    if settings.ConfigDir != "" {
+        var err error
+        files, err = fragmentFiles(settings.ConfigDir)
+        fmt.Fprintf(h, "%s\x00%v\x00", settings.ConfigDir, err)
+    }
+    if settings.ConfigOverride != "" {
+        files = append(files, settings.ConfigOverride)
+    }
+    for _, file := range files {
+        data, err := os.ReadFile(file)
+        fmt.Fprintf(h, "%s\x00%v\x00%d\x00", file, err, len(data))
+        h.Write(data)
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// buildMerged は "eipconf merged" のために設定を取得し、署名を確かめてから断片を結合する
+func buildMerged(settings *Settings) (*MergeReport, error) {
+    fetch := fetchFromSources(settings, false)
+    if fetch.err != nil {
+        return nil, fetch.err
+    }
+    doc, err := openConfig(settings, fetch)
+    if err != nil {
+        return nil, err
+    }
+    return mergeFragments(settings, fetch.source, doc.data)
+}
+
+// writeMerged は結合した設定をtext(表)またはjson形式で出力
+func writeMerged(w io.Writer, report *MergeReport, format string) error {
+    switch format {
+    case "json":
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        return enc.Encode(report)
+    case "text", "":
+        fmt.Fprintf(w, "Merged config from %s (%d tunnels)\n", report.Source, len(report.Tunnels))
+        tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(tw, "TUNNEL\tORIGIN\tPATCHED BY\tCONFIG")
+        for _, t := range report.Tunnels {
+            patchedBy := t.PatchedBy
+            if patchedBy == "" {
+                patchedBy = "-"
+            }
+            var config bytes.Buffer
+            if json.Compact(&config, t.Config) != nil {
+                config.Write(t.Config)
+            }
+            fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.TunnelID, t.Origin, patchedBy, config.String())
+        }
+        if err := tw.Flush(); err != nil {
+            return err
+        }
+        for _, t := range report.Disabled {
+            fmt.Fprintf(w, "# disabled %s: defined in %s\n", t.TunnelID, t.Origin)
+        }
+        for _, c := range report.Conflicts {
+            fmt.Fprintf(w, "# conflict %s\n", c)
+        }
+        return nil
+    default:
+        return fmt.Errorf("unknown merged format: %s", format)
+    }
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestMergeFragmentsFailsOnUnreadableSource(t *testing.T) {
+    tests := []struct {
+        name  string
+        files map[string]string // config_dirに置くファイル。"override"はconfig_override
+        noDir bool
+    }{
+        {name: "missing config_dir", noDir: true},
+        {name: "unparsable fragment", files: map[string]string{"10-a.yaml": "- tunnel_id: \"2\"\n  vlan_id: [\n"}},
+        {name: "unparsable config_override", files: map[string]string{"override": `{"add": [`}},
+        {name: "unknown field in config_override", files: map[string]string{"override": `{"remove": ["1"]}`}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, _, settings := useFakeDaemon(t, configTunnels1and2)
+            dir := t.TempDir()
+            settings.ConfigDir = filepath.Join(dir, "eipconf.d")
+            if err := os.Mkdir(settings.ConfigDir, 0755); err != nil {
+                t.Fatal(err)
+            }
+            if _, err := reconcile(settings, true); err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            want := hostState(t)
+
+            if tt.noDir {
+                os.Remove(settings.ConfigDir)
+            }
+            for name, body := range tt.files {
+                path := filepath.Join(settings.ConfigDir, name)
+                if name == "override" {
+                    path = filepath.Join(dir, "override.json")
+                    settings.ConfigOverride = path
+                }
+                if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if _, err := reconcile(settings, true); err == nil {
+                t.Errorf("reconcile succeeded with %s", tt.name)
+            }
+            if got := hostState(t); !reflect.DeepEqual(got, want) {
+                t.Errorf("state changed:\n got %v\nwant %v", got, want)
+            }
+        })
+    }
+}
+
+func TestMergeFragmentsConflictsAreSoft(t *testing.T) {
+    _, _, settings := useFakeDaemon(t, configTunnel1)
+    settings.ConfigDir = t.TempDir()
+    fragment := `[{"tunnel_id": "1", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.9", "vlan_id": "109"},
+                  {"tunnel_id": "2", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.2", "vlan_id": "101"}]`
+    if err := os.WriteFile(filepath.Join(settings.ConfigDir, "10-b.json"), []byte(fragment), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    // 既に定義されたtunnel_id 1は競合として除き、残りは適用する
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    want := map[string]string{"gif1": "192.0.2.10 198.51.100.1", "em2.100": "100", "bridge1": "em2.100,gif1",
+        "gif2": "192.0.2.10 198.51.100.2", "em2.101": "101", "bridge2": "em2.101,gif2"}
+    if got := hostState(t); !reflect.DeepEqual(got, want) {
+        t.Errorf("state:\n got %v\nwant %v", got, want)
+    }
+}
+
+func TestMergeFragmentsOrder(t *testing.T) {
+    source := `[{"tunnel_id": "1", "dst_addr": "198.51.100.1", "vlan_id": "100"}]`
+    tests := []struct {
+        name      string
+        files     map[string]string // config_dirに置くファイル。"override"で始まるものはconfig_override
+        tunnels   []string          // tunnel_id@断片、変更した場合は+config_override
+        disabled  []string
+        conflicts []string          // 断片: tunnel_id=ID: 理由
+        configs   map[string]string // tunnel_idごとの結合後の設定のフィールド=値
+    }{
+        {
+            name: "config_dir in name order",
+            files: map[string]string{
+                "20-b.json":  `[{"tunnel_id": "2", "dst_addr": "198.51.100.20", "vlan_id": "101"}]`,
+                "10-a.json":  `[{"tunnel_id": "2", "dst_addr": "198.51.100.10", "vlan_id": "101"}, {"tunnel_id": "3", "dst_addr": "198.51.100.3", "vlan_id": "102"}]`,
+                "README.txt": `not a fragment`,
+            },
+            tunnels:   []string{"1@source", "2@10-a.json", "3@10-a.json"},
+            conflicts: []string{"20-b.json: tunnel_id=2: tunnel_id is already defined in 10-a.json"},
+            configs:   map[string]string{"2": "dst_addr=198.51.100.10"},
+        },
+        {
+            name:      "source before config_dir",
+            files:     map[string]string{"10-a.json": `[{"tunnel_id": "1", "dst_addr": "198.51.100.9", "vlan_id": "100"}]`},
+            tunnels:   []string{"1@source"},
+            conflicts: []string{"10-a.json: tunnel_id=1: tunnel_id is already defined in source"},
+            configs:   map[string]string{"1": "dst_addr=198.51.100.1"},
+        },
+        {
+            name: "override add after config_dir",
+            files: map[string]string{
+                "10-a.json":     `[{"tunnel_id": "2", "dst_addr": "198.51.100.2", "vlan_id": "101"}]`,
+                "override.json": `{"add": [{"tunnel_id": "2", "dst_addr": "198.51.100.22", "vlan_id": "101"}, {"tunnel_id": "3", "dst_addr": "198.51.100.3", "vlan_id": "102"}]}`,
+            },
+            tunnels:   []string{"1@source", "2@10-a.json", "3@override.json"},
+            conflicts: []string{"override.json: tunnel_id=2: tunnel_id is already defined in 10-a.json"},
+        },
+        {
+            name:     "patch applies to added tunnel and disable after patch",
+            files:    map[string]string{"override.json": `{"disable": ["1"], "patch": [{"tunnel_id": "1", "vlan_id": "110"}, {"tunnel_id": "3", "dst_addr": "198.51.100.33"}], "add": [{"tunnel_id": "3", "dst_addr": "198.51.100.3", "vlan_id": "102"}]}`},
+            tunnels:  []string{"3@override.json+override.json"},
+            disabled: []string{"1@source+override.json"},
+            configs:  map[string]string{"3": "dst_addr=198.51.100.33"},
+        },
+        {
+            name:  "patch and disable of undefined tunnel",
+            files: map[string]string{"override.json": `{"patch": [{"tunnel_id": "9", "vlan_id": "110"}], "disable": ["8"]}`},
+            tunnels: []string{"1@source"},
+            conflicts: []string{
+                "override.json: tunnel_id=9: patch ignored: tunnel_id is not defined",
+                "override.json: tunnel_id=8: disable ignored: tunnel_id is not defined",
+            },
+        },
+        {
+            name:      "patch with unknown field",
+            files:     map[string]string{"override.json": `{"patch": [{"tunnel_id": "1", "vlan_id": "110", "mtu": "1400"}]}`},
+            tunnels:   []string{"1@source"},
+            conflicts: []string{"override.json: tunnel_id=1: patch ignored: unknown field mtu"},
+            configs:   map[string]string{"1": "vlan_id=100"},
+        },
+        {
+            name: "unquoted numbers in YAML and TOML",
+            files: map[string]string{
+                "10-a.yaml":     "- tunnel_id: 2\n  dst_addr: 198.51.100.2\n  vlan_id: 101\n",
+                "20-b.toml":     "[[tunnels]]\ntunnel_id = 3\ndst_addr = \"198.51.100.3\"\nvlan_id = 102\n",
+                "override.yaml": "patch:\n  - tunnel_id: 2\n    vlan_id: 120\ndisable:\n  - 3\n",
+            },
+            tunnels:  []string{"1@source", "2@10-a.yaml+override.yaml"},
+            disabled: []string{"3@20-b.toml"},
+            configs:  map[string]string{"2": "vlan_id=120"},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := t.TempDir()
+            settings := &Settings{ConfigDir: filepath.Join(dir, "eipconf.d")}
+            if err := os.Mkdir(settings.ConfigDir, 0755); err != nil {
+                t.Fatal(err)
+            }
+            for name, body := range tt.files {
+                path := filepath.Join(settings.ConfigDir, name)
+                if strings.HasPrefix(name, "override") {
+                    path = filepath.Join(dir, name)
+                    settings.ConfigOverride = path
+                }
+                if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            report, err := mergeFragments(settings, "source", []byte(source))
+            if err != nil {
+                t.Fatalf("mergeFragments: %v", err)
+            }
+            name := func(path string) string {
+                if path == "" || path == "source" {
+                    return path
+                }
+                return filepath.Base(path)
+            }
+            summary := func(tunnels []MergedTunnel) []string {
+                got := []string{}
+                for _, m := range tunnels {
+                    s := m.TunnelID + "@" + name(m.Origin)
+                    if m.PatchedBy != "" {
+                        s += "+" + name(m.PatchedBy)
+                    }
+                    got = append(got, s)
+                }
+                return got
+            }
+            if got := summary(report.Tunnels); !reflect.DeepEqual(got, tt.tunnels) {
+                t.Errorf("tunnels = %v, want %v", got, tt.tunnels)
+            }
+            if got, want := summary(report.Disabled), append([]string{}, tt.disabled...); !reflect.DeepEqual(got, want) {
+                t.Errorf("disabled = %v, want %v", got, want)
+            }
+            conflicts := []string{}
+            for _, c := range report.Conflicts {
+                c.Origin = name(c.Origin)
+                c.Reason = strings.ReplaceAll(c.Reason, settings.ConfigDir+string(filepath.Separator), "")
+                conflicts = append(conflicts, c.String())
+            }
+            if want := append([]string{}, tt.conflicts...); !reflect.DeepEqual(conflicts, want) {
+                t.Errorf("conflicts = %v, want %v", conflicts, want)
+            }
+            for id, want := range tt.configs {
+                field, value, _ := strings.Cut(want, "=")
+                for _, m := range report.Tunnels {
+                    var config map[string]any
+                    json.Unmarshal(m.Config, &config)
+                    if m.TunnelID == id && config[field] != value {
+                        t.Errorf("tunnel %s config = %s, want %s", id, m.Config, want)
+                    }
+                }
+            }
+        })
+    }
+}
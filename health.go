@@ -0,0 +1,191 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// healthState は/healthzと/readyzで報告する直近のサイクルの結果
+type healthState struct {
+    mu sync.Mutex
+
+    cycleAt  time.Time // 最後にサイクルを始めた時刻。起動直後は起動時刻
+    pausedAt time.Time // 一時停止中のループが最後に確認した時刻
+
+    fetchAt    time.Time
+    fetchError string
+
+    configFetchedAt time.Time // 適用中の設定を取得した時刻。キャッシュの場合はキャッシュの取得時刻
+    fromCache       bool
+
+    applyAt     time.Time
+    applyFailed int    // 失敗した操作の数
+    heldReason  string // セーフガードで止めている場合の理由
+
+    degraded []string // 設定どおりになっていないトンネル
+}
+
+var health = &healthState{cycleAt: time.Now()}
+
+func (h *healthState) recordCycleStart() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.cycleAt = time.Now()
+}
+
+// recordPaused は一時停止中のループが動いていることを記録する
+// サイクルを始めなくてもloopの確認を通し、監視による再起動で一時停止が解除されないようにする
+func (h *healthState) recordPaused() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.pausedAt = time.Now()
+}
+
+// recordFetch は設定の取得結果と、適用する設定の取得時刻を記録する
+func (h *healthState) recordFetch(err error, configFetchedAt time.Time, fromCache bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.fetchAt = time.Now()
+    h.fetchError = ""
+    if err != nil {
+        h.fetchError = err.Error()
+    }
+    if !configFetchedAt.IsZero() {
+        h.configFetchedAt, h.fromCache = configFetchedAt, fromCache
+    }
+}
+
+// recordApply は適用結果を記録する。resultがnilの場合はセーフガードで止めたものとして扱う
+func (h *healthState) recordApply(result *ApplyResult, heldReason string, degraded []string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.applyAt = time.Now()
+    h.applyFailed = 0
+    if result != nil {
+        h.applyFailed = result.Failed
+    }
+    h.heldReason = heldReason
+    h.degraded = degraded
+}
+
+// healthCheck は1つの確認項目の結果
+type healthCheck struct {
+    OK            bool       `json:"ok"`
+    At            *time.Time `json:"at,omitempty"`
+    AgeSeconds    float64    `json:"age_seconds,omitempty"`
+    MaxAgeSeconds float64    `json:"max_age_seconds,omitempty"`
+    FromCache     bool       `json:"from_cache,omitempty"`
+    Error         string     `json:"error,omitempty"`
+    Failed        int        `json:"failed_operations,omitempty"`
+    HeldReason    string     `json:"held_reason,omitempty"`
+    Degraded      []string   `json:"degraded,omitempty"`
+    Paused        bool       `json:"paused,omitempty"`
+}
+
+// HealthReport は/healthzと/readyzの応答
+type HealthReport struct {
+    Status string                 `json:"status"` // "ok" または "fail"
+    Checks map[string]healthCheck `json:"checks"`
+}
+
+// ageCheck はatからの経過時間がmaxAge以内かを確認する
+func ageCheck(at time.Time, maxAge time.Duration, now time.Time) healthCheck {
+    if at.IsZero() {
+        return healthCheck{OK: false, MaxAgeSeconds: maxAge.Seconds(), Error: "never"}
+    }
+    age := now.Sub(at)
+    return healthCheck{OK: age <= maxAge, At: &at, AgeSeconds: age.Seconds(), MaxAgeSeconds: maxAge.Seconds()}
+}
+
+// report は確認項目をすべて作り、gateに含まれる項目がすべてokならstatusをokにする
+func (h *healthState) report(settings *Settings, gate []string) HealthReport {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    now := time.Now()
+
+    checks := make(map[string]healthCheck)
+    loopAt := h.cycleAt
+    if h.pausedAt.After(loopAt) {
+        loopAt = h.pausedAt
+    }
+    loop := ageCheck(loopAt, time.Duration(settings.HealthMaxCycleAge)*time.Second, now)
+    loop.Paused = h.pausedAt.After(h.cycleAt)
+    checks["loop"] = loop
+
+    fetch := healthCheck{OK: h.fetchError == "" && !h.fetchAt.IsZero(), Error: h.fetchError}
+    if h.fetchAt.IsZero() {
+        fetch.Error = "never"
+    } else {
+        at := h.fetchAt
+        fetch.At = &at
+    }
+    checks["config_fetch"] = fetch
+
+    config := ageCheck(h.configFetchedAt, time.Duration(settings.ReadyMaxConfigAge)*time.Second, now)
+    config.FromCache = h.fromCache
+    checks["config_age"] = config
+
+    apply := healthCheck{OK: !h.applyAt.IsZero() && h.applyFailed == 0 && h.heldReason == "", Failed: h.applyFailed, HeldReason: h.heldReason}
+    if h.applyAt.IsZero() {
+        apply.Error = "never"
+    } else {
+        at := h.applyAt
+        apply.At = &at
+    }
+    checks["apply"] = apply
+
+    checks["tunnels"] = healthCheck{OK: len(h.degraded) == 0, Degraded: h.degraded}
+
+    status := "ok"
+    for _, name := range gate {
+        if !checks[name].OK {
+            status = "fail"
+        }
+    }
+    return HealthReport{Status: status, Checks: checks}
+}
+
+// degradedTunnels は設定にあるトンネルのうち、競合、ロールバック、セーフガードで設定どおりになっていないものを返す
+// resultがnilの場合は計画を適用しなかったものとして扱う
+func degradedTunnels(configs []TunnelConfig, plan *ReconcilePlan, result *ApplyResult) []string {
+    down := make(map[string]bool)
+    for _, c := range plan.Conflicts {
+        down[c.TunnelID] = true
+    }
+    if result == nil {
+        for _, t := range plan.Tunnels {
+            down[t.TunnelID] = true
+        }
+    } else {
+        for _, t := range result.Tunnels {
+            if t.Status != "applied" {
+                down[t.TunnelID] = true
+            }
+        }
+    }
+    degraded := []string{}
+    for _, config := range configs {
+        if down[config.TunnelID] {
+            degraded = append(degraded, config.TunnelID)
+        }
+    }
+    sort.Strings(degraded)
+    return degraded
+}
+
+// healthHandler はgateの項目で判定するハンドラを返す。失敗時は503を返す
+func healthHandler(settings *Settings, gate ...string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        report := health.report(settings, gate)
+        w.Header().Set("Content-Type", "application/json")
+        if report.Status != "ok" {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        enc.Encode(report)
+    }
+}
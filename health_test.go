@@ -0,0 +1,45 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestHealthLoopWhilePaused(t *testing.T) {
+    saved := health
+    t.Cleanup(func() { health = saved })
+    health = &healthState{cycleAt: time.Now().Add(-time.Hour)}
+    settings := &Settings{HealthMaxCycleAge: 60}
+
+    get := func() int {
+        w := httptest.NewRecorder()
+        healthHandler(settings, "loop")(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+        return w.Code
+    }
+    if code := get(); code != http.StatusServiceUnavailable {
+        t.Errorf("stalled loop: /healthz = %d, want 503", code)
+    }
+
+    // 一時停止中もループが動いていればokとし、pausedをつける
+    health.recordPaused()
+    if code := get(); code != http.StatusOK {
+        t.Errorf("paused loop: /healthz = %d, want 200", code)
+    }
+    if loop := health.report(settings, nil).Checks["loop"]; !loop.OK || !loop.Paused {
+        t.Errorf("paused loop check = %+v, want ok and paused", loop)
+    }
+
+    // 再開してサイクルを始めればpausedは外れる
+    health.recordCycleStart()
+    if loop := health.report(settings, nil).Checks["loop"]; !loop.OK || loop.Paused {
+        t.Errorf("resumed loop check = %+v, want ok and not paused", loop)
+    }
+
+    // 一時停止中のループ自体が止まれば失敗する
+    health = &healthState{cycleAt: time.Now().Add(-2 * time.Hour), pausedAt: time.Now().Add(-time.Hour)}
+    if code := get(); code != http.StatusServiceUnavailable {
+        t.Errorf("stalled paused loop: /healthz = %d, want 503", code)
+    }
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "strings"
+    "time"
+)
+
+// PendingRemoval は設定から消えたが、ホールドダウン中のため削除を待っているトンネル
+type PendingRemoval struct {
+    TunnelID string    `json:"tunnel_id"`
+    Ifaces   []string  `json:"ifaces"`   // 削除を待っているgif、bridge、VLAN
+    Since    time.Time `json:"since"`    // 最初に設定から消えていた時刻
+    Fetches  int       `json:"fetches"`  // 続けて設定から消えていた回数
+    New      bool      `json:"new"`      // このサイクルで初めて保留にしたか
+}
+
+// removalTracker はトンネルが設定から続けて消えている時刻と回数を記録する
+type removalTracker struct {
+    since   map[string]time.Time
+    fetches map[string]int
+}
+
+func newRemovalTracker() *removalTracker {
+    return &removalTracker{since: make(map[string]time.Time), fetches: make(map[string]int)}
+}
+
+// pendingRemovals はデーモンのサイクルをまたいで使う記録。再起動すると数え直す
+var pendingRemovals = newRemovalTracker()
+
+// pending はホールドダウン中の削除があるかを返す
+func (t *removalTracker) pending() bool {
+    return len(t.since) > 0
+}
+
+// holdRemovals はホールドダウンを満たしていないトンネルの削除を計画から外し、plan.Pendingに移す
+// removal_hold_downとremoval_hold_down_fetchesの両方を設定した場合は両方を満たすまで削除しない
+// fetchedはこのサイクルでソースから設定を取得したか、304で変わっていないことを確かめたか
+// リセットやキャッシュの設定で動いたサイクルは、消えていた回数に数えない
+func (t *removalTracker) holdRemovals(plan *ReconcilePlan, settings *Settings, now time.Time, fetched bool) {
+    holdDown := time.Duration(settings.RemovalHoldDown) * time.Second
+    if holdDown <= 0 && settings.RemovalHoldDownFetches <= 0 {
+        return
+    }
+
+    // トンネルごとにgifとbridgeの削除をまとめ、bridgeのメンバーだったVLANも一緒に扱う
+    byTunnel := make(map[string][]Change)
+    vlanTunnel := make(map[string]string)
+    for _, c := range plan.Removals {
+        byTunnel[c.TunnelID] = append(byTunnel[c.TunnelID], c)
+        if c.Kind == "bridge" && c.Before != nil {
+            for _, member := range c.Before.Members {
+                vlanTunnel[member] = c.TunnelID
+            }
+        }
+    }
+
+    for id := range t.since {
+        if _, missing := byTunnel[id]; !missing {
+            slog.Info("Pending removal cancelled", "tunnel_id", id, "since", t.since[id], "fetches", t.fetches[id])
+            delete(t.since, id)
+            delete(t.fetches, id)
+        }
+    }
+
+    held := make(map[string]*PendingRemoval)
+    for id := range byTunnel {
+        _, tracked := t.since[id]
+        if !tracked {
+            t.since[id] = now
+        }
+        if fetched {
+            t.fetches[id]++
+        }
+        since, fetches := t.since[id], t.fetches[id]
+        if now.Sub(since) >= holdDown && fetches >= settings.RemovalHoldDownFetches {
+            slog.Info("Hold-down expired, removing tunnel", "tunnel_id", id, "since", since, "fetches", fetches)
+            delete(t.since, id)
+            delete(t.fetches, id)
+            continue
+        }
+        held[id] = &PendingRemoval{TunnelID: id, Since: since, Fetches: fetches, New: !tracked}
+    }
+    if len(held) == 0 {
+        return
+    }
+
+    removals := []Change{}
+    for _, c := range plan.Removals {
+        if p, ok := held[c.TunnelID]; ok {
+            p.Ifaces = append(p.Ifaces, c.Iface)
+            continue
+        }
+        removals = append(removals, c)
+    }
+    cleanup := []Change{}
+    for _, c := range plan.Cleanup {
+        if p, ok := held[vlanTunnel[c.Iface]]; ok {
+            p.Ifaces = append(p.Ifaces, c.Iface)
+            continue
+        }
+        cleanup = append(cleanup, c)
+    }
+    plan.Removals, plan.Cleanup = removals, cleanup
+
+    for _, id := range sortedKeys(held) {
+        p := held[id]
+        plan.Pending = append(plan.Pending, *p)
+        slog.Info("Tunnel pending removal", "tunnel_id", id, "ifaces", p.Ifaces, "since", p.Since, "fetches", p.Fetches,
+            "hold_down", holdDown, "hold_down_fetches", settings.RemovalHoldDownFetches)
+    }
+}
+
+// describePending は保留中の削除を "tunnel_id=2 (gif2, bridge2): absent since ... for 1 fetch(es)" の形式で表す
+func describePending(p PendingRemoval, quote string) string {
+    return fmt.Sprintf("tunnel_id=%s%s%s (%s): absent since %s%s%s for %s%d%s fetch(es)",
+        quote, p.TunnelID, quote, strings.Join(p.Ifaces, ", "), quote, p.Since.Format(time.RFC3339), quote, quote, p.Fetches, quote)
+}
@@ -7,42 +7,77 @@ import (
     "flag"
     "fmt"
     "path/filepath"
+    "io"
     "io/ioutil"
     "log/slog"
     "net"
     "net/http"
     "os"
-    "os/exec"
     "os/signal"
-    "regexp"
+    "reflect"
     "strings"
     "syscall"
     "time"
 )
 
 type Settings struct {
-    ConfigSource         string `json:"config_source"`
-    PhysicalIface        string `json:"physical_iface"`
-    SlackWebhookURL      string `json:"slack_webhook_url,omitempty"`
-    SlackChannel         string `json:"slack_channel,omitempty"`
-    SlackUsername        string `json:"slack_username,omitempty"`
-    SlackIconEmoji       string `json:"slack_icon_emoji,omitempty"`
-    LogLevel             string `json:"log_level,omitempty"`
-    LogFile              string `json:"log_file,omitempty"`
-    FetchInterval        int    `json:"fetch_interval,omitempty"`
-    DefaultSrcAddr       string `json:"default_src_addr,omitempty"`
-    DefaultSrcIface      string `json:"default_src_iface,omitempty"`
+    ConfigSource           string            `json:"config_source,omitempty" jsonschema:"requiredWithout=config_sources"`
+    ConfigSources          []string          `json:"config_sources,omitempty"`
+    ConfigDir              string            `json:"config_dir,omitempty"`
+    ConfigOverride         string            `json:"config_override,omitempty"`
+    PhysicalIface          string            `json:"physical_iface" jsonschema:"required"`
+    SlackWebhookURL        string            `json:"slack_webhook_url,omitempty"`
+    SlackChannel           string            `json:"slack_channel,omitempty"`
+    SlackUsername          string            `json:"slack_username,omitempty"`
+    SlackIconEmoji         string            `json:"slack_icon_emoji,omitempty"`
+    LogLevel               string            `json:"log_level,omitempty" jsonschema:"enum=DEBUG|INFO|WARN|ERROR|debug|info|warn|error"`
+    LogFile                string            `json:"log_file,omitempty"`
+    FetchInterval          int               `json:"fetch_interval,omitempty" jsonschema:"minimum=0"`
+    FetchConnectTimeout    int               `json:"fetch_connect_timeout,omitempty" jsonschema:"minimum=0"`
+    FetchTimeout           int               `json:"fetch_timeout,omitempty" jsonschema:"minimum=0"`
+    FetchMaxBytes          int               `json:"fetch_max_bytes,omitempty" jsonschema:"minimum=0"`
+    FetchBearerTokenFile   string            `json:"fetch_bearer_token_file,omitempty"`
+    FetchBearerTokenEnv    string            `json:"fetch_bearer_token_env,omitempty"`
+    FetchBasicAuthFile     string            `json:"fetch_basic_auth_file,omitempty"`
+    FetchBasicAuthEnv      string            `json:"fetch_basic_auth_env,omitempty"`
+    FetchCAFile            string            `json:"fetch_ca_file,omitempty"`
+    FetchClientCert        string            `json:"fetch_client_cert,omitempty"`
+    FetchClientKey         string            `json:"fetch_client_key,omitempty"`
+    FetchProxy             string            `json:"fetch_proxy,omitempty"`
+    DefaultSrcAddr         string            `json:"default_src_addr,omitempty" jsonschema:"format=ip"`
+    DefaultSrcIface        string            `json:"default_src_iface,omitempty"`
+    InterfaceBackend       string            `json:"interface_backend,omitempty" jsonschema:"enum=auto|native|ifconfig"`
+    StateDir               string            `json:"state_dir,omitempty"`
+    AdoptExisting          bool              `json:"adopt_existing,omitempty"`
+    CacheAfterFailures     int               `json:"cache_after_failures,omitempty" jsonschema:"minimum=0"`
+    DriftCheckInterval     int               `json:"drift_check_interval,omitempty" jsonschema:"minimum=0"`
+    StrictConfig           bool              `json:"strict_config,omitempty"`
+    TrustedKeys            []string          `json:"trusted_keys,omitempty"`
+    SignatureSource        string            `json:"signature_source,omitempty"`
+    AllowEmptyConfig       bool              `json:"allow_empty_config,omitempty"`
+    MaxRemovals            int               `json:"max_removals,omitempty" jsonschema:"minimum=0"`
+    MaxRemovalPercent      int               `json:"max_removal_percent,omitempty" jsonschema:"minimum=0;maximum=100"`
+    RemovalHoldDown        int               `json:"removal_hold_down,omitempty" jsonschema:"minimum=0"`
+    RemovalHoldDownFetches int               `json:"removal_hold_down_fetches,omitempty" jsonschema:"minimum=0"`
+    HTTPListen             string            `json:"http_listen,omitempty"`
+    HealthMaxCycleAge      int               `json:"health_max_cycle_age,omitempty" jsonschema:"minimum=0"`
+    ReadyMaxConfigAge      int               `json:"ready_max_config_age,omitempty" jsonschema:"minimum=0"`
+    ControlSocket          string            `json:"control_socket,omitempty"`
+    Hostname               string            `json:"hostname,omitempty"`
+    Labels                 map[string]string `json:"labels,omitempty"`
 }
 
 
 type TunnelConfig struct {
-    TunnelID    string `json:"tunnel_id"`
-    SrcAddr     string `json:"src_addr,omitempty"`
-    DstAddr     string `json:"dst_addr"`
-    DstHostname string `json:"dst_hostname,omitempty"`
-    VlanID      string `json:"vlan_id"`
-    IPVersion   string `json:"ip_version,omitempty"` // "4" または "6"
-    Description string `json:"description,omitempty"`
+    TunnelID    string            `json:"tunnel_id" jsonschema:"required;pattern=^(0|[1-9][0-9]*)$;maxLength=9"`
+    SrcAddr     string            `json:"src_addr,omitempty" jsonschema:"format=ip"`
+    DstAddr     string            `json:"dst_addr" jsonschema:"requiredWithout=dst_hostname;format=ip"`
+    DstHostname string            `json:"dst_hostname,omitempty"`
+    VlanID      string            `json:"vlan_id" jsonschema:"required;pattern=^([1-9][0-9]{0,2}|[1-3][0-9]{3}|40[0-8][0-9]|409[0-4])$"`
+    IPVersion   string            `json:"ip_version,omitempty" jsonschema:"enum=4|6"` // "4" または "6"
+    Description string            `json:"description,omitempty"`
+    Hosts       []string          `json:"hosts,omitempty"`  // 適用するホスト名のglob。selector.goを参照
+    Labels      map[string]string `json:"labels,omitempty"` // 適用するホストのラベル
 }
 
 type InterfaceConfig struct {
@@ -138,9 +173,15 @@ func sendToSlack(message string, level slog.Level, settings *Settings) {
 }
 
 
-// notifyConfigDiff は差分をslog経由でINFOとして出力し、Slackにも通知
-func notifyConfigDiff(gifsToAdd, gifsToModify, gifsToRemove map[string]InterfaceConfig, bridgesToAdd, bridgesToRemove map[string]BridgeConfig, settings *Settings) {
-    if len(gifsToAdd) == 0 && len(gifsToModify) == 0 && len(gifsToRemove) == 0 && len(bridgesToAdd) == 0 && len(bridgesToRemove) == 0 {
+// notifyConfigDiff は変更計画をslog経由でINFOとして出力し、Slackにも通知
+// serialは適用する設定のシリアル番号で、0の場合は出力しない
+func notifyConfigDiff(plan *ReconcilePlan, serial int64, settings *Settings) {
+    // 保留中の削除は新たに保留にしたサイクルだけ通知する
+    newPending := false
+    for _, p := range plan.Pending {
+        newPending = newPending || p.New
+    }
+    if plan.Empty() && !newPending {
         return
     }
 
@@ -149,28 +190,51 @@ func notifyConfigDiff(gifsToAdd, gifsToModify, gifsToRemove map[string]Interface
         hostname = "unknown"
     }
 
-    var msg strings.Builder
-    msg.WriteString(fmt.Sprintf("Configuration updated on %s:\n", hostname))
+    vlanIDs := make(map[string]string)
+    for _, t := range plan.Tunnels {
+        vlanIDs[t.TunnelID] = t.VlanID
+    }
 
-    if len(gifsToAdd) > 0 {
-        msg.WriteString("Added tunnels:\n")
-        for _, config := range gifsToAdd {
+    var added, modified, removed, pending, vlans, bridges []string
+    for _, p := range plan.Pending {
+        pending = append(pending, fmt.Sprintf("- %s\n", describePending(p, "`")))
+    }
+    for _, c := range plan.Changes() {
+        switch {
+        case c.Kind == "gif" && c.Action == "create":
             // すべての動的値をバックティックで囲む
-            msg.WriteString(fmt.Sprintf("- tunnel_id=`%s`, src_addr=`%s`, dst_addr=`%s`, vlan_id=`%s`, description=`%s`\n", config.TunnelID, config.Src, config.Dst, config.Vlan, config.Description))
+            added = append(added, fmt.Sprintf("- tunnel_id=`%s`, %s, vlan_id=`%s`\n", c.TunnelID, stateDiff(nil, c.After, "`"), vlanIDs[c.TunnelID]))
+        case c.Kind == "gif" && c.Action == "modify":
+            modified = append(modified, fmt.Sprintf("- tunnel_id=`%s`, vlan_id=`%s`: %s\n", c.TunnelID, vlanIDs[c.TunnelID], stateDiff(c.Before, c.After, "`")))
+        case c.Kind == "gif":
+            removed = append(removed, fmt.Sprintf("- tunnel_id=`%s`, %s\n", c.TunnelID, stateDiff(c.Before, nil, "`")))
+        case c.Kind == "vlan":
+            vlans = append(vlans, fmt.Sprintf("- %s `%s`: %s\n", c.Action, c.Iface, stateDiff(c.Before, c.After, "`")))
+        case c.Kind == "bridge":
+            bridges = append(bridges, fmt.Sprintf("- %s `%s`: %s\n", c.Action, c.Iface, stateDiff(c.Before, c.After, "`")))
         }
     }
 
-    if len(gifsToModify) > 0 {
-        msg.WriteString("Modified tunnels:\n")
-        for _, config := range gifsToModify {
-            msg.WriteString(fmt.Sprintf("- tunnel_id=`%s`, src_addr=`%s`, dst_addr=`%s`, vlan_id=`%s`, description=`%s`\n", config.TunnelID, config.Src, config.Dst, config.Vlan, config.Description))
-        }
+    var msg strings.Builder
+    if serial > 0 {
+        msg.WriteString(fmt.Sprintf("Configuration updated on %s (serial `%d`):\n", hostname, serial))
+    } else {
+        msg.WriteString(fmt.Sprintf("Configuration updated on %s:\n", hostname))
     }
-
-    if len(gifsToRemove) > 0 {
-        msg.WriteString("Removed tunnels:\n")
-        for _, config := range gifsToRemove {
-            msg.WriteString(fmt.Sprintf("- tunnel_id=`%s`, src_addr=`%s`, dst_addr=`%s`, vlan_id=`%s`\n", config.TunnelID, config.Src, config.Dst, config.Vlan))
+    for _, section := range []struct {
+        title string
+        lines []string
+    }{
+        {"Added tunnels:", added},
+        {"Modified tunnels:", modified},
+        {"Removed tunnels:", removed},
+        {"Pending removal:", pending},
+        {"VLAN changes:", vlans},
+        {"Bridge changes:", bridges},
+    } {
+        if len(section.lines) > 0 {
+            msg.WriteString(section.title + "\n")
+            msg.WriteString(strings.Join(section.lines, ""))
         }
     }
 
@@ -181,11 +245,14 @@ func notifyConfigDiff(gifsToAdd, gifsToModify, gifsToRemove map[string]Interface
     }
 }
 
+// commandRetryDelay はコマンド失敗時の再試行までの待ち時間
+var commandRetryDelay = time.Second
+
 // runCommand はコマンドを実行し、エラーがあれば再試行する
-func runCommand(cmd string, args ...string) error {
+// actionは失敗を記録するメトリクスのラベルで、操作の種類(create、tunnelなど)を渡す
+func runCommand(action, cmd string, args ...string) error {
     for attempt := 0; attempt < 3; attempt++ {
-        command := exec.Command(cmd, args...)
-        output, err := command.CombinedOutput()
+        output, err := executor.CombinedOutput(cmd, args...)
         if err == nil {
             slog.Info("Command succeeded", "cmd", cmd, "args", args)
             return nil
@@ -196,9 +263,10 @@ func runCommand(cmd string, args ...string) error {
             return nil
         }
         slog.Error("Command failed", "cmd", cmd, "args", args, "error", outputStr)
+        recordCommandFailure(cmd, action, attempt < 2)
         if attempt < 2 {
-            slog.Info("Retrying in 1 second")
-            time.Sleep(time.Second)
+            slog.Info("Retrying", "delay", commandRetryDelay)
+            time.Sleep(commandRetryDelay)
         }
     }
     return fmt.Errorf("command failed after 3 attempts: %s %v", cmd, args)
@@ -206,84 +274,57 @@ func runCommand(cmd string, args ...string) error {
 
 // getCurrentInterfaces は現在のgif、VLAN、bridgeインターフェースを取得
 func getCurrentInterfaces() (map[string]InterfaceConfig, map[string]BridgeConfig, map[string]string) {
-    gifInterfaces := make(map[string]InterfaceConfig)
-    bridgeInterfaces := make(map[string]BridgeConfig)
-    vlanInterfaces := make(map[string]string)
-
-    output, err := exec.Command("ifconfig", "-a").Output()
+    gifInterfaces, bridgeInterfaces, vlanInterfaces, err := backend.List()
     if err != nil {
-        slog.Error("Failed to get current interfaces", "error", err)
-        return gifInterfaces, bridgeInterfaces, vlanInterfaces
-    }
-
-    lines := strings.Split(string(output), "\n")
-    for _, line := range lines {
-        if strings.HasPrefix(line, "gif") {
-            gifName := regexp.MustCompile(`gif\d+`).FindString(line)
-            if gifName != "" {
-                detail, _ := exec.Command("ifconfig", gifName).Output()
-                detailStr := string(detail)
-                var desc string
-                for _, l := range strings.Split(detailStr, "\n") {
-                    l = strings.TrimSpace(l)
-                    if strings.HasPrefix(l, "description:") {
-                        desc = strings.TrimSpace(strings.TrimPrefix(l, "description:"))
-                        break
-                    }
-                }
-                srcDstIPv4 := regexp.MustCompile(`tunnel inet (\S+) --> (\S+)`).FindStringSubmatch(detailStr)
-                srcDstIPv6 := regexp.MustCompile(`tunnel inet6 (\S+) --> (\S+)`).FindStringSubmatch(detailStr)
-                tunnelID := strings.TrimPrefix(gifName, "gif")
-                if len(srcDstIPv4) == 3 {
-                    gifInterfaces[gifName] = InterfaceConfig{Src: srcDstIPv4[1], Dst: srcDstIPv4[2], Vlan: "", IsIPv6: false, TunnelID: tunnelID, Description: desc}
-                } else if len(srcDstIPv6) == 3 {
-                    gifInterfaces[gifName] = InterfaceConfig{Src: srcDstIPv6[1], Dst: srcDstIPv6[2], Vlan: "", IsIPv6: true, TunnelID: tunnelID, Description: desc}
-                } else {
-                    gifInterfaces[gifName] = InterfaceConfig{Src: "", Dst: "", Vlan: "", IsIPv6: false, TunnelID: tunnelID, Description: desc}
-                }
-            }
-        }
-        if strings.HasPrefix(line, "bridge") {
-            bridgeName := regexp.MustCompile(`bridge\d+`).FindString(line)
-            if bridgeName != "" {
-                detail, _ := exec.Command("ifconfig", bridgeName).Output()
-                members := regexp.MustCompile(`member: (\S+)`).FindAllStringSubmatch(string(detail), -1)
-                memberList := []string{}
-                for _, m := range members {
-                    memberList = append(memberList, m[1])
-                }
-                tunnelID := strings.TrimPrefix(bridgeName, "bridge")
-                bridgeInterfaces[bridgeName] = BridgeConfig{Members: memberList, TunnelID: tunnelID}
-            }
-        }
-        if regexp.MustCompile(`\w+\.\d+`).MatchString(line) {
-            vlanName := regexp.MustCompile(`\w+\.\d+`).FindString(line)
-            if vlanName != "" {
-                detail, _ := exec.Command("ifconfig", vlanName).Output()
-                vlanID := regexp.MustCompile(`vlan: (\d+)`).FindStringSubmatch(string(detail))
-                if len(vlanID) == 2 {
-                    vlanInterfaces[vlanName] = vlanID[1]
-                }
-            }
-        }
+        slog.Error("Failed to get current interfaces", "backend", backend.Name(), "error", err)
+    } else {
+        pruneOwnership(gifInterfaces, bridgeInterfaces, vlanInterfaces)
+        recordInterfaces(gifInterfaces, bridgeInterfaces, vlanInterfaces)
     }
     return gifInterfaces, bridgeInterfaces, vlanInterfaces
 }
 
+// parseSettingsDocument はsettings.jsonを拡張子の形式で読み込み、引用符なしの数値を文字列のフィールドに合わせる
+func parseSettingsDocument(data []byte, filename string) (*configDocument, error) {
+    doc, err := parseDocument(data, configFormat(filename, ""))
+    if err != nil {
+        return nil, err
+    }
+    doc.coerceStrings(reflect.TypeOf(Settings{}))
+    return doc, nil
+}
+
 func loadSettings(filename string) (Settings, error) {
     data, err := ioutil.ReadFile(filename)
     if err != nil {
         return Settings{}, fmt.Errorf("failed to read settings file: %v", err)
     }
 
+    doc, err := parseSettingsDocument(data, filename)
+    if err != nil {
+        return Settings{}, err
+    }
     var settings Settings
-    if err := json.Unmarshal(data, &settings); err != nil {
+    if err := doc.unmarshal(&settings); err != nil {
         return Settings{}, fmt.Errorf("failed to unmarshal settings: %v", err)
     }
 
-    if settings.ConfigSource == "" || settings.PhysicalIface == "" {
+    // config_sourceはconfig_sourcesが1つだけの場合と同じ。以降ConfigSourceはプライマリのソースを表す
+    if settings.ConfigSource != "" && len(settings.ConfigSources) > 0 {
+        return Settings{}, fmt.Errorf("config_source and config_sources cannot be used together")
+    }
+    if settings.ConfigSource != "" {
+        settings.ConfigSources = []string{settings.ConfigSource}
+    }
+    if len(settings.ConfigSources) == 0 || settings.PhysicalIface == "" {
         return Settings{}, fmt.Errorf("ConfigSource or PhysicalIface is not specified in settings file")
     }
+    for i, source := range settings.ConfigSources {
+        if source == "" || containsString(settings.ConfigSources[:i], source) {
+            return Settings{}, fmt.Errorf("config_sources[%d] is empty or duplicated: %q", i, source)
+        }
+    }
+    settings.ConfigSource = settings.ConfigSources[0]
 
     if envURL := os.Getenv("SLACK_WEBHOOK_URL"); envURL != "" {
         settings.SlackWebhookURL = envURL
@@ -293,79 +334,165 @@ func loadSettings(filename string) (Settings, error) {
         settings.FetchInterval = 30
     }
 
+    if settings.FetchConnectTimeout <= 0 {
+        settings.FetchConnectTimeout = 10
+    }
+    if settings.FetchTimeout <= 0 {
+        settings.FetchTimeout = 30
+    }
+    if settings.FetchMaxBytes <= 0 {
+        settings.FetchMaxBytes = 10 << 20
+    }
+
+    // 失敗時の待ち時間が延びていくため、既定値は取得間隔より十分長くする
+    if settings.HealthMaxCycleAge <= 0 {
+        settings.HealthMaxCycleAge = settings.FetchInterval*5 + 60
+    }
+    if settings.ReadyMaxConfigAge <= 0 {
+        settings.ReadyMaxConfigAge = settings.FetchInterval * 10
+    }
+
+    if settings.ControlSocket == "" {
+        settings.ControlSocket = "/var/run/eipconf.sock"
+    }
+
+    // トンネルの設定のhostsと突き合わせるホスト名
+    if settings.Hostname == "" {
+        settings.Hostname, _ = os.Hostname()
+    }
+
+    if settings.StateDir == "" {
+        settings.StateDir = "/var/db/eipconf"
+    }
+
+    // 設定が変わっていない間は、この間隔でだけインターフェイスを読み込んで設定と突き合わせる
+    if settings.DriftCheckInterval <= 0 {
+        settings.DriftCheckInterval = settings.FetchInterval * 10
+    }
+
+    if settings.CacheAfterFailures <= 0 {
+        settings.CacheAfterFailures = 3
+    }
+
+    if settings.RemovalHoldDown < 0 || settings.RemovalHoldDownFetches < 0 {
+        return Settings{}, fmt.Errorf("invalid removal_hold_down or removal_hold_down_fetches: %d, %d", settings.RemovalHoldDown, settings.RemovalHoldDownFetches)
+    }
+
+    if settings.MaxRemovals < 0 || settings.MaxRemovalPercent < 0 || settings.MaxRemovalPercent > 100 {
+        return Settings{}, fmt.Errorf("invalid max_removals or max_removal_percent: %d, %d", settings.MaxRemovals, settings.MaxRemovalPercent)
+    }
+
+    if _, err := parseTrustedKeys(settings.TrustedKeys); err != nil {
+        return Settings{}, err
+    }
+    if settings.SignatureSource != "" && len(settings.TrustedKeys) == 0 {
+        return Settings{}, fmt.Errorf("signature_source requires trusted_keys")
+    }
+
+    switch settings.InterfaceBackend {
+    case "", "auto", "native", "ifconfig":
+    default:
+        return Settings{}, fmt.Errorf("invalid interface_backend: %s", settings.InterfaceBackend)
+    }
+
     return settings, nil
 }
 
 // getInterfaceAddr は指定されたインターフェイスのアドレスを取得
 func getInterfaceAddr(iface string, isIPv6 bool) (string, error) {
-    output, err := exec.Command("ifconfig", iface).Output()
-    if err != nil {
-        return "", fmt.Errorf("failed to get interface address: %v", err)
-    }
+    return backend.InterfaceAddr(iface, isIPv6)
+}
 
-    lines := strings.Split(string(output), "\n")
-    for _, line := range lines {
-        if strings.Contains(line, "inet") {
-            if isIPv6 && strings.Contains(line, "inet6") {
-                fields := strings.Fields(line)
-                for _, field := range fields {
-                    if net.ParseIP(field) != nil && strings.Contains(field, ":") {
-                        return field, nil
-                    }
-                }
-            } else if !isIPv6 && strings.Contains(line, "inet") && !strings.Contains(line, "inet6") {
-                fields := strings.Fields(line)
-                for _, field := range fields {
-                    if net.ParseIP(field) != nil && !strings.Contains(field, ":") {
-                        return field, nil
-                    }
-                }
-            }
-        }
+// fetchConfig はconfig_sources（URLまたはローカルファイル）からトンネル設定を取得し、署名、シリアル番号、重複と欠落をチェック
+// 取得に使ったソースも返す
+func fetchConfig(settings *Settings, currentGifs map[string]InterfaceConfig) (string, int64, []TunnelConfig, error) {
+    fetch := fetchFromSources(settings, false)
+    if fetch.err != nil {
+        return "", 0, nil, fetch.err
     }
-    return "", fmt.Errorf("no suitable address found for interface %s (IPv6: %v)", iface, isIPv6)
+    serial, configs, err := acceptConfig(settings, fetch, currentGifs)
+    return fetch.source, serial, configs, err
 }
 
-// fetchConfig は指定されたソース（URLまたはローカルファイル）からトンネル設定を取得し、重複と欠落をチェック
-func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings Settings) ([]TunnelConfig, error) {
-    var body []byte
-    var err error
+// readConfigSource はURLまたはローカルファイルから設定の内容を読み込み、その形式とともに返す
+func readConfigSource(source string) ([]byte, string, error) {
+    body, _, format, err := readConfigSourceIfModified(source, sourceValidators{})
+    return body, format, err
+}
 
+// readConfigSourceIfModified はURLの場合、validatorsのETagとLast-Modifiedで条件付きリクエストを送り、応答のものを返す
+// 304が返った場合はerrNotModifiedを返す。ローカルファイルは常に読み込む
+// 形式はURLではContent-Typeか拡張子、ローカルファイルでは拡張子で判定する
+func readConfigSourceIfModified(source string, validators sourceValidators) ([]byte, sourceValidators, string, error) {
     if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
-        resp, err := http.Get(source)
-        if err != nil {
-            return nil, fmt.Errorf("failed to fetch config from URL: %v", err)
-        }
-        defer resp.Body.Close()
+        body, validators, contentType, err := fetcher.get(source, validators)
+        return body, validators, configFormat(source, contentType), err
+    }
 
-        body, err = ioutil.ReadAll(resp.Body)
-        if err != nil {
-            return nil, fmt.Errorf("failed to read response body: %v", err)
-        }
-    } else {
-        body, err = ioutil.ReadFile(source)
-        if err != nil {
-            return nil, fmt.Errorf("failed to read config file: %v", err)
+    body, err := ioutil.ReadFile(source)
+    if err != nil {
+        return nil, validators, "", fmt.Errorf("failed to read config file: %v", err)
+    }
+    return body, sourceValidators{}, configFormat(source, ""), nil
+}
+
+// parseConfig は設定の内容を解釈し、重複と欠落をチェックする
+// strict_configが有効な場合は問題のある設定を飛ばさず、すべての問題をまとめたエラーを返す
+func parseConfig(doc *configDocument, currentGifs map[string]InterfaceConfig, settings Settings) ([]TunnelConfig, error) {
+    // strict_configでは問題が1つでもあれば設定全体を拒否し、そうでなければ問題のあるエントリーだけを飛ばす
+    problems := validateConfigData(doc, &settings)
+    if settings.StrictConfig && len(problems) > 0 {
+        return nil, rejectedConfigError(problems)
+    }
+    invalid := make(map[int]bool)
+    for _, p := range problems {
+        if p.Index < 0 {
+            slog.Warn("Config problem", "problem", p.String())
+            continue
         }
+        invalid[p.Index] = true
+        slog.Error("Skipping tunnel due to invalid config", "index", p.Index, "tunnel_id", p.TunnelID, "problem", p.String())
     }
 
-    var configs []TunnelConfig
-    if err := json.Unmarshal(body, &configs); err != nil {
-        return nil, fmt.Errorf("failed to unmarshal JSON: %v", err)
+    envelope, err := decodeConfig(doc)
+    if err != nil {
+        return nil, err
     }
+    configs := envelope.Tunnels
+
+    // hostsとlabelsでこのホストに適用しない設定は、以降の確認をせずに除く
+    selected := selectTunnels(configs, &settings)
+    selections.set(selected)
 
+    // 名前解決などで飛ばすことになった設定。strict_configでは最後にまとめて拒否する
+    var rejected []ConfigProblem
     var validConfigs []TunnelConfig
     tunnelIDs := make(map[string]bool)
     dstAddrs := make(map[string]bool)
     vlanIDs := make(map[string]bool)
 
     for i, config := range configs {
+        skip := func(field, problem, msg string, args ...any) {
+            if settings.StrictConfig {
+                rejected = append(rejected, ConfigProblem{Index: i, TunnelID: config.TunnelID, Field: field, Message: problem})
+                return
+            }
+            slog.Error(msg, args...)
+        }
+
+        if !selected[i].Selected {
+            slog.Debug("Tunnel not selected for this host", "index", i, "tunnel_id", config.TunnelID, "reason", selected[i].Reason)
+            continue
+        }
+        if invalid[i] {
+            continue
+        }
         if config.TunnelID == "" {
-            slog.Error("Skipping tunnel due to missing field", "index", i, "reason", "missing tunnel_id")
+            skip("tunnel_id", "missing", "Skipping tunnel due to missing field", "index", i, "reason", "missing tunnel_id")
             continue
         }
         if config.VlanID == "" {
-            slog.Error("Skipping tunnel due to missing field", "index", i, "reason", "missing vlan_id")
+            skip("vlan_id", "missing", "Skipping tunnel due to missing field", "index", i, "reason", "missing vlan_id")
             continue
         }
 
@@ -382,7 +509,8 @@ func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings
                 isIPv6 = strings.Contains(config.SrcAddr, ":")
             }
         default:
-            slog.Error("Skipping tunnel due to invalid ip_version", "index", i, "tunnel_id", config.TunnelID, "ip_version", config.IPVersion)
+            skip("ip_version", fmt.Sprintf("%q is not 4 or 6", config.IPVersion),
+                "Skipping tunnel due to invalid ip_version", "index", i, "tunnel_id", config.TunnelID, "ip_version", config.IPVersion)
             continue
         }
 
@@ -391,7 +519,8 @@ func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings
             if settings.DefaultSrcIface != "" {
                 addr, err := getInterfaceAddr(settings.DefaultSrcIface, isIPv6)
                 if err != nil {
-                    slog.Error("Failed to get interface address", "interface", settings.DefaultSrcIface, "isIPv6", isIPv6, "error", err)
+                    skip("src_addr", fmt.Sprintf("failed to get address of default_src_iface %s: %v", settings.DefaultSrcIface, err),
+                        "Failed to get interface address", "interface", settings.DefaultSrcIface, "isIPv6", isIPv6, "error", err)
                     continue
                 }
                 config.SrcAddr = addr
@@ -400,7 +529,8 @@ func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings
                 config.SrcAddr = settings.DefaultSrcAddr
                 slog.Info("Using default src_addr", "tunnel_id", config.TunnelID, "src_addr", config.SrcAddr)
             } else {
-                slog.Error("Skipping tunnel due to missing src_addr and no default specified", "index", i, "tunnel_id", config.TunnelID)
+                skip("src_addr", "missing and neither default_src_addr nor default_src_iface is set",
+                    "Skipping tunnel due to missing src_addr and no default specified", "index", i, "tunnel_id", config.TunnelID)
                 continue
             }
         }
@@ -413,7 +543,8 @@ func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings
                     config.DstAddr = current.Dst
                     slog.Warn("Failed to resolve dst_hostname, using existing dst_addr", "tunnel_id", config.TunnelID, "dst_hostname", config.DstHostname, "dst_addr", config.DstAddr, "error", err)
                 } else {
-                    slog.Error("Skipping tunnel due to unresolvable dst_hostname", "index", i, "tunnel_id", config.TunnelID, "dst_hostname", config.DstHostname, "error", err)
+                    skip("dst_hostname", fmt.Sprintf("failed to resolve %s: %v", config.DstHostname, err),
+                        "Skipping tunnel due to unresolvable dst_hostname", "index", i, "tunnel_id", config.TunnelID, "dst_hostname", config.DstHostname, "error", err)
                     continue
                 }
             } else {
@@ -442,7 +573,8 @@ func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings
                             resolvedAddr = current.Dst
                             slog.Warn("No suitable IP found for dst_hostname, using existing dst_addr", "tunnel_id", config.TunnelID, "dst_hostname", config.DstHostname, "dst_addr", resolvedAddr, "isIPv6", isIPv6)
                         } else {
-                            slog.Error("Skipping tunnel due to no suitable IP for dst_hostname", "index", i, "tunnel_id", config.TunnelID, "dst_hostname", config.DstHostname, "isIPv6", isIPv6)
+                            skip("dst_hostname", fmt.Sprintf("%s has no address of the tunnel's IP version", config.DstHostname),
+                                "Skipping tunnel due to no suitable IP for dst_hostname", "index", i, "tunnel_id", config.TunnelID, "dst_hostname", config.DstHostname, "isIPv6", isIPv6)
                             continue
                         }
                     } else {
@@ -452,20 +584,21 @@ func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings
                 config.DstAddr = resolvedAddr
             }
         } else if config.DstAddr == "" && config.DstHostname == "" {
-            slog.Error("Skipping tunnel due to missing field", "index", i, "reason", "missing both dst_addr and dst_hostname")
+            skip("dst_addr", "missing both dst_addr and dst_hostname",
+                "Skipping tunnel due to missing field", "index", i, "reason", "missing both dst_addr and dst_hostname")
             continue
         }
 
         if tunnelIDs[config.TunnelID] {
-            slog.Error("Skipping tunnel due to duplicate", "index", i, "tunnel_id", config.TunnelID)
+            skip("tunnel_id", "duplicate "+config.TunnelID, "Skipping tunnel due to duplicate", "index", i, "tunnel_id", config.TunnelID)
             continue
         }
         if dstAddrs[config.DstAddr] {
-            slog.Error("Skipping tunnel due to duplicate", "index", i, "dst_addr", config.DstAddr)
+            skip("dst_addr", "duplicate "+config.DstAddr, "Skipping tunnel due to duplicate", "index", i, "dst_addr", config.DstAddr)
             continue
         }
         if vlanIDs[config.VlanID] {
-            slog.Error("Skipping tunnel due to duplicate", "index", i, "vlan_id", config.VlanID)
+            skip("vlan_id", "duplicate "+config.VlanID, "Skipping tunnel due to duplicate", "index", i, "vlan_id", config.VlanID)
             continue
         }
 
@@ -475,6 +608,9 @@ func fetchConfig(source string, currentGifs map[string]InterfaceConfig, settings
         vlanIDs[config.VlanID] = true
     }
 
+    if len(rejected) > 0 {
+        return nil, rejectedConfigError(rejected)
+    }
     return validConfigs, nil
 }
 
@@ -495,209 +631,6 @@ func membersEqual(m1, m2 []string) bool {
     return true
 }
 
-// applyConfig は差分に基づいて設定を適用
-func applyConfig(gifsToAdd, gifsToModify, gifsToRemove map[string]InterfaceConfig, bridgesToAdd, bridgesToRemove map[string]BridgeConfig, configs []TunnelConfig, settings Settings,
-    currentGifs map[string]InterfaceConfig, currentVLANs map[string]string, currentBridges map[string]BridgeConfig, forceReset bool) {
-    vlanToRemove := make(map[string]bool)
-    for vlan := range currentVLANs {
-        vlanToRemove[vlan] = true
-    }
-
-    for gif := range gifsToRemove {
-        if err := runCommand("ifconfig", gif, "destroy"); err != nil {
-            slog.Error("Failed to remove gif interface", "gif", gif, "error", err)
-        }
-    }
-
-    for bridge := range bridgesToRemove {
-        if err := runCommand("ifconfig", bridge, "destroy"); err != nil {
-            slog.Error("Failed to remove bridge interface", "bridge", bridge, "error", err)
-        }
-    }
-
-    for _, config := range configs {
-        gif := fmt.Sprintf("gif%s", config.TunnelID)
-        bridge := fmt.Sprintf("bridge%s", config.TunnelID)
-        vlanIface := fmt.Sprintf("%s.%s", settings.PhysicalIface, config.VlanID)
-
-        delete(vlanToRemove, vlanIface)
-
-        if current, exists := currentGifs[gif]; exists && !forceReset {
-            if current.Src == config.SrcAddr && current.Dst == config.DstAddr && current.IsIPv6 == strings.Contains(config.SrcAddr, ":") && current.Description == config.Description {
-                slog.Debug("gif already exists with correct config, skipping", "gif", gif)
-            } else {
-                tunnelArgs := []string{gif}
-                if strings.Contains(config.SrcAddr, ":") {
-                    tunnelArgs = append(tunnelArgs, "inet6")
-                }
-                tunnelArgs = append(tunnelArgs, "tunnel", config.SrcAddr, config.DstAddr)
-                if err := runCommand("ifconfig", tunnelArgs...); err != nil {
-                    slog.Error("Failed to configure tunnel", "gif", gif, "error", err)
-                    continue
-                }
-                if err := runCommand("ifconfig", gif, "link0"); err != nil {
-                    slog.Error("Failed to set link0 on gif", "gif", gif, "error", err)
-                }
-                if err := runCommand("ifconfig", gif, "up"); err != nil {
-                    slog.Error("Failed to bring up gif", "gif", gif, "error", err)
-                }
-                if config.Description != "" {
-                    if err := runCommand("ifconfig", gif, "description", config.Description); err != nil {
-                        slog.Error("Failed to update description on gif", "gif", gif, "error", err)
-                    } else {
-                        slog.Info("Updated gif description", "gif", gif, "description", config.Description)
-                    }
-                }
-            }
-        } else {
-            if err := runCommand("ifconfig", gif, "create"); err != nil {
-                slog.Error("Failed to create gif", "gif", gif, "error", err)
-                continue
-            }
-            tunnelArgs := []string{gif}
-            if strings.Contains(config.SrcAddr, ":") {
-                tunnelArgs = append(tunnelArgs, "inet6")
-            }
-            tunnelArgs = append(tunnelArgs, "tunnel", config.SrcAddr, config.DstAddr)
-            if err := runCommand("ifconfig", tunnelArgs...); err != nil {
-                slog.Error("Failed to configure tunnel", "gif", gif, "error", err)
-                continue
-            }
-            if err := runCommand("ifconfig", gif, "mtu", "1500"); err != nil {
-                slog.Error("Failed to set MTU on gif", "gif", gif, "error", err)
-            }
-            if err := runCommand("ifconfig", gif, "link0"); err != nil {
-                slog.Error("Failed to set link0 on gif", "gif", gif, "error", err)
-            }
-            if err := runCommand("ifconfig", gif, "up"); err != nil {
-                slog.Error("Failed to bring up gif", "gif", gif, "error", err)
-            }
-            if config.Description != "" {
-                if err := runCommand("ifconfig", gif, "description", config.Description); err != nil {
-                    slog.Error("Failed to set description on gif", "gif", gif, "error", err)
-                } else {
-                    slog.Info("Set gif description", "gif", gif, "description", config.Description)
-                }
-            }
-        }
-
-        if vlanID, exists := currentVLANs[vlanIface]; exists && vlanID == config.VlanID && !forceReset {
-            slog.Debug("VLAN already exists with correct config, skipping", "vlan", vlanIface)
-        } else {
-            if _, exists := currentVLANs[vlanIface]; exists {
-                if err := runCommand("ifconfig", vlanIface, "destroy"); err != nil {
-                    slog.Error("Failed to remove VLAN for reconfiguration", "vlan", vlanIface, "error", err)
-                    continue
-                }
-            }
-            if err := runCommand("ifconfig", vlanIface, "create"); err != nil {
-                slog.Error("Failed to create VLAN", "vlan", vlanIface, "error", err)
-                continue
-            }
-            if err := runCommand("ifconfig", vlanIface, "vlan", config.VlanID, "vlandev", settings.PhysicalIface, "up"); err != nil {
-                slog.Error("Failed to configure VLAN", "vlan", vlanIface, "error", err)
-            }
-        }
-
-        expectedMembers := []string{gif, vlanIface}
-        if current, exists := currentBridges[bridge]; exists && !forceReset {
-            if membersEqual(current.Members, expectedMembers) {
-                slog.Debug("bridge already exists with correct config, skipping", "bridge", bridge)
-            } else {
-                if err := runCommand("ifconfig", bridge, "destroy"); err != nil {
-                    slog.Error("Failed to remove bridge for reconfiguration", "bridge", bridge, "error", err)
-                    continue
-                }
-                if err := runCommand("ifconfig", bridge, "create"); err != nil {
-                    slog.Error("Failed to create bridge", "bridge", bridge, "error", err)
-                    continue
-                }
-                for _, member := range expectedMembers {
-                    if err := runCommand("ifconfig", bridge, "addm", member); err != nil {
-                        slog.Error("Failed to add member to bridge", "member", member, "bridge", bridge, "error", err)
-                    }
-                }
-                if err := runCommand("ifconfig", bridge, "up"); err != nil {
-                    slog.Error("Failed to bring up bridge", "bridge", bridge, "error", err)
-                }
-            }
-        } else {
-            if err := runCommand("ifconfig", bridge, "create"); err != nil {
-                slog.Error("Failed to create bridge", "bridge", bridge, "error", err)
-                continue
-            }
-            for _, member := range expectedMembers {
-                if err := runCommand("ifconfig", bridge, "addm", member); err != nil {
-                    slog.Error("Failed to add member to bridge", "member", member, "bridge", bridge, "error", err)
-                }
-            }
-            if err := runCommand("ifconfig", bridge, "mtu", "1500"); err != nil {
-                slog.Error("Failed to set MTU on bridge", "bridge", bridge, "error", err)
-            }
-            if err := runCommand("ifconfig", bridge, "up"); err != nil {
-                slog.Error("Failed to bring up bridge", "bridge", bridge, "error", err)
-            }
-        }
-    }
-
-    for vlan := range vlanToRemove {
-        if err := runCommand("ifconfig", vlan, "destroy"); err != nil {
-            slog.Error("Failed to remove unused VLAN", "vlan", vlan, "error", err)
-        }
-    }
-}
-
-// calculateDiff は現在の状態とJSONデータの差分を計算
-func calculateDiff(currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, configs []TunnelConfig, physicalIface string) (
-    gifsToAdd, gifsToModify, gifsToRemove map[string]InterfaceConfig, bridgesToAdd, bridgesToRemove map[string]BridgeConfig) {
-    jsonGifs := make(map[string]InterfaceConfig)
-    jsonBridges := make(map[string]BridgeConfig)
-
-    for _, config := range configs {
-        gif := fmt.Sprintf("gif%s", config.TunnelID)
-        bridge := fmt.Sprintf("bridge%s", config.TunnelID)
-        isIPv6 := strings.Contains(config.SrcAddr, ":") || strings.Contains(config.DstAddr, ":")
-        jsonGifs[gif] = InterfaceConfig{Src: config.SrcAddr, Dst: config.DstAddr, Vlan: config.VlanID, IsIPv6: isIPv6, TunnelID: config.TunnelID, Description: config.Description}
-        jsonBridges[bridge] = BridgeConfig{
-            Members:  []string{gif, fmt.Sprintf("%s.%s", physicalIface, config.VlanID)},
-            TunnelID: config.TunnelID,
-        }
-    }
-
-    gifsToAdd = make(map[string]InterfaceConfig)
-    gifsToModify = make(map[string]InterfaceConfig)
-    gifsToRemove = make(map[string]InterfaceConfig)
-    bridgesToAdd = make(map[string]BridgeConfig)
-    bridgesToRemove = make(map[string]BridgeConfig)
-
-    for k, v := range jsonGifs {
-        if current, exists := currentGifs[k]; exists {
-            if current.Src != v.Src || current.Dst != v.Dst || current.IsIPv6 != v.IsIPv6 || current.Description != v.Description {
-                gifsToModify[k] = v
-            }
-        } else {
-            gifsToAdd[k] = v
-        }
-    }
-    for k, v := range currentGifs {
-        if _, exists := jsonGifs[k]; !exists {
-            gifsToRemove[k] = v
-        }
-    }
-    for k, v := range jsonBridges {
-        if _, exists := currentBridges[k]; !exists || !membersEqual(currentBridges[k].Members, v.Members) {
-            bridgesToAdd[k] = v
-        }
-    }
-    for k, v := range currentBridges {
-        if _, exists := jsonBridges[k]; !exists {
-            bridgesToRemove[k] = v
-        }
-    }
-
-    return
-}
-
 // waitForInterfacesRemoval は指定されたインターフェイス群がすべて削除されるのを待機
 func waitForInterfacesRemoval(interfaces []string) error {
     slog.Debug("Starting interface removal check", "interfaces", interfaces)
@@ -707,16 +640,19 @@ func waitForInterfacesRemoval(interfaces []string) error {
     start := time.Now()
 
     for time.Since(start) < timeout {
-        output, err := exec.Command("ifconfig", "-a").Output()
+        names, err := backend.InterfaceNames()
         if err != nil {
             slog.Warn("Failed to check interfaces removal", "error", err)
             time.Sleep(interval)
             continue
         }
-        outputStr := string(output)
-        remaining := []string{}
+        existing := make(map[string]bool)
+        for _, name := range names {
+            existing[name] = true
+        }
+        remaining = []string{}
         for _, iface := range interfaces {
-            if strings.Contains(outputStr, iface) {
+            if existing[iface] {
                 remaining = append(remaining, iface)
             }
         }
@@ -731,12 +667,16 @@ func waitForInterfacesRemoval(interfaces []string) error {
     return fmt.Errorf("some interfaces still exist after %v: %v", timeout, remaining)
 }
 
-// resetVLANs は物理インターフェイスのVLANをすべて削除
+// resetVLANs は物理インターフェイスのVLANのうちeipconfが作成したものをすべて削除
 func resetVLANs(physicalIface string, currentVLANs map[string]string) error {
     var vlansToRemove []string
     for vlan := range currentVLANs {
-        if strings.HasPrefix(vlan, physicalIface+".") {
-            if err := runCommand("ifconfig", vlan, "destroy"); err != nil {
+        if isPhysicalVLAN(vlan, physicalIface) {
+            if !ownership.Owns(vlan) {
+                slog.Warn("Skipping VLAN not created by eipconf during reset", "vlan", vlan)
+                continue
+            }
+            if err := applyOp(vlan, "destroy"); err != nil {
                 slog.Error("Failed to remove VLAN during reset", "vlan", vlan, "error", err)
                 return err
             }
@@ -755,12 +695,60 @@ func resetVLANs(physicalIface string, currentVLANs map[string]string) error {
     return nil
 }
 
-// resetAllInterfaces はトンネル、VLAN、ブリッジをすべて削除
+// resetTunnel は1つのトンネルのgif、bridge、bridgeにつながった物理インターフェイスのVLANのうち、eipconfが作成したものを削除
+func resetTunnel(physicalIface, tunnelID string, currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, currentVLANs map[string]string) error {
+    gif := fmt.Sprintf("gif%s", tunnelID)
+    bridge := fmt.Sprintf("bridge%s", tunnelID)
+    var candidates []string
+    if _, exists := currentBridges[bridge]; exists {
+        candidates = append(candidates, bridge)
+        for _, member := range currentBridges[bridge].Members {
+            if _, isVLAN := currentVLANs[member]; isVLAN && isPhysicalVLAN(member, physicalIface) {
+                candidates = append(candidates, member)
+            }
+        }
+    }
+    if _, exists := currentGifs[gif]; exists {
+        candidates = append(candidates, gif)
+    }
+    if len(candidates) == 0 {
+        return fmt.Errorf("tunnel %s has no interfaces", tunnelID)
+    }
+
+    var interfacesToRemove []string
+    for _, iface := range candidates {
+        if !ownership.Owns(iface) {
+            slog.Warn("Skipping interface not created by eipconf during reset", "iface", iface, "tunnel_id", tunnelID)
+            continue
+        }
+        if err := applyOp(iface, "destroy"); err != nil {
+            slog.Error("Failed to remove interface during reset", "iface", iface, "tunnel_id", tunnelID, "error", err)
+            return err
+        }
+        interfacesToRemove = append(interfacesToRemove, iface)
+    }
+
+    if len(interfacesToRemove) > 0 {
+        if err := waitForInterfacesRemoval(interfacesToRemove); err != nil {
+            slog.Error("Failed to confirm tunnel interfaces removal", "interfaces", interfacesToRemove, "error", err)
+            return err
+        }
+    }
+
+    slog.Info("Successfully reset tunnel", "tunnel_id", tunnelID, "interfaces", interfacesToRemove)
+    return nil
+}
+
+// resetAllInterfaces はeipconfが作成したトンネル、VLAN、ブリッジをすべて削除
 func resetAllInterfaces(currentGifs map[string]InterfaceConfig, currentVLANs map[string]string, currentBridges map[string]BridgeConfig) error {
     var interfacesToRemove []string
 
     for gif := range currentGifs {
-        if err := runCommand("ifconfig", gif, "destroy"); err != nil {
+        if !ownership.Owns(gif) {
+            slog.Warn("Skipping GIF tunnel not created by eipconf during reset", "gif", gif)
+            continue
+        }
+        if err := applyOp(gif, "destroy"); err != nil {
             slog.Error("Failed to remove GIF tunnel during reset", "gif", gif, "error", err)
             return err
         }
@@ -768,7 +756,11 @@ func resetAllInterfaces(currentGifs map[string]InterfaceConfig, currentVLANs map
     }
 
     for vlan := range currentVLANs {
-        if err := runCommand("ifconfig", vlan, "destroy"); err != nil {
+        if !ownership.Owns(vlan) {
+            slog.Debug("Skipping VLAN not created by eipconf during reset", "vlan", vlan)
+            continue
+        }
+        if err := applyOp(vlan, "destroy"); err != nil {
             slog.Error("Failed to remove VLAN during reset", "vlan", vlan, "error", err)
             return err
         }
@@ -776,7 +768,11 @@ func resetAllInterfaces(currentGifs map[string]InterfaceConfig, currentVLANs map
     }
 
     for bridge := range currentBridges {
-        if err := runCommand("ifconfig", bridge, "destroy"); err != nil {
+        if !ownership.Owns(bridge) {
+            slog.Warn("Skipping bridge not created by eipconf during reset", "bridge", bridge)
+            continue
+        }
+        if err := applyOp(bridge, "destroy"); err != nil {
             slog.Error("Failed to remove bridge during reset", "bridge", bridge, "error", err)
             return err
         }
@@ -802,12 +798,50 @@ func main() {
     var settingsFile string
     flag.StringVar(&settingsFile, "config", defaultSettingsFile, "Path to settings.json file")
     flag.StringVar(&settingsFile, "c", defaultSettingsFile, "Short form of --config")
+    var dryRun bool
+    var planFormat string
+    flag.BoolVar(&dryRun, "dry-run", false, "Print the operations that would be applied and exit without changing interfaces")
+    flag.StringVar(&planFormat, "format", "text", "Output format of plan/--dry-run, status and merged (text or json)")
+    var statusCached bool
+    flag.BoolVar(&statusCached, "cached", false, "Use the cached config in status instead of fetching config_source")
     flag.Parse()
 
+    // "eipconf plan" は --dry-run と同じ。サブコマンドの後ろのフラグも解釈する
+    command := flag.Arg(0)
+    switch command {
+    case "plan":
+        dryRun = true
+        flag.CommandLine.Parse(flag.Args()[1:])
+    case "approve", "accept-serial", "ctl", "status", "merged", "validate":
+        flag.CommandLine.Parse(flag.Args()[1:])
+    }
+    if (dryRun || command == "status" || command == "merged" || command == "validate") && planFormat != "text" && planFormat != "json" {
+        fmt.Fprintf(os.Stderr, "Invalid format: %s\n", planFormat)
+        os.Exit(1)
+    }
+
     if envSettingsFile := os.Getenv("EIPCONF_CONF"); envSettingsFile != "" && settingsFile == defaultSettingsFile {
         settingsFile = envSettingsFile
     }
 
+    // "eipconf schema config|settings" はJSON Schemaを出力する
+    if command == "schema" {
+        if err := writeSchema(os.Stdout, flag.Arg(1)); err != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    // "eipconf validate [FILE...]" は設定を検証するだけで、rootもインターフェイスも必要としない
+    if command == "validate" {
+        if err := runValidate(os.Stdout, settingsFile, settingsFile != defaultSettingsFile, flag.Args(), planFormat); err != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
     sigChan := make(chan os.Signal, 1)
     signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 
@@ -817,6 +851,41 @@ func main() {
         os.Exit(1)
     }
 
+    // "eipconf approve [ID]" はセーフガードで止めた変更を承認する
+    if command == "approve" {
+        if err := approveHeldPlan(os.Stdout, &settings, flag.Arg(0)); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to approve held change: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    // "eipconf accept-serial SERIAL" は適用済みより古いシリアル番号の設定を受け入れる
+    if command == "accept-serial" {
+        if err := acceptSerial(os.Stdout, &settings, flag.Arg(0)); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to accept serial: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    // "eipconf ctl <command>" は実行中のeipconfに制御ソケットで指示する
+    if command == "ctl" {
+        if err := runControlCommand(os.Stdout, &settings, flag.Args()); err != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    // planモードとstatusでは標準出力を結果の出力に使い、Slackにも送らない
+    readOnly := dryRun || command == "status" || command == "merged"
+    var console io.Writer = os.Stdout
+    if readOnly {
+        console = os.Stderr
+        settings.SlackWebhookURL = ""
+    }
+
     var logLevel slog.Level
     switch strings.ToUpper(settings.LogLevel) {
     case "DEBUG":
@@ -832,7 +901,7 @@ func main() {
         logLevel = slog.LevelInfo
     }
 
-    consoleHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+    consoleHandler := slog.NewTextHandler(console, &slog.HandlerOptions{
         AddSource: false,
         Level:     logLevel,
     })
@@ -858,6 +927,78 @@ func main() {
 
     slog.Info("Program start.")
 
+    backend, err = newBackend(settings.InterfaceBackend)
+    if err != nil {
+        slog.Error("Failed to initialize interface backend", "interface_backend", settings.InterfaceBackend, "error", err)
+        os.Exit(1)
+    }
+    slog.Info("Using interface backend", "backend", backend.Name())
+
+    fetcher, err = newConfigFetcher(&settings)
+    if err != nil {
+        slog.Error("Failed to initialize config fetch client", "error", err)
+        os.Exit(1)
+    }
+
+    // status、plan、mergedは所有情報を読むだけで書き戻さない
+    ownership, err = loadOwnership(filepath.Join(settings.StateDir, "owned.json"), readOnly)
+    if err != nil {
+        slog.Error("Failed to load ownership registry", "state_dir", settings.StateDir, "error", err)
+        os.Exit(1)
+    }
+
+    // 状態を読み込んでから受け付ける。先に始めると制御APIからの適用やリセットが空の所有情報で動く
+    if settings.HTTPListen != "" && !readOnly {
+        startHTTPServer(&settings)
+    }
+    if settings.ControlSocket != "none" && !readOnly {
+        startControlServer(&settings)
+    }
+
+    // "eipconf status" はトンネルごとに設定と現在の状態を出力する
+    if command == "status" {
+        report, err := buildStatus(&settings, statusCached)
+        if err != nil {
+            slog.Error("Failed to build status", "sources", settings.ConfigSources, "error", err)
+            os.Exit(1)
+        }
+        if err := writeStatus(os.Stdout, report, planFormat); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to write status: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    // "eipconf merged" はconfig_dirとconfig_overrideを結合した設定と、各トンネルの定義元を出力する。競合があれば1で終了する
+    if command == "merged" {
+        report, err := buildMerged(&settings)
+        if err != nil {
+            slog.Error("Failed to merge config", "sources", settings.ConfigSources, "error", err)
+            os.Exit(1)
+        }
+        if err := writeMerged(os.Stdout, report, planFormat); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to write merged config: %v\n", err)
+            os.Exit(1)
+        }
+        if len(report.Conflicts) > 0 {
+            os.Exit(1)
+        }
+        return
+    }
+
+    if dryRun {
+        report, err := buildPlan(&settings)
+        if err != nil {
+            slog.Error("Failed to build plan", "sources", settings.ConfigSources, "error", err)
+            os.Exit(1)
+        }
+        if err := writePlan(os.Stdout, report, planFormat); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to write plan: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
     defer func() {
         if r := recover(); r != nil {
             slog.Error("Program terminated due to panic", "reason", fmt.Sprintf("%v", r))
@@ -878,20 +1019,22 @@ func main() {
             case <-done:
                 return
             default:
-                currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
-                configs, err := fetchConfig(settings.ConfigSource, currentGifs, settings)
-                if err != nil {
-                    slog.Error("Failed to fetch config", "source", settings.ConfigSource, "error", err)
+                if control.Paused() {
+                    health.recordPaused()
+                    slog.Debug("Reconcile loop paused, skipping", "sleep", interval)
+                    time.Sleep(interval)
+                    continue
+                }
+                if _, err := control.Reconcile(&settings, "loop"); err != nil {
+                    slog.Error("Failed to fetch config", "sources", settings.ConfigSources, "error", err)
+                    metrics.Set("eipconf_fetch_backoff_seconds", "", float64(fail_interval))
                     time.Sleep(time.Duration(fail_interval) * time.Second)
                     fail_interval += 5
                     continue
                 }
 
                 fail_interval = 5
-
-                gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove := calculateDiff(currentGifs, currentBridges, configs, settings.PhysicalIface)
-                notifyConfigDiff(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, &settings)
-                applyConfig(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, configs, settings, currentGifs, currentVLANs, currentBridges, false)
+                metrics.Set("eipconf_fetch_backoff_seconds", "", 0)
 
                 slog.Info("Configuration check completed", "sleep", interval)
                 time.Sleep(interval)
@@ -902,55 +1045,135 @@ func main() {
     for {
         sig := <-sigChan
         switch sig {
-        case syscall.SIGHUP:
-            slog.Info("Received SIGHUP, forcing immediate config update")
-            currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
-            configs, err := fetchConfig(settings.ConfigSource, currentGifs, settings)
-            if err != nil {
-                slog.Error("Failed to fetch config after SIGHUP", "source", settings.ConfigSource, "error", err)
-            } else {
-                gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove := calculateDiff(currentGifs, currentBridges, configs, settings.PhysicalIface)
-                notifyConfigDiff(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, &settings)
-                applyConfig(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, configs, settings, currentGifs, currentVLANs, currentBridges, false)
-                slog.Info("Immediate config update completed after SIGHUP")
-            }
-        case syscall.SIGUSR1:
-            slog.Info("Received SIGUSR1, resetting VLANs")
-            currentGifs, _, currentVLANs := getCurrentInterfaces()
-            if err := resetVLANs(settings.PhysicalIface, currentVLANs); err == nil {
-                configs, err := fetchConfig(settings.ConfigSource, currentGifs, settings)
-                if err != nil {
-                    slog.Error("Failed to fetch config after SIGUSR1", "source", settings.ConfigSource, "error", err)
-                } else {
-                    currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
-                    gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove := calculateDiff(currentGifs, currentBridges, configs, settings.PhysicalIface)
-                    notifyConfigDiff(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, &settings)
-                    applyConfig(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, configs, settings, currentGifs, currentVLANs, currentBridges, false)
-                    slog.Info("Reconfiguration completed after SIGUSR1")
-                }
-            }
-        case syscall.SIGUSR2:
-            slog.Info("Received SIGUSR2, resetting all interfaces")
-            currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
-            if err := resetAllInterfaces(currentGifs, currentVLANs, currentBridges); err == nil {
-                configs, err := fetchConfig(settings.ConfigSource, currentGifs, settings)
-                if err != nil {
-                    slog.Error("Failed to fetch config after SIGUSR2", "source", settings.ConfigSource, "error", err)
-                } else {
-                    currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
-                    gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove := calculateDiff(currentGifs, currentBridges, configs, settings.PhysicalIface)
-                    notifyConfigDiff(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, &settings)
-                    applyConfig(gifsToAdd, gifsToModify, gifsToRemove, bridgesToAdd, bridgesToRemove, configs, settings, currentGifs, currentVLANs, currentBridges, false)
-                    slog.Info("Reconfiguration completed after SIGUSR2")
-                }
-            }
         case syscall.SIGINT, syscall.SIGTERM:
             close(done)
             exitReason = fmt.Sprintf("terminated by signal: %v", sig)
             exitCode = 0
             slog.Info("Program terminated", "reason", exitReason, "exit_code", exitCode)
             os.Exit(exitCode)
+        default:
+            handleSignal(sig, &settings)
+        }
+    }
+}
+
+// reconcile は設定をフェッチし、現在の状態を取得して差分を適用する
+// 設定が取得できない場合はloadConfigに従ってキャッシュを使う
+// conditionalがtrueの場合は条件付きで取得し、設定が変わっていなければdrift_check_intervalごとにだけ現在の状態と突き合わせる
+func reconcile(settings *Settings, conditional bool) (CycleResult, error) {
+    health.recordCycleStart()
+    fetch := fetchFromSources(settings, conditional)
+    waiting := pendingWork(settings)
+    if fetch.notModified && waiting == "" && time.Since(fetchState.driftCheckedAt) < time.Duration(settings.DriftCheckInterval)*time.Second {
+        if _, _, err := loadConfig(settings, fetch, nil); err != nil {
+            return CycleResult{}, err
+        }
+        return CycleResult{At: time.Now(), Serial: fetchState.serial, Skipped: true}, nil
+    }
+    currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
+    configs, fetched, err := loadConfig(settings, fetch, currentGifs)
+    if err != nil {
+        return CycleResult{}, err
+    }
+    // 304はホールドダウン中の削除などを進めるサイクルでだけ、設定を確かめた回数に数える。ドリフトの確認では数えない
+    fetched = fetched && (!fetch.notModified || waiting != "")
+    if fetch.notModified && waiting != "" {
+        slog.Debug("Config not modified, checking interfaces for pending work", "source", fetch.source, "pending", waiting)
+    } else if fetch.notModified {
+        slog.Debug("Config not modified, checking interfaces for drift", "source", fetch.source)
+    }
+    result := applyDiff(configs, fetched, settings, currentGifs, currentBridges, currentVLANs)
+    // セーフガードで止めたサイクルは突き合わせたことにしない。承認されればpendingWorkで次のサイクルに適用する
+    if result.HeldReason == "" {
+        fetchState.driftCheckedAt = time.Now()
+    } else {
+        fetchState.driftCheckedAt = time.Time{}
+    }
+    return result, nil
+}
+
+// pendingWork は設定が変わっていなくても現在の状態と突き合わせる理由を返す。なければ空文字列
+// ホールドダウン中の削除と、保留中または承認済みの計画は次のサイクルで進めるため、304でも飛ばさない
+func pendingWork(settings *Settings) string {
+    if pendingRemovals.pending() {
+        return "removal hold-down"
+    }
+    if _, err := os.Stat(approvalPath(settings)); err == nil {
+        return "approved change"
+    }
+    if _, err := os.Stat(heldPlanPath(settings)); err == nil {
+        return "held change"
+    }
+    return ""
+}
+
+// applyDiff は変更計画を作成して通知し、計画に従って適用する
+// fetchedはconfigsをこのサイクルで取得したか。falseのサイクルはremoval_hold_down_fetchesの回数に数えない
+func applyDiff(configs []TunnelConfig, fetched bool, settings *Settings, currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, currentVLANs map[string]string) CycleResult {
+    adoptIfNeeded(configs, currentGifs, currentBridges, currentVLANs, settings)
+    serial, source := fetchState.serial, fetchState.source
+    plan := calculatePlan(currentGifs, currentBridges, currentVLANs, configs, settings.PhysicalIface)
+    reportConflicts(plan.Conflicts)
+    pendingRemovals.holdRemovals(plan, settings, time.Now(), fetched)
+    if reason := guardPlan(plan, configs, currentGifs, settings); reason != "" {
+        degraded := degradedTunnels(configs, plan, nil)
+        recordCycle(configs, plan, degraded)
+        health.recordApply(nil, reason, degraded)
+        return CycleResult{At: time.Now(), Serial: serial, Source: source, Plan: plan, HeldReason: reason}
+    }
+    notifyConfigDiff(plan, serial, settings)
+    result := executePlan(plan)
+    // 何も適用できなかった設定は適用済みとしない。古いシリアル番号に戻す設定を拒否しないようにする
+    if result.PartlyApplied() {
+        recordAppliedSerial(settings, serial)
+    }
+    degraded := degradedTunnels(configs, plan, &result)
+    recordCycle(configs, plan, degraded)
+    health.recordApply(&result, "", degraded)
+    if plan.Empty() {
+        return CycleResult{At: time.Now(), Serial: serial, Source: source, Plan: plan, Result: &result}
+    }
+    summary := []any{"source", source, "serial", serial, "operations", result.Operations, "failed", result.Failed,
+        "tunnels_applied", result.Count("applied"), "tunnels_rolled_back", result.Count("rolled_back"), "tunnels_rollback_failed", result.Count("rollback_failed")}
+    if result.Failed > 0 {
+        slog.Warn("Configuration applied with errors", summary...)
+    } else {
+        slog.Info("Configuration applied", summary...)
+    }
+    return CycleResult{At: time.Now(), Serial: serial, Source: source, Plan: plan, Result: &result}
+}
+
+// reconfigureAfterReset はリセット後に設定を再取得し、改めて現在の状態を読み込んで適用する
+// knownGifsはリセット前のgifで、dst_hostnameが解決できない場合の既存値として使う
+func reconfigureAfterReset(trigger string, knownGifs map[string]InterfaceConfig, settings *Settings) (CycleResult, error) {
+    configs, _, err := loadConfig(settings, fetchFromSources(settings, true), knownGifs)
+    if err != nil {
+        slog.Error("Failed to fetch config after reset", "trigger", trigger, "sources", settings.ConfigSources, "error", err)
+        return CycleResult{}, err
+    }
+    currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
+    // リセットはループのサイクルとは別に取得するので、removal_hold_down_fetchesの回数に数えない
+    result := applyDiff(configs, false, settings, currentGifs, currentBridges, currentVLANs)
+    slog.Info("Reconfiguration completed after reset", "trigger", trigger)
+    return result, nil
+}
+
+// handleSignal はSIGHUP、SIGUSR1、SIGUSR2を受けて制御APIと同じ再設定やリセットを行う
+func handleSignal(sig os.Signal, settings *Settings) {
+    switch sig {
+    case syscall.SIGHUP:
+        slog.Info("Received SIGHUP, forcing immediate config update")
+        if _, err := control.Reconcile(settings, "SIGHUP"); err != nil {
+            slog.Error("Failed to fetch config after SIGHUP", "sources", settings.ConfigSources, "error", err)
+        } else {
+            slog.Info("Immediate config update completed after SIGHUP")
         }
+    case syscall.SIGUSR1:
+        slog.Info("Received SIGUSR1, resetting VLANs")
+        control.ResetVLANs(settings, "SIGUSR1")
+    case syscall.SIGUSR2:
+        slog.Info("Received SIGUSR2, resetting all interfaces")
+        control.ResetAll(settings, "SIGUSR2")
     }
 }
 
@@ -0,0 +1,18 @@
+package main
+
+import (
+    "flag"
+    "io"
+    "log/slog"
+    "os"
+    "testing"
+)
+
+// TestMain はテスト中の通常のログを抑える。-vで実行した場合は出力する
+func TestMain(m *testing.M) {
+    flag.Parse()
+    if !testing.Verbose() {
+        slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+    }
+    os.Exit(m.Run())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// metricDesc はメトリクスの種類と説明
+type metricDesc struct {
+    name string
+    typ  string // "counter", "gauge", "summary"
+    help string
+}
+
+// 公開するメトリクス。出力はこの順番で行う
+var metricDescs = []metricDesc{
+    {"eipconf_config_fetch_total", "counter", "Config fetches by result (success or failure)."},
+    {"eipconf_config_fetch_duration_seconds", "summary", "Time taken to fetch and parse the config."},
+    {"eipconf_config_from_cache", "gauge", "1 while running from the cached config."},
+    {"eipconf_config_source_up", "gauge", "1 if the last fetch from the config source succeeded, 0 if it failed."},
+    {"eipconf_config_source_active", "gauge", "1 for the config source the applied config was fetched from."},
+    {"eipconf_config_serial", "gauge", "Serial of the last applied config envelope (absent for bare-array configs)."},
+    {"eipconf_fetch_backoff_seconds", "gauge", "Current wait before the next fetch after a failure (0 when the last fetch succeeded)."},
+    {"eipconf_interfaces", "gauge", "Current gif, VLAN and bridge interfaces by kind."},
+    {"eipconf_last_cycle_changes", "gauge", "Changes planned in the last cycle by kind and action."},
+    {"eipconf_changes_total", "counter", "Changes applied since start by kind and action."},
+    {"eipconf_command_failures_total", "counter", "Failed interface commands by command and action, including attempts that were retried."},
+    {"eipconf_command_retries_total", "counter", "Retried interface commands by command and action."},
+    {"eipconf_tunnel_up", "gauge", "1 if the last cycle left the tunnel configured as in the config, 0 if it failed, rolled back or skipped it. Not the link state."},
+}
+
+// metricSet はメトリクスの値を "名前 -> ラベル -> 値" で保持する
+type metricSet struct {
+    mu     sync.Mutex
+    values map[string]map[string]float64
+}
+
+var metrics = &metricSet{values: make(map[string]map[string]float64)}
+
+// labels は "key1", "value1", ... から {key1="value1",...} を作る
+func labels(kv ...string) string {
+    if len(kv) == 0 {
+        return ""
+    }
+    pairs := make([]string, 0, len(kv)/2)
+    for i := 0; i+1 < len(kv); i += 2 {
+        v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+        pairs = append(pairs, fmt.Sprintf(`%s="%s"`, kv[i], v))
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricSet) series(name string) map[string]float64 {
+    if m.values[name] == nil {
+        m.values[name] = make(map[string]float64)
+    }
+    return m.values[name]
+}
+
+// Add はカウンタに値を加える
+func (m *metricSet) Add(name, labels string, v float64) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.series(name)[labels] += v
+}
+
+// Set はゲージに値を設定する
+func (m *metricSet) Set(name, labels string, v float64) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.series(name)[labels] = v
+}
+
+// Replace はメトリクスのすべての系列を入れ替える。設定から消えたトンネルの系列を残さないために使う
+func (m *metricSet) Replace(name string, series map[string]float64) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.values[name] = series
+}
+
+// Observe はsummaryに1回分の観測値を加える
+func (m *metricSet) Observe(name, labels string, v float64) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.series(name+"_sum")[labels] += v
+    m.series(name+"_count")[labels]++
+}
+
+// Write はPrometheusのテキスト形式で出力する
+func (m *metricSet) Write(w io.Writer) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for _, d := range metricDescs {
+        names := []string{d.name}
+        if d.typ == "summary" {
+            names = []string{d.name + "_sum", d.name + "_count"}
+        }
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+        for _, name := range names {
+            series := m.values[name]
+            keys := make([]string, 0, len(series))
+            for k := range series {
+                keys = append(keys, k)
+            }
+            sort.Strings(keys)
+            for _, k := range keys {
+                fmt.Fprintf(w, "%s%s %g\n", name, k, series[k])
+            }
+        }
+    }
+}
+
+// recordFetch は設定の取得結果と所要時間を記録する
+func recordFetch(err error, notModified bool, elapsed time.Duration) {
+    result := "success"
+    switch {
+    case err != nil:
+        result = "failure"
+    case notModified:
+        result = "not_modified"
+    }
+    metrics.Add("eipconf_config_fetch_total", labels("result", result), 1)
+    metrics.Observe("eipconf_config_fetch_duration_seconds", "", elapsed.Seconds())
+}
+
+// recordInterfaces は現在のインターフェイスの数を記録する
+func recordInterfaces(currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, currentVLANs map[string]string) {
+    metrics.Set("eipconf_interfaces", labels("kind", "gif"), float64(len(currentGifs)))
+    metrics.Set("eipconf_interfaces", labels("kind", "vlan"), float64(len(currentVLANs)))
+    metrics.Set("eipconf_interfaces", labels("kind", "bridge"), float64(len(currentBridges)))
+}
+
+// recordCommandFailure はコマンドの失敗と再試行を記録する
+func recordCommandFailure(command, action string, retried bool) {
+    metrics.Add("eipconf_command_failures_total", labels("command", command, "action", action), 1)
+    if retried {
+        metrics.Add("eipconf_command_retries_total", labels("command", command, "action", action), 1)
+    }
+}
+
+// recordAppliedChanges は適用できた変更をeipconf_changes_totalに数える
+// 保留した計画や失敗した変更は数えないよう、executePlanが適用した時点で呼ぶ
+func recordAppliedChanges(changes ...Change) {
+    for _, c := range changes {
+        metrics.Add("eipconf_changes_total", labels("kind", c.Kind, "action", c.Action), 1)
+    }
+}
+
+// recordCycle は計画の変更数と、設定にある各トンネルの状態を記録する
+// eipconf_tunnel_upは適用の結果で、トンネルのリンクの状態や疎通は見ない
+func recordCycle(configs []TunnelConfig, plan *ReconcilePlan, degraded []string) {
+    counts := make(map[string]float64)
+    for _, kind := range []string{"gif", "vlan", "bridge"} {
+        for _, action := range []string{"create", "modify", "destroy"} {
+            counts[labels("kind", kind, "action", action)] = 0
+        }
+    }
+    for _, c := range plan.Changes() {
+        counts[labels("kind", c.Kind, "action", c.Action)]++
+    }
+    metrics.Replace("eipconf_last_cycle_changes", counts)
+
+    down := make(map[string]bool)
+    for _, id := range degraded {
+        down[id] = true
+    }
+    tunnels := make(map[string]float64)
+    for _, config := range configs {
+        up := 1.0
+        if down[config.TunnelID] {
+            up = 0
+        }
+        tunnels[labels("tunnel_id", config.TunnelID, "vlan_id", config.VlanID)] = up
+    }
+    metrics.Replace("eipconf_tunnel_up", tunnels)
+}
+
+// startHTTPServer はhttp_listenで/metrics、/healthz、/readyzを公開する
+func startHTTPServer(settings *Settings) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        metrics.Write(w)
+    })
+    mux.HandleFunc("/healthz", healthHandler(settings, "loop"))
+    mux.HandleFunc("/readyz", healthHandler(settings, "loop", "config_age", "apply", "tunnels"))
+    go func() {
+        slog.Info("Serving metrics and health checks", "listen", settings.HTTPListen)
+        if err := http.ListenAndServe(settings.HTTPListen, mux); err != nil {
+            slog.Error("HTTP server stopped", "listen", settings.HTTPListen, "error", err)
+        }
+    }()
+}
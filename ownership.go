@@ -0,0 +1,201 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// OwnershipRegistry はeipconfが作成したインターフェイスを記録する
+// 削除とリセットは記録されているインターフェイスだけを対象にする
+type OwnershipRegistry struct {
+    mu         sync.Mutex
+    path       string
+    firstRun   bool                 // 読み込み時にファイルがなかった。最初の適用で既存のインターフェイスを引き継ぐ
+    Interfaces map[string]time.Time `json:"interfaces"` // インターフェイス名と作成日時
+}
+
+// ownership は所有情報。起動時にstate_dirのファイルから読み込む。pathが空の場合は保存しない
+var ownership = &OwnershipRegistry{Interfaces: make(map[string]time.Time)}
+
+// loadOwnership はpathから所有情報を読み込む。ファイルがなければ空の状態から始める
+// readOnlyがtrueの場合は、記録を変更しても書き戻さない
+func loadOwnership(path string, readOnly bool) (*OwnershipRegistry, error) {
+    r := &OwnershipRegistry{path: path, Interfaces: make(map[string]time.Time)}
+    if readOnly {
+        r.path = ""
+    }
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        r.firstRun = true
+        return r, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read ownership registry: %v", err)
+    }
+    if err := json.Unmarshal(data, r); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal ownership registry %s: %v", path, err)
+    }
+    if r.Interfaces == nil {
+        r.Interfaces = make(map[string]time.Time)
+    }
+    return r, nil
+}
+
+// Owns はインターフェイスがeipconfの管理下にあるかを返す
+func (r *OwnershipRegistry) Owns(name string) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    _, owned := r.Interfaces[name]
+    return owned
+}
+
+// Add はインターフェイスを管理下に加える
+func (r *OwnershipRegistry) Add(name string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, owned := r.Interfaces[name]; owned {
+        return
+    }
+    r.Interfaces[name] = time.Now()
+    r.save()
+}
+
+// Remove はインターフェイスを管理下から外す
+func (r *OwnershipRegistry) Remove(name string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, owned := r.Interfaces[name]; !owned {
+        return
+    }
+    delete(r.Interfaces, name)
+    r.save()
+}
+
+// Prune は存在しなくなったインターフェイスを記録から消す
+// 再起動などで消えたインターフェイスを、後から手動で同じ名前で作られたものと取り違えないようにする
+func (r *OwnershipRegistry) Prune(present map[string]bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    changed := false
+    for name := range r.Interfaces {
+        if !present[name] {
+            delete(r.Interfaces, name)
+            changed = true
+        }
+    }
+    if changed {
+        r.save()
+    }
+}
+
+// takeFirstRun は所有情報のファイルがない状態で初めて呼ばれたときだけtrueを返す
+// 引き継ぐものがなくても空の記録を保存し、次の起動からは引き継がない
+func (r *OwnershipRegistry) takeFirstRun() bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if !r.firstRun {
+        return false
+    }
+    r.firstRun = false
+    r.save()
+    return true
+}
+
+// save は一時ファイルに書き込んでから置き換える。呼び出し側でロックを取ること
+func (r *OwnershipRegistry) save() {
+    if r.path == "" {
+        return
+    }
+    data, err := json.MarshalIndent(r, "", "  ")
+    if err != nil {
+        slog.Error("Failed to marshal ownership registry", "error", err)
+        return
+    }
+    if err := writeStateFile(r.path, data); err != nil {
+        slog.Error("Failed to write ownership registry", "path", r.path, "error", err)
+    }
+}
+
+// pruneOwnership は現在のgif、bridge、VLANに含まれないインターフェイスを所有情報から消す
+func pruneOwnership(currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, currentVLANs map[string]string) {
+    present := make(map[string]bool)
+    for name := range currentGifs {
+        present[name] = true
+    }
+    for name := range currentBridges {
+        present[name] = true
+    }
+    for name := range currentVLANs {
+        present[name] = true
+    }
+    ownership.Prune(present)
+}
+
+// adoptIfNeeded はadopt_existingが有効な場合と、owned.jsonがまだない最初の適用で既存のインターフェイスを引き継ぐ
+// ownershipの導入前のバージョンから更新したホストは、設定どおりのインターフェイスをそのまま管理下に置く
+func adoptIfNeeded(configs []TunnelConfig, currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, currentVLANs map[string]string, settings *Settings) {
+    if firstRun := ownership.takeFirstRun(); firstRun || settings.AdoptExisting {
+        if firstRun {
+            slog.Info("No ownership registry yet, adopting existing interfaces of configured tunnels")
+        }
+        adoptExisting(configs, currentGifs, currentBridges, currentVLANs, settings.PhysicalIface)
+    }
+}
+
+// adoptExisting は設定にあるトンネルのgif、VLAN、bridgeのうち、既に存在して管理下にないものを管理下に加える
+func adoptExisting(configs []TunnelConfig, currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, currentVLANs map[string]string, physicalIface string) {
+    for _, config := range configs {
+        gif := fmt.Sprintf("gif%s", config.TunnelID)
+        bridge := fmt.Sprintf("bridge%s", config.TunnelID)
+        vlanIface := fmt.Sprintf("%s.%s", physicalIface, config.VlanID)
+        _, gifExists := currentGifs[gif]
+        _, bridgeExists := currentBridges[bridge]
+        _, vlanExists := currentVLANs[vlanIface]
+        for name, exists := range map[string]bool{gif: gifExists, bridge: bridgeExists, vlanIface: vlanExists} {
+            if exists && !ownership.Owns(name) {
+                ownership.Add(name)
+                slog.Info("Adopted existing interface", "iface", name, "tunnel_id", config.TunnelID)
+            }
+        }
+    }
+}
+
+// Conflict はeipconfの管理下にないために変更しなかったインターフェイス
+type Conflict struct {
+    Kind     string `json:"kind"`
+    Iface    string `json:"iface"`
+    TunnelID string `json:"tunnel_id,omitempty"`
+    Reason   string `json:"reason"`
+}
+
+// reportedConflicts は既に報告した競合。同じ競合を毎サイクル通知しないために使う
+var reportedConflicts = make(map[string]string)
+
+// reportConflicts は新たに見つかった競合をWARNとして報告し、解消した競合を記録から消す
+func reportConflicts(conflicts []Conflict) {
+    current := make(map[string]string)
+    for _, c := range conflicts {
+        current[c.Iface] = c.Reason
+        if reportedConflicts[c.Iface] == c.Reason {
+            slog.Debug("Interface not managed by eipconf", "kind", c.Kind, "iface", c.Iface, "reason", c.Reason)
+            continue
+        }
+        slog.Warn("Interface not managed by eipconf", "kind", c.Kind, "iface", c.Iface, "tunnel_id", c.TunnelID, "reason", c.Reason)
+    }
+    for iface := range reportedConflicts {
+        if _, exists := current[iface]; !exists {
+            slog.Info("Conflict resolved", "iface", iface)
+        }
+    }
+    reportedConflicts = current
+}
+
+// isPhysicalVLAN はVLANインターフェイスがphysical_iface上のものかを返す
+func isPhysicalVLAN(name, physicalIface string) bool {
+    return strings.HasPrefix(name, physicalIface+".")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestOwnershipReadOnlyDoesNotWrite(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "owned.json")
+    if err := os.WriteFile(path, []byte(`{"interfaces": {"gif1": "2024-01-01T00:00:00Z"}}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    before, _ := os.ReadFile(path)
+
+    r, err := loadOwnership(path, true)
+    if err != nil {
+        t.Fatalf("loadOwnership: %v", err)
+    }
+    r.Prune(map[string]bool{})
+    r.Add("gif2")
+    if r.Owns("gif1") || !r.Owns("gif2") {
+        t.Errorf("in-memory registry = %v, want only gif2", r.Interfaces)
+    }
+    if after, _ := os.ReadFile(path); string(after) != string(before) {
+        t.Errorf("read-only registry rewrote %s:\n%s", path, after)
+    }
+}
+
+func TestAdoptOnFirstRun(t *testing.T) {
+    fake := useFakeHost(t)
+    ifconfig(t, fake, "gif1", "create")
+    ifconfig(t, fake, "gif1", "tunnel", "192.0.2.10", "198.51.100.1")
+    ifconfig(t, fake, "gif9", "create")
+
+    path := filepath.Join(t.TempDir(), "owned.json")
+    var err error
+    if ownership, err = loadOwnership(path, false); err != nil {
+        t.Fatalf("loadOwnership: %v", err)
+    }
+    settings := &Settings{PhysicalIface: "em2"}
+    configs := []TunnelConfig{{TunnelID: "1", SrcAddr: "192.0.2.10", DstAddr: "198.51.100.1", VlanID: "100"}}
+
+    gifs, bridges, vlans, _ := backend.List()
+    adoptIfNeeded(configs, gifs, bridges, vlans, settings)
+    if !ownership.Owns("gif1") || ownership.Owns("gif9") {
+        t.Errorf("owned after first run = %v, want gif1 only", ownership.Interfaces)
+    }
+    if _, err := os.Stat(path); err != nil {
+        t.Errorf("registry not saved after first run: %v", err)
+    }
+
+    // 2回目以降とowned.jsonがある状態での起動では引き継がない
+    ownership.Remove("gif1")
+    adoptIfNeeded(configs, gifs, bridges, vlans, settings)
+    if ownership.Owns("gif1") {
+        t.Errorf("gif1 adopted again on second run")
+    }
+    if ownership, err = loadOwnership(path, false); err != nil {
+        t.Fatalf("loadOwnership: %v", err)
+    }
+    adoptIfNeeded(configs, gifs, bridges, vlans, settings)
+    if ownership.Owns("gif1") {
+        t.Errorf("gif1 adopted after restart with existing registry")
+    }
+}
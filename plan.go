@@ -0,0 +1,535 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+// IfaceState は変更前後のインターフェイスの値。種類ごとに使うフィールドが異なる
+//   gif: src_addr, dst_addr, description
+//   vlan: vlan_id
+//   bridge: members
+type IfaceState struct {
+    Src         string   `json:"src_addr,omitempty"`
+    Dst         string   `json:"dst_addr,omitempty"`
+    Description string   `json:"description,omitempty"`
+    VlanID      string   `json:"vlan_id,omitempty"`
+    Members     []string `json:"members,omitempty"`
+}
+
+// Change はインターフェイス1つに対する作成、変更、削除と、そのための操作
+type Change struct {
+    Kind     string      `json:"kind"`   // "gif", "vlan", "bridge"
+    Action   string      `json:"action"` // "create", "modify", "destroy"
+    Iface    string      `json:"iface"`
+    TunnelID string      `json:"tunnel_id,omitempty"`
+    Before   *IfaceState `json:"before,omitempty"`
+    After    *IfaceState `json:"after,omitempty"`
+    Ops      []Operation `json:"operations"`
+    Rollback []Operation `json:"rollback,omitempty"` // 失敗時に変更前の状態へ戻す操作
+}
+
+// TunnelPlan は1つのトンネルに属するgif、VLAN、bridgeの変更
+// 1つの単位として適用し、途中で失敗した場合は適用済みの変更をロールバックする
+type TunnelPlan struct {
+    TunnelID string   `json:"tunnel_id"`
+    VlanID   string   `json:"vlan_id"`
+    Changes  []Change `json:"changes"`
+}
+
+// ReconcilePlan は1サイクルで行うすべての変更を実行順に保持する
+// 差分の通知、適用、ログ出力、planモードの出力はすべてこれを元にする
+type ReconcilePlan struct {
+    Removals []Change     `json:"removals"` // 設定から消えたgifとbridgeの削除
+    Tunnels  []TunnelPlan `json:"tunnels"`  // 設定にあるトンネルの作成と変更
+    Cleanup  []Change     `json:"cleanup"`  // 使われなくなったVLANの削除
+    // Conflicts は管理下にないために変更しなかったインターフェイス。Emptyの判定には含めない
+    Conflicts []Conflict `json:"conflicts"`
+    // Pending はホールドダウン中のため削除を待っているトンネル。Emptyの判定には含めない
+    Pending []PendingRemoval `json:"pending"`
+}
+
+// Changes はすべての変更を実行順に返す
+func (p *ReconcilePlan) Changes() []Change {
+    changes := append([]Change{}, p.Removals...)
+    for _, t := range p.Tunnels {
+        changes = append(changes, t.Changes...)
+    }
+    return append(changes, p.Cleanup...)
+}
+
+// Operations はすべての操作を実行順に返す
+func (p *ReconcilePlan) Operations() []Operation {
+    ops := []Operation{}
+    for _, c := range p.Changes() {
+        ops = append(ops, c.Ops...)
+    }
+    return ops
+}
+
+// Empty は変更がないかどうかを返す
+func (p *ReconcilePlan) Empty() bool {
+    return len(p.Removals) == 0 && len(p.Tunnels) == 0 && len(p.Cleanup) == 0
+}
+
+// newOp は1つの操作を作成する
+func newOp(iface, action string, args ...string) Operation {
+    return Operation{Iface: iface, Action: action, Args: args}
+}
+
+// calculatePlan は現在の状態とJSONデータから変更計画を作成
+func calculatePlan(currentGifs map[string]InterfaceConfig, currentBridges map[string]BridgeConfig, currentVLANs map[string]string, configs []TunnelConfig, physicalIface string) *ReconcilePlan {
+    plan := &ReconcilePlan{Removals: []Change{}, Tunnels: []TunnelPlan{}, Cleanup: []Change{}, Conflicts: []Conflict{}, Pending: []PendingRemoval{}}
+
+    jsonGifs := make(map[string]bool)
+    jsonBridges := make(map[string]bool)
+    jsonVLANs := make(map[string]bool)
+    for _, config := range configs {
+        jsonGifs[fmt.Sprintf("gif%s", config.TunnelID)] = true
+        jsonBridges[fmt.Sprintf("bridge%s", config.TunnelID)] = true
+        jsonVLANs[fmt.Sprintf("%s.%s", physicalIface, config.VlanID)] = true
+    }
+
+    for _, gif := range sortedKeys(currentGifs) {
+        if !jsonGifs[gif] {
+            current := currentGifs[gif]
+            if !ownership.Owns(gif) {
+                plan.Conflicts = append(plan.Conflicts, Conflict{Kind: "gif", Iface: gif, TunnelID: current.TunnelID, Reason: "not in config and not created by eipconf, skipping removal"})
+                continue
+            }
+            plan.Removals = append(plan.Removals, Change{Kind: "gif", Action: "destroy", Iface: gif, TunnelID: current.TunnelID,
+                Before: &IfaceState{Src: current.Src, Dst: current.Dst, Description: current.Description}, Ops: []Operation{newOp(gif, "destroy")}})
+        }
+    }
+    for _, bridge := range sortedKeys(currentBridges) {
+        if !jsonBridges[bridge] {
+            current := currentBridges[bridge]
+            if !ownership.Owns(bridge) {
+                plan.Conflicts = append(plan.Conflicts, Conflict{Kind: "bridge", Iface: bridge, TunnelID: current.TunnelID, Reason: "not in config and not created by eipconf, skipping removal"})
+                continue
+            }
+            plan.Removals = append(plan.Removals, Change{Kind: "bridge", Action: "destroy", Iface: bridge, TunnelID: current.TunnelID,
+                Before: &IfaceState{Members: current.Members}, Ops: []Operation{newOp(bridge, "destroy")}})
+        }
+    }
+
+    for _, config := range configs {
+        gif := fmt.Sprintf("gif%s", config.TunnelID)
+        bridge := fmt.Sprintf("bridge%s", config.TunnelID)
+        vlanIface := fmt.Sprintf("%s.%s", physicalIface, config.VlanID)
+        tunnel := TunnelPlan{TunnelID: config.TunnelID, VlanID: config.VlanID}
+
+        // 同じ名前のインターフェイスが管理下になければ、そのトンネルには手を付けない
+        _, gifExists := currentGifs[gif]
+        _, vlanExists := currentVLANs[vlanIface]
+        _, bridgeExists := currentBridges[bridge]
+        conflicts := len(plan.Conflicts)
+        for _, c := range []struct {
+            kind, iface string
+            exists      bool
+        }{{"gif", gif, gifExists}, {"vlan", vlanIface, vlanExists}, {"bridge", bridge, bridgeExists}} {
+            if c.exists && !ownership.Owns(c.iface) {
+                plan.Conflicts = append(plan.Conflicts, Conflict{Kind: c.kind, Iface: c.iface, TunnelID: config.TunnelID, Reason: "exists but not created by eipconf, skipping tunnel"})
+            }
+        }
+        if len(plan.Conflicts) > conflicts {
+            continue
+        }
+
+        isIPv6 := strings.Contains(config.SrcAddr, ":") || strings.Contains(config.DstAddr, ":")
+        after := &IfaceState{Src: config.SrcAddr, Dst: config.DstAddr, Description: config.Description}
+        if current, exists := currentGifs[gif]; exists {
+            if current.Src == config.SrcAddr && current.Dst == config.DstAddr && current.IsIPv6 == isIPv6 && current.Description == config.Description {
+                slog.Debug("gif already exists with correct config, skipping", "gif", gif)
+            } else {
+                ops := []Operation{newOp(gif, "tunnel", config.SrcAddr, config.DstAddr), newOp(gif, "link0"), newOp(gif, "up")}
+                if config.Description != "" {
+                    ops = append(ops, newOp(gif, "description", config.Description))
+                } else if current.Description != "" {
+                    // 設定からdescriptionを消した場合は、gifからも消す
+                    ops = append(ops, newOp(gif, "-description"))
+                }
+                var rollback []Operation
+                if current.Src != "" {
+                    rollback = append(rollback, newOp(gif, "tunnel", current.Src, current.Dst))
+                }
+                if current.Description != "" {
+                    rollback = append(rollback, newOp(gif, "description", current.Description))
+                } else if config.Description != "" {
+                    rollback = append(rollback, newOp(gif, "-description"))
+                }
+                tunnel.Changes = append(tunnel.Changes, Change{Kind: "gif", Action: "modify", Iface: gif, TunnelID: config.TunnelID,
+                    Before: &IfaceState{Src: current.Src, Dst: current.Dst, Description: current.Description}, After: after, Ops: ops, Rollback: rollback})
+            }
+        } else {
+            ops := []Operation{newOp(gif, "create"), newOp(gif, "tunnel", config.SrcAddr, config.DstAddr), newOp(gif, "mtu", "1500"), newOp(gif, "link0"), newOp(gif, "up")}
+            if config.Description != "" {
+                ops = append(ops, newOp(gif, "description", config.Description))
+            }
+            tunnel.Changes = append(tunnel.Changes, Change{Kind: "gif", Action: "create", Iface: gif, TunnelID: config.TunnelID, After: after, Ops: ops,
+                Rollback: []Operation{newOp(gif, "destroy")}})
+        }
+
+        if vlanID, exists := currentVLANs[vlanIface]; exists && vlanID == config.VlanID {
+            slog.Debug("VLAN already exists with correct config, skipping", "vlan", vlanIface)
+        } else if exists {
+            tunnel.Changes = append(tunnel.Changes, Change{Kind: "vlan", Action: "modify", Iface: vlanIface, TunnelID: config.TunnelID,
+                Before: &IfaceState{VlanID: vlanID}, After: &IfaceState{VlanID: config.VlanID},
+                Ops:      []Operation{newOp(vlanIface, "destroy"), newOp(vlanIface, "create"), newOp(vlanIface, "vlan", config.VlanID, physicalIface)},
+                Rollback: []Operation{newOp(vlanIface, "destroy"), newOp(vlanIface, "create"), newOp(vlanIface, "vlan", vlanID, physicalIface)}})
+        } else {
+            tunnel.Changes = append(tunnel.Changes, Change{Kind: "vlan", Action: "create", Iface: vlanIface, TunnelID: config.TunnelID,
+                After: &IfaceState{VlanID: config.VlanID},
+                Ops:      []Operation{newOp(vlanIface, "create"), newOp(vlanIface, "vlan", config.VlanID, physicalIface)},
+                Rollback: []Operation{newOp(vlanIface, "destroy")}})
+        }
+
+        expectedMembers := []string{gif, vlanIface}
+        addMembers := []Operation{newOp(bridge, "addm", gif), newOp(bridge, "addm", vlanIface)}
+        if current, exists := currentBridges[bridge]; exists {
+            if membersEqual(current.Members, expectedMembers) {
+                slog.Debug("bridge already exists with correct config, skipping", "bridge", bridge)
+            } else {
+                ops := append(append([]Operation{newOp(bridge, "destroy"), newOp(bridge, "create")}, addMembers...), newOp(bridge, "up"))
+                rollback := []Operation{newOp(bridge, "destroy"), newOp(bridge, "create")}
+                for _, member := range current.Members {
+                    rollback = append(rollback, newOp(bridge, "addm", member))
+                }
+                rollback = append(rollback, newOp(bridge, "up"))
+                tunnel.Changes = append(tunnel.Changes, Change{Kind: "bridge", Action: "modify", Iface: bridge, TunnelID: config.TunnelID,
+                    Before: &IfaceState{Members: current.Members}, After: &IfaceState{Members: expectedMembers}, Ops: ops, Rollback: rollback})
+            }
+        } else {
+            ops := append(append([]Operation{newOp(bridge, "create")}, addMembers...), newOp(bridge, "mtu", "1500"), newOp(bridge, "up"))
+            tunnel.Changes = append(tunnel.Changes, Change{Kind: "bridge", Action: "create", Iface: bridge, TunnelID: config.TunnelID,
+                After: &IfaceState{Members: expectedMembers}, Ops: ops, Rollback: []Operation{newOp(bridge, "destroy")}})
+        }
+
+        if len(tunnel.Changes) > 0 {
+            plan.Tunnels = append(plan.Tunnels, tunnel)
+        }
+    }
+
+    for _, vlan := range sortedKeys(currentVLANs) {
+        if !jsonVLANs[vlan] {
+            if !ownership.Owns(vlan) {
+                // 他のNICのVLANはeipconfとは無関係なので報告しない
+                if isPhysicalVLAN(vlan, physicalIface) {
+                    plan.Conflicts = append(plan.Conflicts, Conflict{Kind: "vlan", Iface: vlan, Reason: "not in config and not created by eipconf, skipping removal"})
+                }
+                continue
+            }
+            plan.Cleanup = append(plan.Cleanup, Change{Kind: "vlan", Action: "destroy", Iface: vlan,
+                Before: &IfaceState{VlanID: currentVLANs[vlan]}, Ops: []Operation{newOp(vlan, "destroy")}})
+        }
+    }
+
+    return plan
+}
+
+// sortedKeys はmapのキーを名前順に返す
+func sortedKeys[V any](m map[string]V) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// containsString はスライスに指定した文字列が含まれるか確認
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// removeString はスライスから指定した文字列を取り除いた新しいスライスを返す
+func removeString(list []string, s string) []string {
+    var result []string
+    for _, v := range list {
+        if v != s {
+            result = append(result, v)
+        }
+    }
+    return result
+}
+
+// TunnelResult はトンネル1つの適用結果
+type TunnelResult struct {
+    TunnelID string `json:"tunnel_id"`
+    Status   string `json:"status"` // "applied", "rolled_back", "rollback_failed"
+    FailedOp string `json:"failed_op,omitempty"`
+    Error    string `json:"error,omitempty"`
+}
+
+// ApplyResult は1サイクルの適用結果
+type ApplyResult struct {
+    Operations int            `json:"operations"`
+    Failed     int            `json:"failed"` // 失敗した操作の数。ロールバック中の失敗は含まない
+    Tunnels    []TunnelResult `json:"tunnels"`
+}
+
+// Count は指定した状態のトンネルの数を返す
+func (r *ApplyResult) Count(status string) int {
+    n := 0
+    for _, t := range r.Tunnels {
+        if t.Status == status {
+            n++
+        }
+    }
+    return n
+}
+
+// PartlyApplied は失敗がないか、少なくとも1つのトンネルを適用できたかを返す
+// すべてのトンネルがロールバックした場合など、何も適用できなかったサイクルではfalse
+func (r *ApplyResult) PartlyApplied() bool {
+    return r.Failed == 0 || r.Count("applied") > 0
+}
+
+// executePlan は計画に従って変更を適用する
+// 削除は1つずつ実行し、トンネルごとの変更は失敗するとロールバックする
+func executePlan(plan *ReconcilePlan) ApplyResult {
+    result := ApplyResult{Operations: len(plan.Operations()), Tunnels: []TunnelResult{}}
+    for _, c := range plan.Removals {
+        result.Failed += executeChange(c)
+    }
+    // ロールバックしたトンネルのbridgeに戻したメンバーは削除しない
+    restored := make(map[string]bool)
+    for _, t := range plan.Tunnels {
+        tr, failed := executeTunnel(t)
+        result.Failed += failed
+        result.Tunnels = append(result.Tunnels, tr)
+        if tr.Status != "applied" {
+            for _, c := range t.Changes {
+                if c.Before != nil {
+                    for _, member := range c.Before.Members {
+                        restored[member] = true
+                    }
+                }
+            }
+        }
+    }
+    for _, c := range plan.Cleanup {
+        if restored[c.Iface] {
+            slog.Warn("Keeping interface restored by rollback", "kind", c.Kind, "iface", c.Iface)
+            continue
+        }
+        result.Failed += executeChange(c)
+    }
+    return result
+}
+
+// executeChange は1つの変更の操作を順に実行し、失敗した操作の数を返す
+func executeChange(c Change) int {
+    failed := 0
+    for _, o := range c.Ops {
+        if err := applyOperation(o); err != nil {
+            failed++
+            slog.Error("Failed to apply operation", "kind", c.Kind, "action", c.Action, "iface", c.Iface, "op", o.String(), "error", err)
+        }
+    }
+    if failed == 0 {
+        slog.Info("Applied change", "kind", c.Kind, "action", c.Action, "iface", c.Iface, "tunnel_id", c.TunnelID)
+        recordAppliedChanges(c)
+    }
+    return failed
+}
+
+// executeTunnel はトンネルのgif、VLAN、bridgeの変更を1つの単位として適用する
+// 途中で操作が失敗した場合は、着手済みの変更を逆順にロールバックする
+// 変更の最初の操作(createなど)が失敗した場合、その変更は何もしていないのでロールバックしない
+func executeTunnel(t TunnelPlan) (TunnelResult, int) {
+    for i, c := range t.Changes {
+        for j, o := range c.Ops {
+            err := applyOperation(o)
+            if err == nil {
+                continue
+            }
+            slog.Error("Failed to apply operation", "kind", c.Kind, "action", c.Action, "iface", c.Iface, "op", o.String(), "error", err)
+            result := TunnelResult{TunnelID: t.TunnelID, FailedOp: o.String(), Error: err.Error()}
+            started := t.Changes[:i]
+            if j > 0 {
+                started = t.Changes[:i+1]
+            }
+            if rollbackChanges(started) {
+                result.Status = "rolled_back"
+                slog.Warn("Rolled back tunnel after failed operation", "tunnel_id", t.TunnelID, "failed_op", o.String(), "error", err)
+            } else {
+                result.Status = "rollback_failed"
+                slog.Error("Failed to roll back tunnel, interfaces may be left half-configured", "tunnel_id", t.TunnelID, "failed_op", o.String(), "error", err)
+            }
+            return result, 1
+        }
+        slog.Info("Applied change", "kind", c.Kind, "action", c.Action, "iface", c.Iface, "tunnel_id", c.TunnelID)
+    }
+    // ロールバックした変更は数えない
+    recordAppliedChanges(t.Changes...)
+    return TunnelResult{TunnelID: t.TunnelID, Status: "applied"}, 0
+}
+
+// rollbackChanges は変更を逆順に取り消す。すべてのロールバック操作が成功したかを返す
+// 失敗した操作があっても残りの操作は続ける
+func rollbackChanges(changes []Change) bool {
+    ok := true
+    for i := len(changes) - 1; i >= 0; i-- {
+        c := changes[i]
+        for _, o := range c.Rollback {
+            if err := applyOperation(o); err != nil {
+                ok = false
+                slog.Error("Failed to apply rollback operation", "kind", c.Kind, "iface", c.Iface, "op", o.String(), "error", err)
+            }
+        }
+    }
+    return ok
+}
+
+// PlanReport はplanモードの出力
+type PlanReport struct {
+    Hostname     string         `json:"hostname"`
+    Backend      string         `json:"backend"`
+    ConfigSource string         `json:"config_source"`
+    Serial       int64          `json:"serial,omitempty"` // 設定のシリアル番号
+    GeneratedAt  time.Time      `json:"generated_at"`
+    Plan         *ReconcilePlan `json:"plan"`
+    Operations   []Operation    `json:"operations"`
+    HeldReason   string         `json:"held_reason,omitempty"` // セーフガードで止められる場合の理由
+}
+
+// buildPlan は現在の状態と設定から変更計画を作成する
+// インターフェイスには一切変更を加えない
+func buildPlan(settings *Settings) (PlanReport, error) {
+    hostname, err := os.Hostname()
+    if err != nil {
+        hostname = "unknown"
+    }
+    report := PlanReport{Hostname: hostname, Backend: backend.Name(), ConfigSource: settings.ConfigSource, GeneratedAt: time.Now(), Operations: []Operation{}}
+
+    currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
+    source, serial, configs, err := fetchConfig(settings, currentGifs)
+    if err != nil {
+        return report, err
+    }
+    report.ConfigSource, report.Serial = source, serial
+    adoptIfNeeded(configs, currentGifs, currentBridges, currentVLANs, settings)
+    report.Plan = calculatePlan(currentGifs, currentBridges, currentVLANs, configs, settings.PhysicalIface)
+    // 実行中のデーモンがどれだけ数えたかは分からないため、初めて消えたものとして扱う
+    newRemovalTracker().holdRemovals(report.Plan, settings, report.GeneratedAt, true)
+    report.Operations = report.Plan.Operations()
+    report.HeldReason = checkSafeguards(report.Plan, configs, currentGifs, settings)
+    return report, nil
+}
+
+// writePlan は計画をtextまたはjson形式で出力
+func writePlan(w io.Writer, report PlanReport, format string) error {
+    switch format {
+    case "json":
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        return enc.Encode(report)
+    case "text", "":
+        fmt.Fprintf(w, "Plan for %s (backend: %s, source: %s)\n", report.Hostname, report.Backend, report.ConfigSource)
+        if report.Serial > 0 {
+            fmt.Fprintf(w, "# config serial: %d\n", report.Serial)
+        }
+        if report.Plan == nil {
+            fmt.Fprintln(w, "No changes.")
+            return nil
+        }
+        for _, c := range report.Plan.Conflicts {
+            fmt.Fprintf(w, "# conflict: %s %s: %s\n", c.Kind, c.Iface, c.Reason)
+        }
+        for _, p := range report.Plan.Pending {
+            fmt.Fprintf(w, "# pending removal: %s\n", describePending(p, ""))
+        }
+        if report.Plan.Empty() {
+            fmt.Fprintln(w, "No changes.")
+            return nil
+        }
+        if report.HeldReason != "" {
+            fmt.Fprintf(w, "# held by safeguard: %s\n", report.HeldReason)
+        }
+        for _, c := range report.Plan.Changes() {
+            fmt.Fprintf(w, "# %s\n", describeChange(c))
+            for _, o := range c.Ops {
+                fmt.Fprintln(w, o.String())
+            }
+        }
+        fmt.Fprintf(w, "%d operation(s).\n", len(report.Operations))
+        return nil
+    default:
+        return fmt.Errorf("unknown plan format: %s", format)
+    }
+}
+
+// describeChange は変更を "modify gif gif1: dst_addr 2001:db8::2 -> 2001:db8::3" の形式で表す
+func describeChange(c Change) string {
+    s := fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Iface)
+    if diff := stateDiff(c.Before, c.After, ""); diff != "" {
+        s += ": " + diff
+    }
+    return s
+}
+
+// stateDiff は変更前後の値を列挙する。作成では変更後、削除では変更前の値のみを出力し、
+// 変更では異なる値だけを出力する。quoteは値を囲む文字列
+func stateDiff(before, after *IfaceState, quote string) string {
+    fields := func(s *IfaceState) [][2]string {
+        if s == nil {
+            return nil
+        }
+        var f [][2]string
+        add := func(k, v string) {
+            if v != "" {
+                f = append(f, [2]string{k, v})
+            }
+        }
+        add("src_addr", s.Src)
+        add("dst_addr", s.Dst)
+        add("vlan_id", s.VlanID)
+        add("description", s.Description)
+        add("members", strings.Join(s.Members, ","))
+        return f
+    }
+    q := func(v string) string { return quote + v + quote }
+
+    var parts []string
+    switch {
+    case before == nil:
+        for _, f := range fields(after) {
+            parts = append(parts, fmt.Sprintf("%s=%s", f[0], q(f[1])))
+        }
+    case after == nil:
+        for _, f := range fields(before) {
+            parts = append(parts, fmt.Sprintf("%s=%s", f[0], q(f[1])))
+        }
+    default:
+        values := make(map[string][2]string)
+        var keys []string
+        for i, s := range []*IfaceState{before, after} {
+            for _, f := range fields(s) {
+                v, seen := values[f[0]]
+                if !seen {
+                    keys = append(keys, f[0])
+                }
+                v[i] = f[1]
+                values[f[0]] = v
+            }
+        }
+        for _, k := range keys {
+            if v := values[k]; v[0] != v[1] {
+                parts = append(parts, fmt.Sprintf("%s=%s -> %s", k, q(v[0]), q(v[1])))
+            }
+        }
+    }
+    return strings.Join(parts, ", ")
+}
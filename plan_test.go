@@ -0,0 +1,276 @@
+package main
+
+import (
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// useFakeHost はifconfigバックエンドをFakeExecutorに向け、空の所有情報から始める
+// 物理インターフェイスはem0(アドレスあり)とem2(VLANの親)
+func useFakeHost(t *testing.T) *FakeExecutor {
+    t.Helper()
+    fake := NewFakeExecutor()
+    fake.AddPhysical("em0", "192.0.2.10", "2001:db8::10")
+    fake.AddPhysical("em2")
+
+    savedExecutor, savedBackend, savedOwnership, savedDelay := executor, backend, ownership, commandRetryDelay
+    t.Cleanup(func() {
+        executor, backend, ownership, commandRetryDelay = savedExecutor, savedBackend, savedOwnership, savedDelay
+    })
+    executor = fake
+    backend = &ifconfigBackend{}
+    ownership = &OwnershipRegistry{Interfaces: make(map[string]time.Time)}
+    commandRetryDelay = 0
+    return fake
+}
+
+// ifconfig はテストの前提となる状態をFakeExecutorに直接作る。所有情報には記録しない
+func ifconfig(t *testing.T, fake *FakeExecutor, args ...string) {
+    t.Helper()
+    if out, err := fake.CombinedOutput("ifconfig", args...); err != nil {
+        t.Fatalf("ifconfig %s: %v: %s", strings.Join(args, " "), err, out)
+    }
+}
+
+// hostState はバックエンドから読んだ状態を比較しやすい形にする
+//   gif: "src dst description"、vlan: VLAN ID、bridge: メンバーを名前順に "," で連結
+func hostState(t *testing.T) map[string]string {
+    t.Helper()
+    gifs, bridges, vlans, err := backend.List()
+    if err != nil {
+        t.Fatalf("List: %v", err)
+    }
+    state := make(map[string]string)
+    for name, gif := range gifs {
+        state[name] = strings.TrimSpace(gif.Src + " " + gif.Dst + " " + gif.Description)
+    }
+    for name, vlan := range vlans {
+        state[name] = vlan
+    }
+    for name, bridge := range bridges {
+        members := append([]string{}, bridge.Members...)
+        sort.Strings(members)
+        state[name] = strings.Join(members, ",")
+    }
+    return state
+}
+
+// planAndExecute は現在の状態から計画を作って適用する
+func planAndExecute(t *testing.T, configs []TunnelConfig) (*ReconcilePlan, ApplyResult) {
+    t.Helper()
+    gifs, bridges, vlans, err := backend.List()
+    if err != nil {
+        t.Fatalf("List: %v", err)
+    }
+    plan := calculatePlan(gifs, bridges, vlans, configs, "em2")
+    return plan, executePlan(plan)
+}
+
+func TestCalculateAndExecutePlan(t *testing.T) {
+    tunnel1 := TunnelConfig{TunnelID: "1", SrcAddr: "2001:db8::10", DstAddr: "2001:db8::2", VlanID: "100", Description: "Customer A"}
+    tunnel2 := TunnelConfig{TunnelID: "2", SrcAddr: "192.0.2.10", DstAddr: "198.51.100.2", VlanID: "101"}
+    moved := tunnel1
+    moved.DstAddr = "2001:db8::9"
+    revlanned := tunnel1
+    revlanned.VlanID = "200"
+    undescribed := tunnel1
+    undescribed.Description = ""
+
+    tests := []struct {
+        name             string
+        initial          []TunnelConfig                         // 事前にeipconfとして適用しておく設定
+        setup            func(t *testing.T, fake *FakeExecutor) // 事前に手動で作るインターフェイス
+        failOn           string
+        configs          []TunnelConfig
+        wantOps          []string
+        wantState        map[string]string
+        wantTunnelStatus string
+        wantNoCommand    string // 実行されてはならないコマンド
+    }{
+        {
+            name:    "create tunnel",
+            configs: []TunnelConfig{tunnel1},
+            wantOps: []string{
+                "gif1 create", "gif1 tunnel 2001:db8::10 2001:db8::2", "gif1 mtu 1500", "gif1 link0", "gif1 up", "gif1 description Customer A",
+                "em2.100 create", "em2.100 vlan 100 em2",
+                "bridge1 create", "bridge1 addm gif1", "bridge1 addm em2.100", "bridge1 mtu 1500", "bridge1 up",
+            },
+            wantState:        map[string]string{"gif1": "2001:db8::10 2001:db8::2 Customer A", "em2.100": "100", "bridge1": "em2.100,gif1"},
+            wantTunnelStatus: "applied",
+        },
+        {
+            name:    "modify dst_addr",
+            initial: []TunnelConfig{tunnel1},
+            configs: []TunnelConfig{moved},
+            wantOps: []string{
+                "gif1 tunnel 2001:db8::10 2001:db8::9", "gif1 link0", "gif1 up", "gif1 description Customer A",
+            },
+            wantState:        map[string]string{"gif1": "2001:db8::10 2001:db8::9 Customer A", "em2.100": "100", "bridge1": "em2.100,gif1"},
+            wantTunnelStatus: "applied",
+        },
+        {
+            name:    "remove description",
+            initial: []TunnelConfig{tunnel1},
+            configs: []TunnelConfig{undescribed},
+            wantOps: []string{
+                "gif1 tunnel 2001:db8::10 2001:db8::2", "gif1 link0", "gif1 up", "gif1 -description",
+            },
+            wantState:        map[string]string{"gif1": "2001:db8::10 2001:db8::2", "em2.100": "100", "bridge1": "em2.100,gif1"},
+            wantTunnelStatus: "applied",
+        },
+        {
+            name:    "change vlan_id",
+            initial: []TunnelConfig{tunnel1},
+            configs: []TunnelConfig{revlanned},
+            wantOps: []string{
+                "em2.200 create", "em2.200 vlan 200 em2",
+                "bridge1 destroy", "bridge1 create", "bridge1 addm gif1", "bridge1 addm em2.200", "bridge1 up",
+                "em2.100 destroy",
+            },
+            wantState:        map[string]string{"gif1": "2001:db8::10 2001:db8::2 Customer A", "em2.200": "200", "bridge1": "em2.200,gif1"},
+            wantTunnelStatus: "applied",
+        },
+        {
+            name:      "remove tunnel",
+            initial:   []TunnelConfig{tunnel1, tunnel2},
+            configs:   []TunnelConfig{tunnel1},
+            wantOps:   []string{"gif2 destroy", "bridge2 destroy", "em2.101 destroy"},
+            wantState: map[string]string{"gif1": "2001:db8::10 2001:db8::2 Customer A", "em2.100": "100", "bridge1": "em2.100,gif1"},
+        },
+        {
+            name: "keep interfaces not created by eipconf",
+            setup: func(t *testing.T, fake *FakeExecutor) {
+                ifconfig(t, fake, "gif9", "create")
+                ifconfig(t, fake, "gif9", "tunnel", "192.0.2.10", "203.0.113.9")
+                ifconfig(t, fake, "em2.900", "create")
+                ifconfig(t, fake, "em2.900", "vlan", "900", "vlandev", "em2")
+            },
+            configs:   []TunnelConfig{},
+            wantOps:   []string{},
+            wantState: map[string]string{"gif9": "192.0.2.10 203.0.113.9", "em2.900": "900"},
+        },
+        {
+            name:    "roll back tunnel on failure",
+            failOn:  "bridge1 addm",
+            configs: []TunnelConfig{tunnel1},
+            wantOps: []string{
+                "gif1 create", "gif1 tunnel 2001:db8::10 2001:db8::2", "gif1 mtu 1500", "gif1 link0", "gif1 up", "gif1 description Customer A",
+                "em2.100 create", "em2.100 vlan 100 em2",
+                "bridge1 create", "bridge1 addm gif1", "bridge1 addm em2.100", "bridge1 mtu 1500", "bridge1 up",
+            },
+            wantState:        map[string]string{},
+            wantTunnelStatus: "rolled_back",
+        },
+        {
+            name:    "do not roll back a create that failed",
+            failOn:  "gif1 create",
+            configs: []TunnelConfig{tunnel1},
+            wantOps: []string{
+                "gif1 create", "gif1 tunnel 2001:db8::10 2001:db8::2", "gif1 mtu 1500", "gif1 link0", "gif1 up", "gif1 description Customer A",
+                "em2.100 create", "em2.100 vlan 100 em2",
+                "bridge1 create", "bridge1 addm gif1", "bridge1 addm em2.100", "bridge1 mtu 1500", "bridge1 up",
+            },
+            wantState:        map[string]string{},
+            wantTunnelStatus: "rolled_back",
+            wantNoCommand:    "ifconfig gif1 destroy",
+        },
+        {
+            name:    "roll back only the changes before a failed VLAN create",
+            failOn:  "em2.100 create",
+            configs: []TunnelConfig{tunnel1},
+            wantOps: []string{
+                "gif1 create", "gif1 tunnel 2001:db8::10 2001:db8::2", "gif1 mtu 1500", "gif1 link0", "gif1 up", "gif1 description Customer A",
+                "em2.100 create", "em2.100 vlan 100 em2",
+                "bridge1 create", "bridge1 addm gif1", "bridge1 addm em2.100", "bridge1 mtu 1500", "bridge1 up",
+            },
+            wantState:        map[string]string{},
+            wantTunnelStatus: "rolled_back",
+            wantNoCommand:    "ifconfig em2.100 destroy",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fake := useFakeHost(t)
+            if tt.setup != nil {
+                tt.setup(t, fake)
+            }
+            if tt.initial != nil {
+                if _, result := planAndExecute(t, tt.initial); result.Failed > 0 {
+                    t.Fatalf("initial apply failed: %+v", result)
+                }
+            }
+            if tt.failOn != "" {
+                fake.FailOn(tt.failOn, 0, "")
+            }
+
+            plan, result := planAndExecute(t, tt.configs)
+            var ops []string
+            for _, op := range plan.Operations() {
+                ops = append(ops, op.String())
+            }
+            if !reflect.DeepEqual(ops, tt.wantOps) && !(len(ops) == 0 && len(tt.wantOps) == 0) {
+                t.Errorf("operations:\n got %q\nwant %q", ops, tt.wantOps)
+            }
+            if got := hostState(t); !reflect.DeepEqual(got, tt.wantState) {
+                t.Errorf("state:\n got %v\nwant %v", got, tt.wantState)
+            }
+            switch {
+            case tt.wantTunnelStatus == "" && len(result.Tunnels) > 0:
+                t.Errorf("tunnel results = %+v, want none", result.Tunnels)
+            case tt.wantTunnelStatus != "" && (len(result.Tunnels) != 1 || result.Tunnels[0].Status != tt.wantTunnelStatus):
+                t.Errorf("tunnel results = %+v, want one %s", result.Tunnels, tt.wantTunnelStatus)
+            }
+            for _, cmd := range fake.Commands() {
+                if tt.wantNoCommand != "" && cmd == tt.wantNoCommand {
+                    t.Errorf("ran %q", cmd)
+                }
+            }
+            if tt.failOn == "" && result.Failed > 0 {
+                t.Errorf("failed operations = %d, want 0", result.Failed)
+            }
+
+            // 適用に成功した場合、同じ設定をもう一度突き合わせても変更はない
+            if tt.failOn == "" {
+                if again, _ := planAndExecute(t, tt.configs); !again.Empty() {
+                    t.Errorf("second plan not empty: %v", again.Operations())
+                }
+            }
+        })
+    }
+}
+
+func TestCalculatePlanConflicts(t *testing.T) {
+    fake := useFakeHost(t)
+    ifconfig(t, fake, "gif1", "create")
+    ifconfig(t, fake, "gif1", "tunnel", "192.0.2.10", "203.0.113.1")
+
+    plan, _ := planAndExecute(t, []TunnelConfig{{TunnelID: "1", SrcAddr: "192.0.2.10", DstAddr: "198.51.100.1", VlanID: "100"}})
+    if !plan.Empty() {
+        t.Errorf("plan for tunnel with unowned gif not empty: %v", plan.Operations())
+    }
+    if len(plan.Conflicts) != 1 || plan.Conflicts[0].Iface != "gif1" {
+        t.Errorf("conflicts = %+v, want gif1", plan.Conflicts)
+    }
+    if got := hostState(t)["gif1"]; got != "192.0.2.10 203.0.113.1" {
+        t.Errorf("gif1 = %q, changed although not owned", got)
+    }
+}
+
+func TestCommandFailureMetricAction(t *testing.T) {
+    fake := useFakeHost(t)
+    savedMetrics := metrics
+    t.Cleanup(func() { metrics = savedMetrics })
+    metrics = &metricSet{values: make(map[string]map[string]float64)}
+
+    // IPv6のトンネルではifconfigの2番目の引数がinet6になるが、ラベルは操作の種類にする
+    fake.FailOn("gif1 inet6 tunnel", 1, "")
+    planAndExecute(t, []TunnelConfig{{TunnelID: "1", SrcAddr: "2001:db8::10", DstAddr: "2001:db8::2", VlanID: "100"}})
+    want := map[string]float64{labels("command", "ifconfig", "action", "tunnel"): 1}
+    if got := metrics.series("eipconf_command_failures_total"); !reflect.DeepEqual(got, want) {
+        t.Errorf("eipconf_command_failures_total = %v, want %v", got, want)
+    }
+}
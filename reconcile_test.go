@@ -0,0 +1,894 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// configServer はETagつきで設定を返すHTTPサーバー。If-None-Matchが一致すれば304を返す
+type configServer struct {
+    mu       sync.Mutex
+    body     string
+    status   int // 0以外ならこのステータスだけを返す
+    requests int
+}
+
+func (s *configServer) set(body string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.body = body
+}
+
+func (s *configServer) fail(status int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.status = status
+}
+
+func (s *configServer) count() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.requests
+}
+
+func (s *configServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.requests++
+    if s.status != 0 {
+        w.WriteHeader(s.status)
+        return
+    }
+    sum := sha256.Sum256([]byte(s.body))
+    etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+    if r.Header.Get("If-None-Match") == etag {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Content-Type", "application/json")
+    w.Write([]byte(s.body))
+}
+
+// useFakeDaemon はFakeExecutorのホストと設定を返すHTTPサーバーを用意し、
+// デーモンのサイクルをまたぐ状態を空から始める
+func useFakeDaemon(t *testing.T, body string) (*FakeExecutor, *configServer, *Settings) {
+    t.Helper()
+    fake := useFakeHost(t)
+    server := &configServer{body: body}
+    srv := httptest.NewServer(server)
+    t.Cleanup(srv.Close)
+
+    savedFetchState, savedSources, savedPending, savedHealth := fetchState, sources, pendingRemovals, health
+    t.Cleanup(func() {
+        fetchState, sources, pendingRemovals, health = savedFetchState, savedSources, savedPending, savedHealth
+    })
+    fetchState = configFetchState{}
+    sources = &sourceTracker{states: make(map[string]*SourceState)}
+    pendingRemovals = newRemovalTracker()
+    health = &healthState{}
+
+    settings := &Settings{
+        ConfigSource:       srv.URL + "/config.json",
+        ConfigSources:      []string{srv.URL + "/config.json"},
+        PhysicalIface:      "em2",
+        StateDir:           t.TempDir(),
+        FetchInterval:      30,
+        DriftCheckInterval: 3600,
+    }
+    return fake, server, settings
+}
+
+const (
+    configTunnel1      = `[{"tunnel_id": "1", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.1", "vlan_id": "100"}]`
+    configTunnels1and2 = `[{"tunnel_id": "1", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.1", "vlan_id": "100"},
+                          {"tunnel_id": "2", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.2", "vlan_id": "101"}]`
+)
+
+// tunnelList はtunnel_idがidsのトンネルの設定を作る。宛先とVLANはconfigTunnels1and2と同じ規則
+func tunnelList(ids ...int) string {
+    entries := make([]string, 0, len(ids))
+    for _, id := range ids {
+        entries = append(entries, fmt.Sprintf(`{"tunnel_id": "%d", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.%d", "vlan_id": "%d"}`, id, id, 99+id))
+    }
+    return "[" + strings.Join(entries, ",") + "]"
+}
+
+func TestReconcileFetchAndApply(t *testing.T) {
+    _, server, settings := useFakeDaemon(t, configTunnels1and2)
+
+    result, err := reconcile(settings, true)
+    if err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if result.Result == nil || result.Result.Count("applied") != 2 {
+        t.Fatalf("first cycle result = %+v, want 2 tunnels applied", result.Result)
+    }
+    want := map[string]string{"gif1": "192.0.2.10 198.51.100.1", "em2.100": "100", "bridge1": "em2.100,gif1",
+        "gif2": "192.0.2.10 198.51.100.2", "em2.101": "101", "bridge2": "em2.101,gif2"}
+    if got := hostState(t); !reflect.DeepEqual(got, want) {
+        t.Errorf("state after first cycle:\n got %v\nwant %v", got, want)
+    }
+
+    // 設定が変わっていなければ、drift_check_intervalの間はインターフェイスを読まない
+    result, err = reconcile(settings, true)
+    if err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if !result.Skipped {
+        t.Errorf("unchanged config not skipped: %+v", result)
+    }
+
+    server.set(configTunnel1)
+    result, err = reconcile(settings, true)
+    if err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if result.Skipped || len(result.Plan.Removals) != 2 {
+        t.Fatalf("removal cycle = %+v, want gif2 and bridge2 removed", result)
+    }
+    want = map[string]string{"gif1": "192.0.2.10 198.51.100.1", "em2.100": "100", "bridge1": "em2.100,gif1"}
+    if got := hostState(t); !reflect.DeepEqual(got, want) {
+        t.Errorf("state after removal:\n got %v\nwant %v", got, want)
+    }
+}
+
+func TestReconcileKeepsConfigWhenSourceFails(t *testing.T) {
+    _, server, settings := useFakeDaemon(t, configTunnel1)
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+
+    // 壊れた設定は受け入れず、キャッシュした設定のまま動く
+    server.set(`[{"tunnel_id": `)
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if !fetchState.usingCache {
+        t.Errorf("broken config accepted instead of the cached config")
+    }
+    if _, exists := hostState(t)["gif1"]; !exists {
+        t.Errorf("gif1 removed after broken config")
+    }
+}
+
+func TestReconcileConfigCache(t *testing.T) {
+    tests := []struct {
+        name               string
+        restart            bool   // 失敗する前に再起動する
+        corrupt            bool   // キャッシュの内容を書き換える
+        broken             string // 空でなければソースはこの設定を返し、空なら503を返す
+        cacheAfterFailures int
+        failures           int
+        wantCache          bool
+    }{
+        {name: "startup without source", restart: true, cacheAfterFailures: 3, failures: 1, wantCache: true},
+        {name: "startup with unparsable config", restart: true, broken: `[{"tunnel_id": `, cacheAfterFailures: 3, failures: 1, wantCache: true},
+        {name: "running before cache_after_failures", cacheAfterFailures: 3, failures: 2},
+        {name: "running after cache_after_failures", cacheAfterFailures: 3, failures: 3, wantCache: true},
+        {name: "corrupted cache", restart: true, corrupt: true, cacheAfterFailures: 3, failures: 3},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fake, server, settings := useFakeDaemon(t, configTunnels1and2)
+            settings.CacheAfterFailures = tt.cacheAfterFailures
+            if _, err := reconcile(settings, true); err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            applied := hostState(t)
+
+            if tt.restart {
+                fetchState = configFetchState{}
+                sources = &sourceTracker{states: make(map[string]*SourceState)}
+            }
+            if tt.corrupt {
+                data, err := os.ReadFile(configCachePath(settings))
+                if err != nil {
+                    t.Fatal(err)
+                }
+                data = []byte(strings.Replace(string(data), "198.51.100.2", "198.51.100.3", 1))
+                if err := os.WriteFile(configCachePath(settings), data, 0644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if tt.broken != "" {
+                server.set(tt.broken)
+            } else {
+                server.fail(http.StatusServiceUnavailable)
+            }
+            // キャッシュを使えばなくなったgif2を作り直す
+            ifconfig(t, fake, "gif2", "destroy")
+
+            var err error
+            for i := 0; i < tt.failures; i++ {
+                _, err = reconcile(settings, true)
+            }
+            _, exists := hostState(t)["gif2"]
+            if tt.wantCache {
+                if err != nil || !fetchState.usingCache {
+                    t.Fatalf("reconcile = %v, usingCache %v, want running from the cache", err, fetchState.usingCache)
+                }
+                if got := hostState(t); !reflect.DeepEqual(got, applied) {
+                    t.Errorf("state from cache:\n got %v\nwant %v", got, applied)
+                }
+                return
+            }
+            if err == nil || fetchState.usingCache || exists {
+                t.Errorf("reconcile = %v, usingCache %v, gif2 recreated %v, want an error without the cache", err, fetchState.usingCache, exists)
+            }
+        })
+    }
+}
+
+func TestConfigFetcherGet(t *testing.T) {
+    tokenFile := filepath.Join(t.TempDir(), "token")
+    if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("EIPCONF_TEST_BASIC_AUTH", "eipconf:secret")
+    t.Setenv("EIPCONF_TEST_BAD_BASIC_AUTH", "eipconf")
+
+    ok := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, configTunnel1) }
+    tests := []struct {
+        name       string
+        handler    http.HandlerFunc
+        settings   Settings
+        validators sourceValidators
+        tune       func(f *configFetcher)
+        wantErr    string // 空なら本文を返す
+    }{
+        {name: "ok", handler: ok},
+        {name: "not found", handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) }, wantErr: "returned client error: 404 Not Found"},
+        {name: "unauthorized", handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusUnauthorized) }, wantErr: "rejected the credentials: 401 Unauthorized"},
+        {name: "server error", handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) }, wantErr: "returned server error: 502 Bad Gateway"},
+        {name: "not modified without validators", handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotModified) },
+            wantErr: "returned unexpected status: 304 Not Modified"},
+        {name: "not modified", handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotModified) },
+            validators: sourceValidators{etag: `"1"`}, wantErr: errNotModified.Error()},
+        {name: "content length over fetch_max_bytes", handler: ok, settings: Settings{FetchMaxBytes: 10}, wantErr: "bytes, larger than fetch_max_bytes 10"},
+        {name: "chunked body over fetch_max_bytes", settings: Settings{FetchMaxBytes: 10}, wantErr: "is larger than fetch_max_bytes 10",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                io.WriteString(w, "[")
+                w.(http.Flusher).Flush()
+                io.WriteString(w, strings.Repeat(" ", 20)+"]")
+            }},
+        {name: "bearer token", settings: Settings{FetchBearerTokenFile: tokenFile},
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                if r.Header.Get("Authorization") != "Bearer secret" {
+                    w.WriteHeader(http.StatusUnauthorized)
+                    return
+                }
+                ok(w, r)
+            }},
+        {name: "basic auth", settings: Settings{FetchBasicAuthEnv: "EIPCONF_TEST_BASIC_AUTH"},
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                if user, password, _ := r.BasicAuth(); user != "eipconf" || password != "secret" {
+                    w.WriteHeader(http.StatusUnauthorized)
+                    return
+                }
+                ok(w, r)
+            }},
+        {name: "malformed basic auth", handler: ok, settings: Settings{FetchBasicAuthEnv: "EIPCONF_TEST_BAD_BASIC_AUTH"}, wantErr: "basic auth credentials must be USER:PASSWORD"},
+        {name: "missing credentials", handler: ok, settings: Settings{FetchBearerTokenEnv: "EIPCONF_TEST_NO_TOKEN"},
+            wantErr: "environment variable EIPCONF_TEST_NO_TOKEN for credentials is not set"},
+        {name: "timeout", wantErr: "after fetch_timeout",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                select {
+                case <-r.Context().Done():
+                case <-time.After(time.Second):
+                }
+            },
+            tune: func(f *configFetcher) { f.timeout, f.client.Timeout = 50*time.Millisecond, 50*time.Millisecond }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv := httptest.NewServer(tt.handler)
+            defer srv.Close()
+            settings := tt.settings
+            settings.FetchConnectTimeout, settings.FetchTimeout = 5, 5
+            if settings.FetchMaxBytes == 0 {
+                settings.FetchMaxBytes = 1 << 20
+            }
+            f, err := newConfigFetcher(&settings)
+            if err != nil {
+                t.Fatalf("newConfigFetcher: %v", err)
+            }
+            if tt.tune != nil {
+                tt.tune(f)
+            }
+
+            body, _, _, err := f.get(srv.URL+"/config.json", tt.validators)
+            if tt.wantErr == "" {
+                if err != nil || string(body) != configTunnel1 {
+                    t.Errorf("get = %q, %v, want the config", body, err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("get = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+
+    srv := httptest.NewServer(http.HandlerFunc(ok))
+    srv.Close()
+    if _, _, _, err := mustConfigFetcher(&Settings{FetchConnectTimeout: 5, FetchTimeout: 5, FetchMaxBytes: 1 << 20}).get(srv.URL, sourceValidators{}); err == nil ||
+        !strings.Contains(err.Error(), "failed to connect to") {
+        t.Errorf("get from a closed server = %v, want a connection error", err)
+    }
+}
+
+func TestNewConfigFetcherRejectsSettings(t *testing.T) {
+    tests := []struct {
+        name     string
+        settings Settings
+        wantErr  string
+    }{
+        {name: "bearer token and basic auth", settings: Settings{FetchBearerTokenEnv: "A", FetchBasicAuthEnv: "B"}, wantErr: "bearer token and basic auth cannot be used together"},
+        {name: "token file and env", settings: Settings{FetchBearerTokenFile: "/a", FetchBearerTokenEnv: "A"}, wantErr: "either from a file or from an environment variable"},
+        {name: "client cert without key", settings: Settings{FetchClientCert: "/cert.pem"}, wantErr: "fetch_client_cert and fetch_client_key must be set together"},
+        {name: "missing CA file", settings: Settings{FetchCAFile: "/nonexistent/ca.pem"}, wantErr: "failed to read fetch_ca_file"},
+        {name: "invalid proxy", settings: Settings{FetchProxy: "://proxy"}, wantErr: "invalid fetch_proxy"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := newConfigFetcher(&tt.settings); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("newConfigFetcher = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestSourceTrackerOrder(t *testing.T) {
+    settings := &Settings{ConfigSources: []string{"primary", "secondary"}, FetchInterval: 30}
+    failure := fmt.Errorf("unavailable")
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    type result struct {
+        source string
+        err    error
+        at     time.Duration // startからの時間
+    }
+    tests := []struct {
+        name    string
+        results []result
+        at      time.Duration
+        want    []string
+    }{
+        {name: "no failures", want: []string{"primary", "secondary"}},
+        {name: "primary backing off", results: []result{{"primary", failure, 0}}, at: 29 * time.Second, want: []string{"secondary"}},
+        {name: "primary backoff expired", results: []result{{"primary", failure, 0}}, at: 30 * time.Second, want: []string{"primary", "secondary"}},
+        {name: "backoff grows with failures", results: []result{{"primary", failure, 0}, {"primary", failure, 30 * time.Second}},
+            at: 89 * time.Second, want: []string{"secondary"}},
+        {name: "backoff is capped at 10 fetch intervals", results: []result{{"primary", failure, 0}, {"primary", failure, 0}, {"primary", failure, 0},
+            {"primary", failure, 0}, {"primary", failure, 0}, {"primary", failure, 0}, {"primary", failure, 0}, {"primary", failure, 0},
+            {"primary", failure, 0}, {"primary", failure, 0}, {"primary", failure, 0}, {"primary", failure, 0}}, at: 300 * time.Second,
+            want: []string{"primary", "secondary"}},
+        {name: "success clears backoff", results: []result{{"primary", failure, 0}, {"primary", nil, time.Second}}, at: 2 * time.Second,
+            want: []string{"primary", "secondary"}},
+        {name: "all backing off tries the soonest", results: []result{{"secondary", failure, 0}, {"primary", failure, 10 * time.Second}},
+            at: 20 * time.Second, want: []string{"secondary"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tracker := &sourceTracker{states: make(map[string]*SourceState)}
+            for _, r := range tt.results {
+                tracker.record(settings, r.source, r.err, start.Add(r.at))
+            }
+            if got := tracker.order(settings, start.Add(tt.at)); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("order = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestReconcileSourceFailover(t *testing.T) {
+    _, primary, settings := useFakeDaemon(t, configTunnels1and2)
+    secondary := &configServer{body: configTunnel1}
+    srv := httptest.NewServer(secondary)
+    t.Cleanup(srv.Close)
+    settings.ConfigSources = append(settings.ConfigSources, srv.URL+"/config.json")
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+
+    // プライマリが失敗すればセカンダリの設定を適用し、待ち時間の間はプライマリを試さない
+    primary.fail(http.StatusServiceUnavailable)
+    result, err := reconcile(settings, true)
+    if err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if result.Source != settings.ConfigSources[1] || sources.Active(settings) != settings.ConfigSources[1] {
+        t.Errorf("source = %s, active = %s, want the secondary", result.Source, sources.Active(settings))
+    }
+    if _, exists := hostState(t)["gif2"]; exists {
+        t.Errorf("config of the secondary not applied")
+    }
+    requests := primary.count()
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if primary.count() != requests {
+        t.Errorf("primary fetched during its backoff")
+    }
+
+    // 待ち時間が過ぎて回復していればプライマリに戻る
+    primary.fail(0)
+    sources.states[settings.ConfigSources[0]].RetryAt = nil
+    if result, err = reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if result.Source != settings.ConfigSources[0] {
+        t.Errorf("source = %s, want the primary", result.Source)
+    }
+    if _, exists := hostState(t)["gif2"]; !exists {
+        t.Errorf("config of the primary not applied")
+    }
+
+    // すべてのソースが失敗すればエラーをまとめる
+    primary.fail(http.StatusServiceUnavailable)
+    secondary.fail(http.StatusServiceUnavailable)
+    settings.CacheAfterFailures = 3
+    if _, err := reconcile(settings, true); err == nil || !strings.Contains(err.Error(), "no config source available") {
+        t.Errorf("reconcile = %v, want no config source available", err)
+    }
+}
+
+func TestBuildStatus(t *testing.T) {
+    fake, server, settings := useFakeDaemon(t, tunnelList(1, 2, 3))
+    settings.ControlSocket = "none"
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    ifconfig(t, fake, "gif2", "tunnel", "192.0.2.10", "203.0.113.2")
+    ifconfig(t, fake, "em2.102", "destroy")
+    ifconfig(t, fake, "gif9", "create")
+
+    // ソースから取得できなければキャッシュした設定と突き合わせる
+    server.fail(http.StatusServiceUnavailable)
+    report, err := buildStatus(settings, false)
+    if err != nil {
+        t.Fatalf("buildStatus: %v", err)
+    }
+    if !report.FromCache || report.ConfigFetchedAt == nil {
+        t.Errorf("from_cache = %v, config_fetched_at = %v, want the cached config", report.FromCache, report.ConfigFetchedAt)
+    }
+
+    tests := []struct {
+        tunnelID    string
+        wantDesired bool
+        wantLink    string
+        wantChanges []string
+    }{
+        {tunnelID: "1", wantDesired: true, wantLink: "up"},
+        {tunnelID: "2", wantDesired: true, wantLink: "up", wantChanges: []string{"modify gif gif2: dst_addr=203.0.113.2 -> 198.51.100.2"}},
+        {tunnelID: "3", wantDesired: true, wantLink: "em2.102 missing",
+            wantChanges: []string{"create vlan em2.102: vlan_id=102", "modify bridge bridge3: members=gif3 -> gif3,em2.102"}},
+        {tunnelID: "9", wantLink: "gif9 down", wantChanges: []string{"conflict: gif gif9: not in config and not created by eipconf, skipping removal"}},
+    }
+    if len(report.Tunnels) != len(tests) {
+        t.Fatalf("%d tunnels in status, want %d: %+v", len(report.Tunnels), len(tests), report.Tunnels)
+    }
+    for i, tt := range tests {
+        got := report.Tunnels[i]
+        if got.TunnelID != tt.tunnelID || (got.Desired != nil) != tt.wantDesired || got.Link != tt.wantLink ||
+            !reflect.DeepEqual(got.Changes, tt.wantChanges) || got.Drift != (len(tt.wantChanges) > 0) {
+            t.Errorf("tunnel %d = %+v, want tunnel_id %s, desired %v, link %q, changes %v", i, got, tt.tunnelID, tt.wantDesired, tt.wantLink, tt.wantChanges)
+        }
+    }
+
+    // 状態の確認ではインターフェイスを変更しない
+    if _, exists := hostState(t)["em2.102"]; exists {
+        t.Errorf("buildStatus created em2.102")
+    }
+}
+
+func TestReconcileRecordsSerialOnlyWhenApplied(t *testing.T) {
+    fake, _, settings := useFakeDaemon(t, `{"version": 1, "serial": 2, "tunnels": `+configTunnel1+`}`)
+    savedMetrics := metrics
+    t.Cleanup(func() { metrics = savedMetrics })
+    metrics = &metricSet{values: make(map[string]map[string]float64)}
+
+    // すべてのトンネルがロールバックしたサイクルのシリアル番号は記録しない
+    fake.FailOn("bridge1 addm", 3, "")
+    result, err := reconcile(settings, true)
+    if err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if result.Result == nil || result.Result.Count("rolled_back") != 1 {
+        t.Fatalf("first cycle result = %+v, want tunnel 1 rolled back", result.Result)
+    }
+    if applied, _ := loadAppliedSerial(settings); applied.Serial != 0 {
+        t.Errorf("applied serial after rollback = %d, want none", applied.Serial)
+    }
+
+    if _, err := reconcile(settings, false); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if applied, _ := loadAppliedSerial(settings); applied.Serial != 2 {
+        t.Errorf("applied serial = %d, want 2", applied.Serial)
+    }
+}
+
+func TestReconcileSerial(t *testing.T) {
+    envelope := func(serial int, tunnels string) string {
+        return fmt.Sprintf(`{"version": 1, "serial": %d, "tunnels": %s}`, serial, tunnels)
+    }
+    tests := []struct {
+        name         string
+        body         string
+        acceptSerial string // 空でなければ取得する前にeipconf accept-serialを実行する
+        wantErr      string // 空なら設定を適用する
+    }{
+        {name: "newer serial", body: envelope(6, configTunnel1)},
+        {name: "same serial", body: envelope(5, configTunnel1)},
+        {name: "older serial", body: envelope(4, configTunnel1), wantErr: "config serial 4 is older than applied serial 5"},
+        {name: "older serial after accept-serial", body: envelope(4, configTunnel1), acceptSerial: "4"},
+        {name: "no envelope", body: configTunnel1},
+        {name: "unsupported version", body: `{"version": 2, "serial": 6, "tunnels": []}`, wantErr: "unsupported config version: 2"},
+        {name: "no version", body: `{"serial": 6, "tunnels": []}`, wantErr: "config envelope has no version"},
+        {name: "no serial", body: `{"version": 1, "tunnels": []}`, wantErr: "config envelope has no serial"},
+        {name: "no tunnels", body: `{"version": 1, "serial": 6}`, wantErr: "config envelope has no tunnels"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, server, settings := useFakeDaemon(t, envelope(5, configTunnels1and2))
+            settings.CacheAfterFailures = 3
+            if _, err := reconcile(settings, true); err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            before := hostState(t)
+
+            if tt.acceptSerial != "" {
+                if err := acceptSerial(io.Discard, settings, tt.acceptSerial); err != nil {
+                    t.Fatalf("acceptSerial: %v", err)
+                }
+            }
+            server.set(tt.body)
+            _, err := reconcile(settings, true)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Errorf("reconcile = %v, want %q", err, tt.wantErr)
+                }
+                if got := hostState(t); !reflect.DeepEqual(got, before) {
+                    t.Errorf("rejected config changed state:\n got %v\nwant %v", got, before)
+                }
+                if applied, _ := loadAppliedSerial(settings); applied.Serial != 5 {
+                    t.Errorf("applied serial = %d, want 5", applied.Serial)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            if _, exists := hostState(t)["gif2"]; exists {
+                t.Errorf("config not applied, gif2 still exists")
+            }
+        })
+    }
+}
+
+func TestReconcileSignature(t *testing.T) {
+    key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+    otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+    publicKey := func(k ed25519.PrivateKey) string {
+        return base64.StdEncoding.EncodeToString(k.Public().(ed25519.PublicKey))
+    }
+    sign := func(k ed25519.PrivateKey, message string) string {
+        return base64.StdEncoding.EncodeToString(ed25519.Sign(k, []byte(message)))
+    }
+    // signedEnvelope は封筒の署名をつけた設定を作る。署名したものと違うtunnelsを書けば改ざんした設定になる
+    signedEnvelope := func(k ed25519.PrivateKey, serial int, signed, tunnels string) string {
+        signature := sign(k, fmt.Sprintf("eipconf-config-v1\nserial=%d\ngenerated_at=\n%s", serial, signed))
+        return fmt.Sprintf(`{"version": 1, "serial": %d, "tunnels": %s, "signature": "%s"}`, serial, tunnels, signature)
+    }
+
+    tests := []struct {
+        name      string
+        body      string
+        detached  string   // 空でなければsignature_sourceのファイルの内容
+        keys      []string // 空ならkeyだけを信頼する
+        wantError string   // 空なら設定を適用する
+    }{
+        {name: "signed envelope", body: signedEnvelope(key, 2, configTunnel1, configTunnel1)},
+        {name: "second trusted key", body: signedEnvelope(key, 2, configTunnel1, configTunnel1), keys: []string{publicKey(otherKey), publicKey(key)}},
+        {name: "unsigned envelope", body: `{"version": 1, "serial": 2, "tunnels": ` + configTunnel1 + `}`, wantError: "config is not signed"},
+        {name: "unsigned list", body: configTunnel1, wantError: "config is not signed"},
+        {name: "untrusted key", body: signedEnvelope(otherKey, 2, configTunnel1, configTunnel1), wantError: "does not match any of the trusted keys"},
+        {name: "tampered tunnels", body: signedEnvelope(key, 2, configTunnel1, tunnelList(1, 3)), wantError: "does not match any of the trusted keys"},
+        {name: "malformed signature", body: `{"version": 1, "serial": 2, "tunnels": [], "signature": "c2lnbmF0dXJl"}`, wantError: "not a base64 ed25519 signature"},
+        {name: "malformed trusted key", body: signedEnvelope(key, 2, configTunnel1, configTunnel1), keys: []string{"a2V5"}, wantError: "trusted_keys[0] is not a base64 ed25519 public key"},
+        {name: "detached signature", body: configTunnel1, detached: sign(key, configTunnel1)},
+        {name: "detached signature of other content", body: configTunnel1, detached: sign(key, configTunnels1and2), wantError: "does not match any of the trusted keys"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, server, settings := useFakeDaemon(t, signedEnvelope(key, 1, configTunnels1and2, configTunnels1and2))
+            settings.TrustedKeys = []string{publicKey(key)}
+            settings.CacheAfterFailures = 3
+            if _, err := reconcile(settings, true); err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            before := hostState(t)
+
+            if tt.keys != nil {
+                settings.TrustedKeys = tt.keys
+            }
+            if tt.detached != "" {
+                settings.SignatureSource = filepath.Join(t.TempDir(), "config.json.sig")
+                if err := os.WriteFile(settings.SignatureSource, []byte(tt.detached), 0644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            server.set(tt.body)
+            _, err := reconcile(settings, true)
+            if tt.wantError != "" {
+                if !isSignatureError(err) || !strings.Contains(err.Error(), tt.wantError) {
+                    t.Errorf("reconcile = %v, want signature rejected: %s", err, tt.wantError)
+                }
+                if got := hostState(t); !reflect.DeepEqual(got, before) {
+                    t.Errorf("rejected config changed state:\n got %v\nwant %v", got, before)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            if _, exists := hostState(t)["gif2"]; exists {
+                t.Errorf("config not applied, gif2 still exists")
+            }
+        })
+    }
+}
+
+func TestReconcileCountsAppliedChanges(t *testing.T) {
+    fake, server, settings := useFakeDaemon(t, configTunnels1and2)
+    savedMetrics := metrics
+    t.Cleanup(func() { metrics = savedMetrics })
+    metrics = &metricSet{values: make(map[string]map[string]float64)}
+    changes := func(n float64) map[string]float64 {
+        return map[string]float64{labels("kind", "gif", "action", "create"): n, labels("kind", "vlan", "action", "create"): n,
+            labels("kind", "bridge", "action", "create"): n}
+    }
+
+    // ロールバックしたトンネル2の変更は数えない
+    fake.FailOn("em2.101 create", 3, "")
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if got := metrics.series("eipconf_changes_total"); !reflect.DeepEqual(got, changes(1)) {
+        t.Errorf("eipconf_changes_total after rollback = %v, want %v", got, changes(1))
+    }
+    if _, err := reconcile(settings, false); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if got := metrics.series("eipconf_changes_total"); !reflect.DeepEqual(got, changes(2)) {
+        t.Errorf("eipconf_changes_total = %v, want %v", got, changes(2))
+    }
+
+    // 保留した計画の変更は数えない
+    settings.MaxRemovals, settings.AllowEmptyConfig = 1, true
+    server.set(`[]`)
+    for i := 0; i < 2; i++ {
+        if result, err := reconcile(settings, true); err != nil || result.HeldReason == "" {
+            t.Fatalf("removal cycle = %+v, %v, want held", result, err)
+        }
+    }
+    if got := metrics.series("eipconf_changes_total"); !reflect.DeepEqual(got, changes(2)) {
+        t.Errorf("eipconf_changes_total after held cycles = %v, want %v", got, changes(2))
+    }
+}
+
+// removal_hold_down_fetchesはソースから設定を取得したか、304で確かめたサイクルだけを数える
+func TestRemovalHoldDownCountsFetchedConfigs(t *testing.T) {
+    _, server, settings := useFakeDaemon(t, configTunnels1and2)
+    settings.RemovalHoldDownFetches = 3
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    pending := func(result CycleResult, err error) int {
+        t.Helper()
+        if err != nil {
+            t.Fatalf("cycle: %v", err)
+        }
+        if len(result.Plan.Pending) != 1 {
+            t.Fatalf("pending = %+v, want tunnel 2", result.Plan.Pending)
+        }
+        return result.Plan.Pending[0].Fetches
+    }
+
+    server.set(configTunnel1)
+    if got := pending(reconcile(settings, true)); got != 1 {
+        t.Errorf("fetches after the config changed = %d, want 1", got)
+    }
+    if got := pending(reconfigureAfterReset("test", nil, settings)); got != 1 {
+        t.Errorf("fetches after a reset = %d, want 1", got)
+    }
+    server.set(`[{"tunnel_id": `)
+    if got := pending(reconcile(settings, true)); got != 1 || !fetchState.usingCache {
+        t.Errorf("fetches while running from the cache = %d, want 1", got)
+    }
+    server.set(configTunnel1)
+    if got := pending(reconcile(settings, true)); got != 2 {
+        t.Errorf("fetches after the source recovered = %d, want 2", got)
+    }
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    if _, exists := hostState(t)["gif2"]; exists {
+        t.Errorf("gif2 not removed after 3 fetches")
+    }
+}
+
+func TestReconcileSafeguards(t *testing.T) {
+    tests := []struct {
+        name     string
+        config   string
+        setup    func(settings *Settings)
+        wantHeld string // 空なら適用する
+    }{
+        {name: "empty config", config: `[]`, wantHeld: "config has no tunnels and would remove all 4 tunnel(s)"},
+        {name: "empty config allowed", config: `[]`, setup: func(s *Settings) { s.AllowEmptyConfig = true }},
+        {name: "more than max_removals", config: tunnelList(1, 2), setup: func(s *Settings) { s.MaxRemovals = 1 },
+            wantHeld: "would remove 2 tunnel(s), more than max_removals 1"},
+        {name: "max_removals", config: tunnelList(1, 2), setup: func(s *Settings) { s.MaxRemovals = 2 }},
+        {name: "more than max_removal_percent", config: tunnelList(1, 2), setup: func(s *Settings) { s.MaxRemovalPercent = 25 },
+            wantHeld: "would remove 2 of 4 tunnel(s), more than max_removal_percent 25%"},
+        {name: "max_removal_percent", config: tunnelList(1, 2), setup: func(s *Settings) { s.MaxRemovalPercent = 50 }},
+        {name: "additions are not limited", config: tunnelList(1, 2, 3, 4, 5, 6), setup: func(s *Settings) { s.MaxRemovals, s.MaxRemovalPercent = 1, 1 }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, server, settings := useFakeDaemon(t, tunnelList(1, 2, 3, 4))
+            if _, err := reconcile(settings, true); err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            before := hostState(t)
+            if tt.setup != nil {
+                tt.setup(settings)
+            }
+
+            server.set(tt.config)
+            result, err := reconcile(settings, true)
+            if err != nil {
+                t.Fatalf("reconcile: %v", err)
+            }
+            if result.HeldReason != tt.wantHeld {
+                t.Fatalf("held reason = %q, want %q", result.HeldReason, tt.wantHeld)
+            }
+            _, heldErr := loadHeldPlan(settings)
+            if tt.wantHeld != "" {
+                if heldErr != nil {
+                    t.Errorf("held plan not saved: %v", heldErr)
+                }
+                if got := hostState(t); !reflect.DeepEqual(got, before) {
+                    t.Errorf("held cycle changed state:\n got %v\nwant %v", got, before)
+                }
+                return
+            }
+            if heldErr == nil {
+                t.Errorf("held plan saved for an allowed change")
+            }
+            if got, want := len(hostState(t)), 3*strings.Count(tt.config, "tunnel_id"); got != want {
+                t.Errorf("%d interfaces after the cycle, want %d", got, want)
+            }
+        })
+    }
+}
+
+func TestHeldPlanApproval(t *testing.T) {
+    _, server, settings := useFakeDaemon(t, tunnelList(1, 2, 3))
+    settings.MaxRemovals = 1
+    if _, err := reconcile(settings, true); err != nil {
+        t.Fatalf("reconcile: %v", err)
+    }
+    server.set(configTunnel1)
+    if result, err := reconcile(settings, true); err != nil || result.HeldReason == "" {
+        t.Fatalf("removal cycle = %+v, %v, want held", result, err)
+    }
+    held, err := loadHeldPlan(settings)
+    if err != nil {
+        t.Fatalf("loadHeldPlan: %v", err)
+    }
+
+    if err := approveHeldPlan(io.Discard, settings, "000000000000"); err == nil {
+        t.Errorf("approved a plan with another id")
+    }
+    // 承認した後に削除対象が変わった計画は、改めて承認するまで保留する
+    if err := approveHeldPlan(io.Discard, settings, held.ID); err != nil {
+        t.Fatalf("approveHeldPlan: %v", err)
+    }
+    server.set(`[]`)
+    settings.AllowEmptyConfig = true
+    if result, err := reconcile(settings, true); err != nil || result.HeldReason == "" {
+        t.Fatalf("cycle with other removals = %+v, %v, want held", result, err)
+    }
+    if _, exists := hostState(t)["gif1"]; !exists {
+        t.Errorf("gif1 removed by an approval of another plan")
+    }
+
+    // 承認は同じ削除対象の計画に戻れば有効
+    server.set(configTunnel1)
+    if result, err := reconcile(settings, true); err != nil || result.HeldReason != "" {
+        t.Fatalf("approved cycle = %+v, %v, want applied", result, err)
+    }
+    want := map[string]string{"gif1": "192.0.2.10 198.51.100.1", "em2.100": "100", "bridge1": "em2.100,gif1"}
+    if got := hostState(t); !reflect.DeepEqual(got, want) {
+        t.Errorf("state after approval:\n got %v\nwant %v", got, want)
+    }
+    if err := approveHeldPlan(io.Discard, settings, ""); err == nil {
+        t.Errorf("approved a plan after the held change was applied")
+    }
+}
+
+// 設定が変わっていなくても、ホールドダウン中の削除と承認された計画は次のサイクルで進める
+func TestReconcileNotModifiedKeepsPendingWork(t *testing.T) {
+    t.Run("removal hold-down", func(t *testing.T) {
+        _, server, settings := useFakeDaemon(t, configTunnels1and2)
+        settings.RemovalHoldDownFetches = 2
+        if _, err := reconcile(settings, true); err != nil {
+            t.Fatalf("reconcile: %v", err)
+        }
+        server.set(configTunnel1)
+        if result, err := reconcile(settings, true); err != nil || len(result.Plan.Pending) != 1 {
+            t.Fatalf("removal cycle = %+v, %v, want tunnel 2 pending", result, err)
+        }
+
+        result, err := reconcile(settings, true)
+        if err != nil {
+            t.Fatalf("reconcile: %v", err)
+        }
+        if result.Skipped {
+            t.Fatalf("304 skipped the pending removal")
+        }
+        if _, exists := hostState(t)["gif2"]; exists {
+            t.Errorf("gif2 not removed after hold-down")
+        }
+        if result, _ := reconcile(settings, true); !result.Skipped {
+            t.Errorf("cycle after hold-down not skipped: %+v", result)
+        }
+    })
+
+    t.Run("approved held plan", func(t *testing.T) {
+        _, server, settings := useFakeDaemon(t, configTunnels1and2)
+        settings.MaxRemovals = 1
+        if _, err := reconcile(settings, true); err != nil {
+            t.Fatalf("reconcile: %v", err)
+        }
+        server.set(`[]`)
+        settings.AllowEmptyConfig = true
+        if result, err := reconcile(settings, true); err != nil || result.HeldReason == "" {
+            t.Fatalf("removal cycle = %+v, %v, want held", result, err)
+        }
+        if result, _ := reconcile(settings, true); result.Skipped || result.HeldReason == "" {
+            t.Errorf("held cycle after 304 = %+v, want held again", result)
+        }
+
+        if err := approveHeldPlan(io.Discard, settings, ""); err != nil {
+            t.Fatalf("approve: %v", err)
+        }
+        result, err := reconcile(settings, true)
+        if err != nil {
+            t.Fatalf("reconcile: %v", err)
+        }
+        if result.Skipped || result.HeldReason != "" {
+            t.Fatalf("approved cycle = %+v, want applied", result)
+        }
+        if got := hostState(t); len(got) != 0 {
+            t.Errorf("state after approved removal = %v, want empty", got)
+        }
+    })
+}
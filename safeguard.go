@@ -0,0 +1,168 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// HeldPlan はセーフガードで適用を止めた変更計画
+// state_dirに保存し、eipconf approveで承認されると次のサイクルで適用する
+type HeldPlan struct {
+    ID       string    `json:"id"`
+    Reason   string    `json:"reason"`
+    HeldAt   time.Time `json:"held_at"`
+    Tunnels  int       `json:"tunnels"`  // 現在のトンネル数
+    Desired  int       `json:"desired"`  // 設定にあるトンネル数
+    Removals []string  `json:"removals"` // 削除されるインターフェイス
+}
+
+// PlanApproval は運用者による承認。IDが保留中の計画と一致する場合だけ有効
+type PlanApproval struct {
+    ID         string    `json:"id"`
+    ApprovedAt time.Time `json:"approved_at"`
+}
+
+func heldPlanPath(settings *Settings) string {
+    return filepath.Join(settings.StateDir, "held-plan.json")
+}
+
+func approvalPath(settings *Settings) string {
+    return filepath.Join(settings.StateDir, "approval.json")
+}
+
+// removalsOf は計画で削除されるインターフェイスを名前順に返す
+func removalsOf(plan *ReconcilePlan) []string {
+    removals := []string{}
+    for _, c := range append(append([]Change{}, plan.Removals...), plan.Cleanup...) {
+        removals = append(removals, c.Iface)
+    }
+    sort.Strings(removals)
+    return removals
+}
+
+// planID は削除対象から計画を識別する値を作る。削除対象が変われば承認をやり直す
+func planID(removals []string) string {
+    sum := sha256.Sum256([]byte(strings.Join(removals, "\n")))
+    return hex.EncodeToString(sum[:])[:12]
+}
+
+// checkSafeguards は1サイクルで削除するトンネルが多すぎないかを確認し、止める理由を返す
+// 問題がなければ空文字列
+func checkSafeguards(plan *ReconcilePlan, configs []TunnelConfig, currentGifs map[string]InterfaceConfig, settings *Settings) string {
+    removed := 0
+    for _, c := range plan.Removals {
+        if c.Kind == "gif" {
+            removed++
+        }
+    }
+    if removed == 0 {
+        return ""
+    }
+    if len(configs) == 0 && !settings.AllowEmptyConfig {
+        return fmt.Sprintf("config has no tunnels and would remove all %d tunnel(s)", removed)
+    }
+    if settings.MaxRemovals > 0 && removed > settings.MaxRemovals {
+        return fmt.Sprintf("would remove %d tunnel(s), more than max_removals %d", removed, settings.MaxRemovals)
+    }
+    if settings.MaxRemovalPercent > 0 && len(currentGifs) > 0 && removed*100 > settings.MaxRemovalPercent*len(currentGifs) {
+        return fmt.Sprintf("would remove %d of %d tunnel(s), more than max_removal_percent %d%%", removed, len(currentGifs), settings.MaxRemovalPercent)
+    }
+    return ""
+}
+
+// guardPlan はセーフガードを確認し、計画を止める場合はその理由を返す。適用してよい場合は空文字列
+// 止めた場合は計画を保存してWARNで知らせる。同じ計画を止め続けている間は繰り返し知らせない
+func guardPlan(plan *ReconcilePlan, configs []TunnelConfig, currentGifs map[string]InterfaceConfig, settings *Settings) string {
+    reason := checkSafeguards(plan, configs, currentGifs, settings)
+    held, _ := loadHeldPlan(settings)
+    if reason == "" {
+        if held != nil {
+            slog.Info("Held configuration change is no longer pending", "id", held.ID)
+            os.Remove(heldPlanPath(settings))
+        }
+        return ""
+    }
+
+    removals := removalsOf(plan)
+    id := planID(removals)
+    if approval, err := loadApproval(settings); err == nil && approval.ID == id {
+        slog.Warn("Applying held configuration change approved by operator", "id", id, "reason", reason, "approved_at", approval.ApprovedAt, "removals", strings.Join(removals, ","))
+        os.Remove(approvalPath(settings))
+        os.Remove(heldPlanPath(settings))
+        return ""
+    }
+
+    if held != nil && held.ID == id {
+        slog.Info("Configuration change still held by safeguard", "id", id, "reason", reason)
+        return reason
+    }
+    held = &HeldPlan{ID: id, Reason: reason, HeldAt: time.Now(), Tunnels: len(currentGifs), Desired: len(configs), Removals: removals}
+    data, err := json.MarshalIndent(held, "", "  ")
+    if err == nil {
+        err = writeStateFile(heldPlanPath(settings), data)
+    }
+    if err != nil {
+        slog.Error("Failed to save held plan", "path", heldPlanPath(settings), "error", err)
+    }
+    slog.Warn("Configuration change held by safeguard, run 'eipconf approve' to apply it", "id", id, "reason", reason, "removals", strings.Join(removals, ","))
+    return reason
+}
+
+func loadHeldPlan(settings *Settings) (*HeldPlan, error) {
+    data, err := os.ReadFile(heldPlanPath(settings))
+    if err != nil {
+        return nil, err
+    }
+    var held HeldPlan
+    if err := json.Unmarshal(data, &held); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal held plan: %v", err)
+    }
+    return &held, nil
+}
+
+func loadApproval(settings *Settings) (*PlanApproval, error) {
+    data, err := os.ReadFile(approvalPath(settings))
+    if err != nil {
+        return nil, err
+    }
+    var approval PlanApproval
+    if err := json.Unmarshal(data, &approval); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal approval: %v", err)
+    }
+    return &approval, nil
+}
+
+// approveHeldPlan は保留中の計画を承認する。eipconf approveから呼ばれる
+// idが空でなければ保留中の計画のIDと一致する場合だけ承認する
+func approveHeldPlan(w io.Writer, settings *Settings, id string) error {
+    held, err := loadHeldPlan(settings)
+    if os.IsNotExist(err) {
+        return fmt.Errorf("no configuration change is held")
+    }
+    if err != nil {
+        return err
+    }
+    if id != "" && id != held.ID {
+        return fmt.Errorf("held change is %s, not %s", held.ID, id)
+    }
+    data, err := json.MarshalIndent(PlanApproval{ID: held.ID, ApprovedAt: time.Now()}, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := writeStateFile(approvalPath(settings), data); err != nil {
+        return err
+    }
+    fmt.Fprintf(w, "Approved held change %s (%s)\n", held.ID, held.Reason)
+    fmt.Fprintf(w, "Interfaces to be removed: %s\n", strings.Join(held.Removals, ", "))
+    fmt.Fprintln(w, "The change is applied on the next cycle; send SIGHUP to apply it now.")
+    return nil
+}
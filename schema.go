@@ -0,0 +1,252 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "reflect"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// JSON Schemaは構造体のjsonタグとjsonschemaタグから作る。jsonschemaタグは ";" 区切りで次を指定する
+//   required              必須
+//   requiredWithout=NAME  NAMEがない場合は必須
+//   enum=A|B              値の候補
+//   pattern=RE            文字列の正規表現
+//   maxLength=N           文字列の最大長
+//   minimum=N, maximum=N  数値の範囲
+//   format=ip             IPv4またはIPv6アドレス
+// 検証はvalidateSchemaで行い、ここで作るキーワードだけに対応する
+
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemas は "eipconf schema" で出力できるスキーマ
+var schemas = map[string]func() map[string]any{
+    "config":   configSchema,
+    "settings": settingsSchema,
+}
+
+// configSchema はconfig.jsonのスキーマ。トンネルの配列か、それを包んだ封筒のどちらか
+func configSchema() map[string]any {
+    return map[string]any{
+        "$schema": schemaDialect,
+        "title":   "eipconf config.json",
+        "anyOf":   []any{tunnelListSchema(), envelopeSchema()},
+    }
+}
+
+// tunnelListSchema はトンネルの配列のスキーマ
+func tunnelListSchema() map[string]any {
+    return fieldSchema(reflect.TypeOf([]TunnelConfig{}))
+}
+
+// envelopeSchema はバージョンとシリアル番号つきの設定のスキーマ
+func envelopeSchema() map[string]any {
+    return structSchema(reflect.TypeOf(ConfigEnvelope{}))
+}
+
+// settingsSchema はsettings.jsonのスキーマ
+func settingsSchema() map[string]any {
+    schema := structSchema(reflect.TypeOf(Settings{}))
+    schema["$schema"] = schemaDialect
+    schema["title"] = "eipconf settings.json"
+    return schema
+}
+
+// structSchema は構造体のフィールドからobjectのスキーマを作る。未知のフィールドは許さない
+func structSchema(t reflect.Type) map[string]any {
+    properties := make(map[string]any)
+    required := []string{}
+    var anyOf []any
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+        if name == "" || name == "-" {
+            continue
+        }
+        property := fieldSchema(field.Type)
+        for _, rule := range strings.Split(field.Tag.Get("jsonschema"), ";") {
+            key, value, _ := strings.Cut(rule, "=")
+            switch key {
+            case "required":
+                required = append(required, name)
+            case "requiredWithout":
+                anyOf = append(anyOf, map[string]any{"required": []string{name}}, map[string]any{"required": []string{value}})
+            case "enum":
+                property["enum"] = strings.Split(value, "|")
+            case "pattern":
+                property["pattern"] = value
+            case "maxLength", "minimum", "maximum":
+                n, _ := strconv.Atoi(value)
+                property[key] = n
+            case "format":
+                if value == "ip" {
+                    property["anyOf"] = []any{map[string]any{"format": "ipv4"}, map[string]any{"format": "ipv6"}}
+                }
+            }
+        }
+        properties[name] = property
+    }
+    schema := map[string]any{
+        "type":                 "object",
+        "properties":           properties,
+        "required":             required,
+        "additionalProperties": false,
+    }
+    if anyOf != nil {
+        schema["anyOf"] = anyOf
+    }
+    return schema
+}
+
+// fieldSchema は型に対応するスキーマを作る
+func fieldSchema(t reflect.Type) map[string]any {
+    switch {
+    case t == reflect.TypeOf(time.Time{}):
+        return map[string]any{"type": "string", "format": "date-time"}
+    case t.Kind() == reflect.String:
+        return map[string]any{"type": "string"}
+    case t.Kind() == reflect.Int || t.Kind() == reflect.Int64:
+        return map[string]any{"type": "integer"}
+    case t.Kind() == reflect.Bool:
+        return map[string]any{"type": "boolean"}
+    case t.Kind() == reflect.Slice:
+        return map[string]any{"type": "array", "items": fieldSchema(t.Elem())}
+    case t.Kind() == reflect.Map:
+        return map[string]any{"type": "object", "additionalProperties": fieldSchema(t.Elem())}
+    case t.Kind() == reflect.Struct:
+        return structSchema(t)
+    }
+    return map[string]any{}
+}
+
+// writeSchema は指定したスキーマを出力する
+func writeSchema(w io.Writer, name string) error {
+    schema, ok := schemas[name]
+    if !ok {
+        return fmt.Errorf("usage: eipconf schema %s", strings.Join(sortedKeys(schemas), "|"))
+    }
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(schema())
+}
+
+// schemaError はスキーマに合わない値の位置と理由
+type schemaError struct {
+    Path    []string // 配列の位置とフィールド名
+    Message string
+}
+
+// validateSchema はjson.Unmarshalでanyに読み込んだ値をスキーマで検証する
+func validateSchema(schema map[string]any, v any, path []string) []schemaError {
+    var errs []schemaError
+    fail := func(format string, args ...any) {
+        errs = append(errs, schemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+    }
+
+    if typ, ok := schema["type"].(string); ok && jsonType(v) != typ && !(typ == "integer" && jsonType(v) == "number" && v.(float64) == float64(int64(v.(float64)))) {
+        fail("expected %s, got %s", typ, jsonType(v))
+        return errs
+    }
+
+    switch v := v.(type) {
+    case []any:
+        if items, ok := schema["items"].(map[string]any); ok {
+            for i, item := range v {
+                errs = append(errs, validateSchema(items, item, append(append([]string{}, path...), strconv.Itoa(i)))...)
+            }
+        }
+    case map[string]any:
+        properties, _ := schema["properties"].(map[string]any)
+        required, _ := schema["required"].([]string)
+        for _, name := range required {
+            if _, exists := v[name]; !exists {
+                errs = append(errs, schemaError{Path: append(append([]string{}, path...), name), Message: "missing"})
+            }
+        }
+        for _, name := range sortedKeys(v) {
+            property, known := properties[name].(map[string]any)
+            if !known {
+                if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+                    errs = append(errs, validateSchema(additional, v[name], append(append([]string{}, path...), name))...)
+                } else if schema["additionalProperties"] == false {
+                    errs = append(errs, schemaError{Path: append(append([]string{}, path...), name), Message: "unknown field"})
+                }
+                continue
+            }
+            errs = append(errs, validateSchema(property, v[name], append(append([]string{}, path...), name))...)
+        }
+    case string:
+        if enum, ok := schema["enum"].([]string); ok && !containsString(enum, v) {
+            fail("%q is not one of %s", v, strings.Join(enum, ", "))
+        }
+        if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(v) {
+            fail("%q does not match %s", v, pattern)
+        }
+        if max, ok := schema["maxLength"].(int); ok && len(v) > max {
+            fail("%q is longer than %d", v, max)
+        }
+        switch format, _ := schema["format"].(string); format {
+        case "ipv4", "ipv6":
+            ip := net.ParseIP(v)
+            if ip == nil || (format == "ipv4") != (ip.To4() != nil && !strings.Contains(v, ":")) {
+                fail("%q is not an %s address", v, format)
+            }
+        case "date-time":
+            if _, err := time.Parse(time.RFC3339, v); err != nil {
+                fail("%q is not an RFC 3339 date-time", v)
+            }
+        }
+    case float64:
+        if min, ok := schema["minimum"].(int); ok && v < float64(min) {
+            fail("%v is less than %d", v, min)
+        }
+        if max, ok := schema["maximum"].(int); ok && v > float64(max) {
+            fail("%v is greater than %d", v, max)
+        }
+    }
+
+    if anyOf, ok := schema["anyOf"].([]any); ok {
+        var messages []string
+        for _, sub := range anyOf {
+            subErrs := validateSchema(sub.(map[string]any), v, path)
+            if len(subErrs) == 0 {
+                return errs
+            }
+            for _, e := range subErrs {
+                if len(e.Path) > len(path) {
+                    messages = append(messages, strings.Join(e.Path[len(path):], ".")+" "+e.Message)
+                } else {
+                    messages = append(messages, e.Message)
+                }
+            }
+        }
+        sort.Strings(messages)
+        fail("none of: %s", strings.Join(messages, "; "))
+    }
+    return errs
+}
+
+// jsonType はjson.Unmarshalで読み込んだ値のJSONの型名を返す
+func jsonType(v any) string {
+    switch v.(type) {
+    case nil:
+        return "null"
+    case bool:
+        return "boolean"
+    case float64:
+        return "number"
+    case string:
+        return "string"
+    case []any:
+        return "array"
+    case map[string]any:
+        return "object"
+    }
+    return "unknown"
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// フリート全体で1つの設定を共有する場合、トンネルの設定のhostsとlabelsで適用するホストを選ぶ
+//   hosts   ホスト名のglob(path.Match)。いずれかに一致するホストだけに適用する
+//   labels  settings.jsonのlabelsとすべて一致するホストだけに適用する。値はglobで書ける
+// どちらもない設定はすべてのホストに適用する。ホスト名はsettings.jsonのhostname、なければos.Hostname()
+
+const noSelectorReason = "no hosts or labels, applies to every host"
+
+// TunnelSelection は設定の1つのエントリーをこのホストに適用するかどうかと、その理由
+type TunnelSelection struct {
+    Index    int    `json:"index"`
+    TunnelID string `json:"tunnel_id,omitempty"`
+    Selected bool   `json:"selected"`
+    Reason   string `json:"reason"`
+}
+
+// selections は直近に解釈した設定の選択の結果。statusで表示する
+var selections = &selectionRecord{}
+
+type selectionRecord struct {
+    mu      sync.Mutex
+    entries []TunnelSelection
+}
+
+func (r *selectionRecord) set(entries []TunnelSelection) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.entries = entries
+}
+
+func (r *selectionRecord) get() []TunnelSelection {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.entries
+}
+
+// hasSelector はhostsかlabelsを指定しているかを返す
+func hasSelector(config TunnelConfig) bool {
+    return len(config.Hosts) > 0 || len(config.Labels) > 0
+}
+
+// selectTunnel は設定をこのホストに適用するかどうかと、その理由を返す
+func selectTunnel(config TunnelConfig, settings *Settings) (bool, string) {
+    if !hasSelector(config) {
+        return true, noSelectorReason
+    }
+    var reasons []string
+    if len(config.Hosts) > 0 {
+        matched := ""
+        for _, pattern := range config.Hosts {
+            if ok, _ := path.Match(pattern, settings.Hostname); ok {
+                matched = pattern
+                break
+            }
+        }
+        if matched == "" {
+            return false, fmt.Sprintf("hostname %s matches none of hosts %s", settings.Hostname, strings.Join(config.Hosts, ", "))
+        }
+        reasons = append(reasons, fmt.Sprintf("hostname %s matches %s", settings.Hostname, matched))
+    }
+    for _, key := range sortedKeys(config.Labels) {
+        want := config.Labels[key]
+        have, exists := settings.Labels[key]
+        if !exists {
+            return false, fmt.Sprintf("host has no label %s, wants %s=%s", key, key, want)
+        }
+        if ok, _ := path.Match(want, have); !ok {
+            return false, fmt.Sprintf("label %s=%s does not match %s", key, have, want)
+        }
+        reasons = append(reasons, fmt.Sprintf("label %s=%s matches %s", key, have, want))
+    }
+    return true, strings.Join(reasons, ", ")
+}
+
+// selectTunnels は設定の各エントリーをこのホストに適用するかどうかを決める
+func selectTunnels(configs []TunnelConfig, settings *Settings) []TunnelSelection {
+    entries := make([]TunnelSelection, 0, len(configs))
+    for i, config := range configs {
+        selected, reason := selectTunnel(config, settings)
+        entries = append(entries, TunnelSelection{Index: i, TunnelID: config.TunnelID, Selected: selected, Reason: reason})
+    }
+    return entries
+}
+
+// hasSelectors は選択の結果にhostsかlabelsで選んだエントリーがあるかを返す
+func hasSelectors(entries []TunnelSelection) bool {
+    for _, e := range entries {
+        if e.Reason != noSelectorReason {
+            return true
+        }
+    }
+    return false
+}
+
+// selectorsOverlap は2つの設定が同じホストに適用されうるかを返す。ホストがわからない場合の重複の確認に使う
+// どちらかが全ホスト向けか、hostsとlabelsが同じ場合だけ重なるとみなす
+func selectorsOverlap(a, b TunnelConfig) bool {
+    if !hasSelector(a) || !hasSelector(b) {
+        return true
+    }
+    return selectorKey(a) == selectorKey(b)
+}
+
+func selectorKey(config TunnelConfig) string {
+    hosts := append([]string{}, config.Hosts...)
+    sort.Strings(hosts)
+    labels := make([]string, 0, len(config.Labels))
+    for _, key := range sortedKeys(config.Labels) {
+        labels = append(labels, key+"="+config.Labels[key])
+    }
+    return strings.Join(hosts, ",") + "\x00" + strings.Join(labels, ",")
+}
+
+// validateSelector はhostsとlabelsの書式を検証する
+func validateSelector(config TunnelConfig, add func(field, format string, args ...any)) {
+    for _, pattern := range config.Hosts {
+        if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+            add("hosts", "%q is not a valid hostname pattern", pattern)
+        }
+    }
+    for _, key := range sortedKeys(config.Labels) {
+        if key == "" {
+            add("labels", "label name is empty")
+        } else if _, err := path.Match(config.Labels[key], ""); err != nil {
+            add("labels", "%s=%q is not a valid label pattern", key, config.Labels[key])
+        }
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "strings"
+)
+
+// 署名はed25519の64バイトの署名をbase64で表したもの。trusted_keysのいずれかの鍵で検証できれば受け入れる
+// signature_sourceを指定した場合はそこから読み込んだ署名で設定の内容そのものを検証し、
+// 指定しない場合は封筒のsignatureで次のメッセージを検証する
+//   "eipconf-config-v1\n" + "serial=<serial>\n" + "generated_at=<generated_at>\n" + <tunnelsの値をファイルに書かれたとおりに>
+
+// signatureError は署名の検証に失敗したことを表す
+type signatureError struct {
+    reason string
+}
+
+func (e *signatureError) Error() string {
+    return "config signature rejected: " + e.reason
+}
+
+// isSignatureError はエラーが署名の検証の失敗かどうかを返す
+func isSignatureError(err error) bool {
+    var sigErr *signatureError
+    return errors.As(err, &sigErr)
+}
+
+// parseTrustedKeys はtrusted_keysのbase64の公開鍵を読み込む
+func parseTrustedKeys(keys []string) ([]ed25519.PublicKey, error) {
+    var parsed []ed25519.PublicKey
+    for i, key := range keys {
+        raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+        if err != nil || len(raw) != ed25519.PublicKeySize {
+            return nil, fmt.Errorf("trusted_keys[%d] is not a base64 ed25519 public key", i)
+        }
+        parsed = append(parsed, ed25519.PublicKey(raw))
+    }
+    return parsed, nil
+}
+
+// readSignature はsourceから取得した設定の署名をsignature_sourceから読み込む。署名を確認しない場合と、封筒の署名を使う場合はnil
+// signature_sourceの "{source}" は設定のソースに置き換える
+func readSignature(settings *Settings, source string) ([]byte, error) {
+    if len(settings.TrustedKeys) == 0 || settings.SignatureSource == "" {
+        return nil, nil
+    }
+    signatureSource := strings.ReplaceAll(settings.SignatureSource, "{source}", source)
+    signature, _, err := readConfigSource(signatureSource)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read signature from %s: %v", signatureSource, err)
+    }
+    return signature, nil
+}
+
+// signedMessage は封筒の署名と、その署名で検証するメッセージを取り出す
+func signedMessage(body []byte) ([]byte, string, error) {
+    var envelope struct {
+        Serial      int64           `json:"serial"`
+        GeneratedAt string          `json:"generated_at"`
+        Tunnels     json.RawMessage `json:"tunnels"`
+        Signature   string          `json:"signature"`
+    }
+    if err := json.Unmarshal(body, &envelope); err != nil || envelope.Signature == "" {
+        return nil, "", fmt.Errorf("config is not signed")
+    }
+    message := fmt.Sprintf("eipconf-config-v1\nserial=%d\ngenerated_at=%s\n", envelope.Serial, envelope.GeneratedAt)
+    return append([]byte(message), envelope.Tunnels...), envelope.Signature, nil
+}
+
+// verifyConfig は設定の署名をtrusted_keysで検証する。trusted_keysがなければ確認しない
+// signatureはsignature_sourceから読み込んだ署名で、nilの場合は封筒の署名を使う
+func verifyConfig(settings *Settings, body, signature []byte) error {
+    if len(settings.TrustedKeys) == 0 {
+        return nil
+    }
+    keys, err := parseTrustedKeys(settings.TrustedKeys)
+    if err != nil {
+        return &signatureError{reason: err.Error()}
+    }
+
+    message, encoded := body, string(signature)
+    if signature == nil {
+        if message, encoded, err = signedMessage(body); err != nil {
+            return &signatureError{reason: err.Error()}
+        }
+    }
+    sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+    if err != nil || len(sig) != ed25519.SignatureSize {
+        return &signatureError{reason: "signature is not a base64 ed25519 signature"}
+    }
+    for i, key := range keys {
+        if ed25519.Verify(key, message, sig) {
+            slog.Debug("Config signature verified", "key", i)
+            return nil
+        }
+    }
+    return &signatureError{reason: "signature does not match any of the trusted keys"}
+}
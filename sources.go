@@ -0,0 +1,165 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// SourceState は1つの設定ソースの取得状況
+type SourceState struct {
+    Source      string     `json:"source"`
+    Priority    int        `json:"priority"` // config_sourcesの順番。0がプライマリ
+    Failures    int        `json:"failures"` // 連続して取得に失敗した回数
+    LastError   string     `json:"last_error,omitempty"`
+    LastSuccess *time.Time `json:"last_success,omitempty"`
+    RetryAt     *time.Time `json:"retry_at,omitempty"` // これより前は、他のソースが使える限り試さない
+}
+
+// sourceTracker はconfig_sourcesの各ソースの状態と、直近に使ったソースを管理する
+type sourceTracker struct {
+    mu     sync.Mutex
+    states map[string]*SourceState
+    active string // 最後に設定を受け入れたソース
+}
+
+var sources = &sourceTracker{states: make(map[string]*SourceState)}
+
+// sourceBackoff は連続して失敗したソースを次に試すまでの時間。fetch_intervalの失敗回数倍で、10倍までとする
+func sourceBackoff(settings *Settings, failures int) time.Duration {
+    if failures > 10 {
+        failures = 10
+    }
+    return time.Duration(settings.FetchInterval*failures) * time.Second
+}
+
+func (t *sourceTracker) state(settings *Settings, source string) *SourceState {
+    if t.states[source] == nil {
+        priority := 0
+        for i, s := range settings.ConfigSources {
+            if s == source {
+                priority = i
+            }
+        }
+        t.states[source] = &SourceState{Source: source, Priority: priority}
+    }
+    return t.states[source]
+}
+
+// order は今回試すソースを優先順に返す。待ち時間中のソースは飛ばすが、すべて待ち時間中なら最も早く再開するものを試す
+func (t *sourceTracker) order(settings *Settings, now time.Time) []string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    var ready []string
+    var soonest string
+    var soonestAt time.Time
+    for _, source := range settings.ConfigSources {
+        state := t.state(settings, source)
+        if state.RetryAt == nil || !now.Before(*state.RetryAt) {
+            ready = append(ready, source)
+            continue
+        }
+        if soonest == "" || state.RetryAt.Before(soonestAt) {
+            soonest, soonestAt = source, *state.RetryAt
+        }
+    }
+    if len(ready) == 0 {
+        return []string{soonest}
+    }
+    return ready
+}
+
+// record はソースの取得結果を記録する
+func (t *sourceTracker) record(settings *Settings, source string, err error, now time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    state := t.state(settings, source)
+    if err == nil {
+        state.Failures, state.LastError, state.LastSuccess, state.RetryAt = 0, "", &now, nil
+        metrics.Set("eipconf_config_source_up", labels("source", source, "priority", strconv.Itoa(state.Priority)), 1)
+        return
+    }
+    state.Failures++
+    state.LastError = err.Error()
+    retryAt := now.Add(sourceBackoff(settings, state.Failures))
+    state.RetryAt = &retryAt
+    metrics.Set("eipconf_config_source_up", labels("source", source, "priority", strconv.Itoa(state.Priority)), 0)
+}
+
+// activate は設定を受け入れたソースを記録し、フェイルオーバーとプライマリへの復帰を通知する
+func (t *sourceTracker) activate(settings *Settings, source string) {
+    t.mu.Lock()
+    previous := t.active
+    t.active = source
+    t.mu.Unlock()
+
+    for i, s := range settings.ConfigSources {
+        active := 0.0
+        if s == source {
+            active = 1
+        }
+        metrics.Set("eipconf_config_source_active", labels("source", s, "priority", strconv.Itoa(i)), active)
+    }
+    switch {
+    case previous == "" || previous == source:
+    case source == settings.ConfigSources[0]:
+        slog.Warn("Config source returned to primary", "source", source, "previous", previous)
+    default:
+        slog.Warn("Config source failed over", "source", source, "previous", previous)
+    }
+}
+
+// Active は最後に設定を受け入れたソースを返す。まだなければプライマリ
+func (t *sourceTracker) Active(settings *Settings) string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.active == "" {
+        return settings.ConfigSources[0]
+    }
+    return t.active
+}
+
+// States は各ソースの状態を優先順に返す
+func (t *sourceTracker) States(settings *Settings) []SourceState {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    states := make([]SourceState, 0, len(settings.ConfigSources))
+    for _, source := range settings.ConfigSources {
+        states = append(states, *t.state(settings, source))
+    }
+    return states
+}
+
+// fetchFromSources はconfig_sourcesを優先順に試し、最初に取得できた設定を返す
+// 取得できた設定を受け入れられるかどうかはここでは確かめず、受け入れられなくても次のソースは試さない
+// conditionalがtrueの場合、適用中の設定を取得したソースには条件付きリクエストを送る
+func fetchFromSources(settings *Settings, conditional bool) configFetch {
+    start := time.Now()
+    var errs []string
+    var fetch configFetch
+    for _, source := range sources.order(settings, start) {
+        fetch = fetchSource(settings, source, conditional && source == fetchState.source)
+        sources.record(settings, source, fetch.err, time.Now())
+        if fetch.err == nil {
+            break
+        }
+        if len(settings.ConfigSources) > 1 {
+            slog.Info("Config source unavailable, trying next", "source", source, "error", fetch.err)
+        }
+        errs = append(errs, fmt.Sprintf("%s: %v", source, fetch.err))
+    }
+    if fetch.err != nil && len(settings.ConfigSources) > 1 {
+        fetch.err = fmt.Errorf("no config source available: %s", strings.Join(errs, "; "))
+    }
+    // 設定が変わっていなくても断片が変わっていれば、前回受け入れた設定と結合し直す
+    fetch.fragments = fragmentsDigest(settings)
+    if fetch.notModified && fetch.fragments != fetchState.fragments {
+        slog.Debug("Config fragments changed, merging again", "source", fetch.source)
+        fetch.body, fetch.signature, fetch.format, fetch.notModified = fetchState.body, fetchState.signature, fetchState.format, false
+    }
+    fetch.elapsed = time.Since(start)
+    return fetch
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+// TunnelStatus は1つのトンネルの設定と実際の状態
+type TunnelStatus struct {
+    TunnelID  string            `json:"tunnel_id"`
+    Desired   *IfaceState       `json:"desired,omitempty"` // 設定にないトンネルではnil
+    Actual    *IfaceState       `json:"actual,omitempty"`  // インターフェイスが1つもなければnil
+    Link      string            `json:"link"`              // すべてupなら "up"、そうでなければ最初に見つかった "gif1 down" など
+    Links     map[string]string `json:"links"`             // インターフェイスごとのリンク状態。存在しなければ "missing"
+    Drift     bool              `json:"drift"`
+    Changes   []string          `json:"changes,omitempty"` // 設定どおりにするために必要な変更と競合
+    LastError string            `json:"last_error,omitempty"`
+}
+
+// StatusReport はstatusサブコマンドの出力
+type StatusReport struct {
+    Hostname        string            `json:"hostname"`
+    Backend         string            `json:"backend"`
+    ConfigSource    string            `json:"config_source"`               // 設定を取得したソース。キャッシュの場合はキャッシュの取得元
+    RunningSource   string            `json:"running_source,omitempty"`    // 実行中のeipconfが直近のサイクルで使ったソース
+    FromCache       bool              `json:"from_cache"`
+    ConfigFetchedAt *time.Time        `json:"config_fetched_at,omitempty"` // キャッシュを使った場合はその取得時刻
+    Serial          int64             `json:"serial,omitempty"`            // 設定のシリアル番号
+    AppliedSerial   int64             `json:"applied_serial,omitempty"`    // 最後に適用した設定のシリアル番号
+    LastCycleAt     *time.Time        `json:"last_cycle_at,omitempty"`     // 実行中のeipconfが最後に再設定した時刻
+    HeldReason      string            `json:"held_reason,omitempty"`
+    GeneratedAt     time.Time         `json:"generated_at"`
+    Tunnels         []TunnelStatus    `json:"tunnels"`
+    Selection       []TunnelSelection `json:"selection,omitempty"` // 設定の各エントリーをこのホストに適用するかどうかと、その理由
+}
+
+// buildStatus は設定と現在のインターフェイスをトンネルごとに突き合わせる
+// 設定を取得できない場合、またはcachedがtrueの場合はキャッシュした設定を使う。インターフェイスには一切変更を加えない
+func buildStatus(settings *Settings, cached bool) (StatusReport, error) {
+    hostname, err := os.Hostname()
+    if settings.Hostname != "" {
+        hostname = settings.Hostname
+    } else if err != nil {
+        hostname = "unknown"
+    }
+    report := StatusReport{Hostname: hostname, Backend: backend.Name(), ConfigSource: settings.ConfigSource, GeneratedAt: time.Now(), Tunnels: []TunnelStatus{}}
+
+    currentGifs, currentBridges, currentVLANs := getCurrentInterfaces()
+    var configs []TunnelConfig
+    if !cached {
+        report.ConfigSource, report.Serial, configs, err = fetchConfig(settings, currentGifs)
+        if err != nil {
+            slog.Warn("Config source unavailable, showing cached config", "sources", settings.ConfigSources, "error", err)
+        }
+    }
+    if cached || err != nil {
+        cache, err := loadConfigCache(settings)
+        if err != nil {
+            return report, err
+        }
+        report.Serial, configs, err = acceptConfig(settings, cache.fetched(), currentGifs)
+        if err != nil {
+            return report, fmt.Errorf("failed to parse cached config: %v", err)
+        }
+        report.ConfigSource = cache.Source
+        report.FromCache = true
+        report.ConfigFetchedAt = &cache.FetchedAt
+    }
+    report.Selection = selections.get()
+
+    if applied, err := loadAppliedSerial(settings); err == nil {
+        report.AppliedSerial = applied.Serial
+    }
+
+    tunnels := make(map[string]*TunnelStatus)
+    vlanIfaces := make(map[string]string)
+    tunnel := func(id string) *TunnelStatus {
+        if tunnels[id] == nil {
+            tunnels[id] = &TunnelStatus{TunnelID: id, Links: make(map[string]string)}
+        }
+        return tunnels[id]
+    }
+    for _, config := range configs {
+        gif := fmt.Sprintf("gif%s", config.TunnelID)
+        vlanIface := fmt.Sprintf("%s.%s", settings.PhysicalIface, config.VlanID)
+        tunnel(config.TunnelID).Desired = &IfaceState{Src: config.SrcAddr, Dst: config.DstAddr, Description: config.Description,
+            VlanID: config.VlanID, Members: []string{gif, vlanIface}}
+        vlanIfaces[config.TunnelID] = vlanIface
+    }
+    for _, current := range currentGifs {
+        tunnel(current.TunnelID)
+    }
+    for _, current := range currentBridges {
+        tunnel(current.TunnelID)
+    }
+
+    for id, t := range tunnels {
+        gif, bridge, vlanIface := fmt.Sprintf("gif%s", id), fmt.Sprintf("bridge%s", id), vlanIfaces[id]
+        actual, found := &IfaceState{}, false
+        if current, exists := currentGifs[gif]; exists {
+            actual.Src, actual.Dst, actual.Description, found = current.Src, current.Dst, current.Description, true
+        }
+        if current, exists := currentBridges[bridge]; exists {
+            actual.Members, found = current.Members, true
+            // 設定にないトンネルはbridgeのメンバーからVLANを探す
+            for _, member := range current.Members {
+                if vlanIface == "" && isPhysicalVLAN(member, settings.PhysicalIface) {
+                    vlanIface = member
+                    break
+                }
+            }
+        }
+        if vlanID, exists := currentVLANs[vlanIface]; exists {
+            actual.VlanID, found = vlanID, true
+        }
+        if found {
+            t.Actual = actual
+        }
+
+        t.Link = "up"
+        for _, iface := range []string{gif, vlanIface, bridge} {
+            if iface == "" {
+                continue
+            }
+            state := "missing"
+            _, gifExists := currentGifs[iface]
+            _, bridgeExists := currentBridges[iface]
+            _, vlanExists := currentVLANs[iface]
+            if gifExists || bridgeExists || vlanExists {
+                if state, err = backend.LinkState(iface); err != nil {
+                    slog.Debug("Failed to get link state", "iface", iface, "error", err)
+                    state = "unknown"
+                }
+            }
+            t.Links[iface] = state
+            if state != "up" && t.Link == "up" {
+                t.Link = iface + " " + state
+            }
+        }
+    }
+
+    // 設定どおりにするために必要な変更があるトンネルを差分ありとする
+    plan := calculatePlan(currentGifs, currentBridges, currentVLANs, configs, settings.PhysicalIface)
+    for _, c := range plan.Conflicts {
+        if t := tunnels[c.TunnelID]; t != nil {
+            t.Changes = append(t.Changes, fmt.Sprintf("conflict: %s %s: %s", c.Kind, c.Iface, c.Reason))
+        }
+    }
+    for _, c := range plan.Changes() {
+        if t := tunnels[c.TunnelID]; t != nil {
+            t.Changes = append(t.Changes, describeChange(c))
+        }
+    }
+
+    if last := lastCycle(settings); last != nil {
+        report.LastCycleAt = &last.At
+        report.RunningSource = last.Source
+        report.HeldReason = last.HeldReason
+        if last.Result != nil {
+            for _, r := range last.Result.Tunnels {
+                if t := tunnels[r.TunnelID]; t != nil && r.Error != "" {
+                    t.LastError = fmt.Sprintf("%s: %s: %s", r.Status, r.FailedOp, r.Error)
+                }
+            }
+        }
+    }
+
+    for _, id := range sortTunnelIDs(sortedKeys(tunnels)) {
+        t := tunnels[id]
+        t.Drift = len(t.Changes) > 0
+        report.Tunnels = append(report.Tunnels, *t)
+    }
+    return report, nil
+}
+
+// sortTunnelIDs はトンネルIDを数値の順に並べる。数値でないIDは後ろに名前順で並べる
+func sortTunnelIDs(ids []string) []string {
+    sort.SliceStable(ids, func(i, j int) bool {
+        a, aerr := strconv.Atoi(ids[i])
+        b, berr := strconv.Atoi(ids[j])
+        if aerr == nil && berr == nil {
+            return a < b
+        }
+        return aerr == nil && berr != nil
+    })
+    return ids
+}
+
+// lastCycle は実行中のeipconfから直近の再設定の結果を取得する。取得できなければnil
+func lastCycle(settings *Settings) *CycleResult {
+    if settings.ControlSocket == "none" {
+        return nil
+    }
+    resp, err := controlRequest(settings, http.MethodGet, "/plan")
+    if err != nil {
+        slog.Debug("Last cycle unavailable", "error", err)
+        return nil
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        slog.Debug("Last cycle unavailable", "status", resp.Status)
+        return nil
+    }
+    var last CycleResult
+    if err := json.NewDecoder(resp.Body).Decode(&last); err != nil {
+        slog.Debug("Failed to decode last cycle", "error", err)
+        return nil
+    }
+    return &last
+}
+
+// writeStatus は状態をtext(表)またはjson形式で出力
+func writeStatus(w io.Writer, report StatusReport, format string) error {
+    switch format {
+    case "json":
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        return enc.Encode(report)
+    case "text", "":
+        fmt.Fprintf(w, "Status of %s (backend: %s, source: %s)\n", report.Hostname, report.Backend, report.ConfigSource)
+        if report.Serial > 0 || report.AppliedSerial > 0 {
+            fmt.Fprintf(w, "# config serial: %d, applied serial: %d\n", report.Serial, report.AppliedSerial)
+        }
+        if report.RunningSource != "" && report.RunningSource != report.ConfigSource {
+            fmt.Fprintf(w, "# running eipconf uses config from %s\n", report.RunningSource)
+        }
+        if report.FromCache {
+            fmt.Fprintf(w, "# desired config from cache fetched at %s\n", report.ConfigFetchedAt.Format(time.RFC3339))
+        }
+        if report.LastCycleAt == nil {
+            fmt.Fprintln(w, "# last cycle unavailable, eipconf is not running or has not completed a cycle")
+        }
+        if report.HeldReason != "" {
+            fmt.Fprintf(w, "# last cycle held by safeguard: %s\n", report.HeldReason)
+        }
+
+        dash := func(s string) string {
+            if s == "" {
+                return "-"
+            }
+            return s
+        }
+        tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(tw, "TUNNEL\tSRC\tDST\tVLAN\tMEMBERS\tDESCRIPTION\tLINK\tDRIFT\tLAST ERROR")
+        for _, t := range report.Tunnels {
+            actual := t.Actual
+            if actual == nil {
+                actual = &IfaceState{}
+            }
+            drift := "-"
+            if t.Drift {
+                drift = "yes"
+            }
+            fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.TunnelID, dash(actual.Src), dash(actual.Dst), dash(actual.VlanID),
+                dash(strings.Join(actual.Members, ",")), dash(actual.Description), t.Link, drift, dash(t.LastError))
+        }
+        if err := tw.Flush(); err != nil {
+            return err
+        }
+
+        for _, t := range report.Tunnels {
+            for _, c := range t.Changes {
+                fmt.Fprintf(w, "# drift %s: %s\n", t.TunnelID, c)
+            }
+        }
+        // hostsやlabelsで選んだエントリーがある場合だけ、各エントリーを選んだ理由を出力する
+        if hasSelectors(report.Selection) {
+            for _, e := range report.Selection {
+                entry := e.TunnelID
+                if entry == "" {
+                    entry = fmt.Sprintf("index %d", e.Index)
+                }
+                if e.Selected {
+                    fmt.Fprintf(w, "# selected %s: %s\n", entry, e.Reason)
+                } else {
+                    fmt.Fprintf(w, "# not selected %s: %s\n", entry, e.Reason)
+                }
+            }
+        }
+        return nil
+    default:
+        return fmt.Errorf("unknown status format: %s", format)
+    }
+}
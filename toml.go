@@ -0,0 +1,506 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+// TOML 1.0の読み込み。日時はRFC 3339の文字列に変換する。infとnanはJSONで表せないのでエラーとする
+// TOMLの文書は常にテーブルなので、トンネルの設定は封筒の形（version、serialと[[tunnels]]）か、[[tunnels]]だけで書く
+
+type tomlParser struct {
+    text    *sourceText
+    src     string
+    i       int
+    root    *docNode
+    current *docNode
+    defined map[*docNode]bool // [table]で定義したテーブル
+    closed  map[*docNode]bool // インラインテーブルと配列の値。後から追加できない
+    tables  map[*docNode]bool // [[table]]で作った配列
+}
+
+type tomlFailure struct {
+    err *documentError
+}
+
+func parseTOML(src string) (root *docNode, err error) {
+    p := &tomlParser{text: newSourceText(src), src: src, defined: map[*docNode]bool{}, closed: map[*docNode]bool{}, tables: map[*docNode]bool{}}
+    p.root = &docNode{pos: position{Line: 1, Column: 1}, isMap: true}
+    p.current = p.root
+    defer func() {
+        if r := recover(); r != nil {
+            failure, ok := r.(tomlFailure)
+            if !ok {
+                panic(r)
+            }
+            root, err = nil, failure.err
+        }
+    }()
+    p.parse()
+    return p.root, nil
+}
+
+func (p *tomlParser) fail(offset int, format string, args ...any) {
+    panic(tomlFailure{&documentError{format: formatTOML, pos: p.text.position(offset), msg: fmt.Sprintf(format, args...)}})
+}
+
+func (p *tomlParser) peek(s string) bool {
+    return strings.HasPrefix(p.src[p.i:], s)
+}
+
+func (p *tomlParser) skipSpace() {
+    for p.i < len(p.src) && (p.src[p.i] == ' ' || p.src[p.i] == '\t') {
+        p.i++
+    }
+}
+
+// skipLine は行末の空白とコメントを確かめ、次の行の先頭に移る
+func (p *tomlParser) skipLine() {
+    p.skipSpace()
+    if p.i < len(p.src) && p.src[p.i] == '#' {
+        for p.i < len(p.src) && p.src[p.i] != '\n' {
+            p.i++
+        }
+    }
+    if p.i < len(p.src) && p.src[p.i] != '\n' {
+        p.fail(p.i, "expected end of line, found %q", p.src[p.i])
+    }
+    p.i++
+}
+
+// skipBlank は配列の中の空白、改行とコメントを飛ばす
+func (p *tomlParser) skipBlank() {
+    for p.i < len(p.src) {
+        switch p.src[p.i] {
+        case ' ', '\t', '\n':
+            p.i++
+        case '#':
+            for p.i < len(p.src) && p.src[p.i] != '\n' {
+                p.i++
+            }
+        default:
+            return
+        }
+    }
+}
+
+func (p *tomlParser) parse() {
+    for p.i < len(p.src) {
+        p.skipSpace()
+        switch {
+        case p.i >= len(p.src):
+        case p.src[p.i] == '\n' || p.src[p.i] == '#':
+            p.skipLine()
+        case p.peek("[["):
+            start := p.i
+            p.i += 2
+            keys := p.parseKey()
+            if p.skipSpace(); !p.peek("]]") {
+                p.fail(p.i, "expected ']]'")
+            }
+            p.i += 2
+            p.arrayTable(start, keys)
+            p.skipLine()
+        case p.peek("["):
+            start := p.i
+            p.i++
+            keys := p.parseKey()
+            if p.skipSpace(); !p.peek("]") {
+                p.fail(p.i, "expected ']'")
+            }
+            p.i++
+            p.table(start, keys)
+            p.skipLine()
+        default:
+            p.parseKeyValue(p.current)
+            p.skipLine()
+        }
+    }
+}
+
+type tomlKey struct {
+    name   string
+    offset int
+}
+
+// parseKey はドットで区切ったキーを読む
+func (p *tomlParser) parseKey() []tomlKey {
+    var keys []tomlKey
+    for {
+        p.skipSpace()
+        start := p.i
+        var name string
+        switch {
+        case p.peek(`"""`) || p.peek(`'''`):
+            p.fail(p.i, "multi-line strings cannot be keys")
+        case p.peek(`"`):
+            name = p.parseBasicString()
+        case p.peek(`'`):
+            name = p.parseLiteralString()
+        default:
+            for p.i < len(p.src) && isBareKeyChar(p.src[p.i]) {
+                p.i++
+            }
+            if p.i == start {
+                p.fail(p.i, "expected a key")
+            }
+            name = p.src[start:p.i]
+        }
+        keys = append(keys, tomlKey{name: name, offset: start})
+        p.skipSpace()
+        if !p.peek(".") {
+            return keys
+        }
+        p.i++
+    }
+}
+
+func isBareKeyChar(c byte) bool {
+    return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// descend はtableからキーをたどり、途中のテーブルがなければ作る。[[table]]の配列は最後の要素をたどる
+func (p *tomlParser) descend(table *docNode, keys []tomlKey) *docNode {
+    for _, key := range keys {
+        child := table.get(key.name)
+        switch {
+        case child == nil:
+            child = &docNode{pos: p.text.position(key.offset), isMap: true}
+            table.set(key.name, child)
+        case child.isSeq && p.tables[child]:
+            child = child.items[len(child.items)-1]
+        case !child.isMap || p.closed[child]:
+            p.fail(key.offset, "key %q is already defined as a value", key.name)
+        }
+        table = child
+    }
+    return table
+}
+
+func (p *tomlParser) table(start int, keys []tomlKey) {
+    parent := p.descend(p.root, keys[:len(keys)-1])
+    last := keys[len(keys)-1]
+    table := parent.get(last.name)
+    switch {
+    case table == nil:
+        table = &docNode{pos: p.text.position(start), isMap: true}
+        parent.set(last.name, table)
+    case !table.isMap || p.closed[table] || p.defined[table]:
+        p.fail(start, "table %q is already defined", last.name)
+    }
+    p.defined[table] = true
+    p.current = table
+}
+
+func (p *tomlParser) arrayTable(start int, keys []tomlKey) {
+    parent := p.descend(p.root, keys[:len(keys)-1])
+    last := keys[len(keys)-1]
+    array := parent.get(last.name)
+    switch {
+    case array == nil:
+        array = &docNode{pos: p.text.position(start), isSeq: true}
+        p.tables[array] = true
+        parent.set(last.name, array)
+    case !p.tables[array]:
+        p.fail(start, "key %q is already defined and is not an array of tables", last.name)
+    }
+    table := &docNode{pos: p.text.position(start), isMap: true}
+    array.items = append(array.items, table)
+    p.current = table
+}
+
+func (p *tomlParser) parseKeyValue(table *docNode) {
+    keys := p.parseKey()
+    if !p.peek("=") {
+        p.fail(p.i, "expected '=' after key")
+    }
+    p.i++
+    p.skipSpace()
+    table = p.descend(table, keys[:len(keys)-1])
+    last := keys[len(keys)-1]
+    if table.get(last.name) != nil {
+        p.fail(last.offset, "duplicate key %q", last.name)
+    }
+    table.set(last.name, p.parseValue())
+}
+
+func (p *tomlParser) parseValue() *docNode {
+    start := p.i
+    pos := p.text.position(start)
+    switch {
+    case p.i >= len(p.src) || p.src[p.i] == '\n':
+        p.fail(p.i, "missing value")
+    case p.peek(`"""`):
+        return stringNode(pos, p.parseMultilineBasicString())
+    case p.peek(`'''`):
+        return stringNode(pos, p.parseMultilineLiteralString())
+    case p.peek(`"`):
+        return stringNode(pos, p.parseBasicString())
+    case p.peek(`'`):
+        return stringNode(pos, p.parseLiteralString())
+    case p.peek("["):
+        return p.parseArray()
+    case p.peek("{"):
+        return p.parseInlineTable()
+    }
+
+    for p.i < len(p.src) && strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_:.+-", p.src[p.i]) >= 0 {
+        p.i++
+        // 日付と時刻の間の空白
+        if tomlDate.MatchString(p.src[start:p.i]) && p.i+3 < len(p.src) && p.src[p.i] == ' ' && isDigit(p.src[p.i+1]) && isDigit(p.src[p.i+2]) && p.src[p.i+3] == ':' {
+            p.i++
+        }
+    }
+    token := p.src[start:p.i]
+    scalar, err := resolveTOMLScalar(token)
+    if err != nil {
+        p.fail(start, "%v", err)
+    }
+    return &docNode{pos: pos, scalar: scalar, raw: token}
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+var (
+    tomlDate     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+    tomlDateTime = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}[Tt ]\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:\d{2})?$`)
+    tomlTime     = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?$`)
+    tomlInt      = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+    tomlHex      = regexp.MustCompile(`^0x[0-9a-fA-F](_?[0-9a-fA-F])*$`)
+    tomlOct      = regexp.MustCompile(`^0o[0-7](_?[0-7])*$`)
+    tomlBin      = regexp.MustCompile(`^0b[01](_?[01])*$`)
+    tomlFloat    = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)((\.[0-9](_?[0-9])*)([eE][+-]?[0-9](_?[0-9])*)?|[eE][+-]?[0-9](_?[0-9])*)$`)
+)
+
+// tomlDateTimeString は日付と時刻をRFC 3339の形の文字列にする。日付と時刻の間の空白は "T" にする
+func tomlDateTimeString(s string) (string, error) {
+    value := strings.ToUpper(strings.Replace(s, " ", "T", 1))
+    layout := "2006-01-02T15:04:05.999999999"
+    switch {
+    case tomlDate.MatchString(value):
+        layout = "2006-01-02"
+    case tomlTime.MatchString(value):
+        layout = "15:04:05.999999999"
+    case strings.HasSuffix(value, "Z") || strings.LastIndexAny(value, "+-") > len("2006-01-02"):
+        layout = time.RFC3339Nano
+    }
+    if _, err := time.Parse(layout, value); err != nil {
+        return "", fmt.Errorf("invalid date-time %s", s)
+    }
+    return stringNode(position{}, value).scalar, nil
+}
+
+// resolveTOMLScalar は文字列以外のスカラーをJSONの表現にする
+func resolveTOMLScalar(s string) (string, error) {
+    var n int64
+    var err error
+    digits := strings.ReplaceAll(s, "_", "")
+    switch {
+    case s == "true" || s == "false":
+        return s, nil
+    case tomlInt.MatchString(s):
+        n, err = strconv.ParseInt(digits, 10, 64)
+    case tomlHex.MatchString(s):
+        n, err = strconv.ParseInt(digits[2:], 16, 64)
+    case tomlOct.MatchString(s):
+        n, err = strconv.ParseInt(digits[2:], 8, 64)
+    case tomlBin.MatchString(s):
+        n, err = strconv.ParseInt(digits[2:], 2, 64)
+    case tomlFloat.MatchString(s):
+        f, err := strconv.ParseFloat(digits, 64)
+        if err != nil || math.IsInf(f, 0) {
+            return "", fmt.Errorf("number %s is out of range", s)
+        }
+        return strconv.FormatFloat(f, 'g', -1, 64), nil
+    case strings.TrimLeft(s, "+-") == "inf" || strings.TrimLeft(s, "+-") == "nan":
+        return "", fmt.Errorf("%s cannot be represented in JSON", s)
+    case tomlDateTime.MatchString(s), tomlDate.MatchString(s), tomlTime.MatchString(s):
+        return tomlDateTimeString(s)
+    case s == "":
+        return "", fmt.Errorf("missing value")
+    default:
+        return "", fmt.Errorf("invalid value %q", s)
+    }
+    if err != nil {
+        return "", fmt.Errorf("integer %s is out of range", s)
+    }
+    return strconv.FormatInt(n, 10), nil
+}
+
+func (p *tomlParser) parseArray() *docNode {
+    node := &docNode{pos: p.text.position(p.i), isSeq: true, items: []*docNode{}}
+    p.closed[node] = true
+    for p.i++; ; {
+        p.skipBlank()
+        if p.peek("]") {
+            p.i++
+            return node
+        }
+        node.items = append(node.items, p.parseValue())
+        p.skipBlank()
+        switch {
+        case p.peek(","):
+            p.i++
+        case p.peek("]"):
+            p.i++
+            return node
+        default:
+            p.fail(p.i, "expected ',' or ']' in array")
+        }
+    }
+}
+
+func (p *tomlParser) parseInlineTable() *docNode {
+    node := &docNode{pos: p.text.position(p.i), isMap: true}
+    p.i++
+    p.skipSpace()
+    if p.peek("}") {
+        p.i++
+        p.closed[node] = true
+        return node
+    }
+    for {
+        p.parseKeyValue(node)
+        p.skipSpace()
+        switch {
+        case p.peek(","):
+            p.i++
+        case p.peek("}"):
+            p.i++
+            p.closeTable(node)
+            return node
+        default:
+            p.fail(p.i, "expected ',' or '}' in inline table")
+        }
+    }
+}
+
+// closeTable はインラインテーブルとその中のテーブルに、後から追加できないようにする
+func (p *tomlParser) closeTable(node *docNode) {
+    p.closed[node] = true
+    for _, item := range node.items {
+        if item.isMap {
+            p.closeTable(item)
+        }
+    }
+}
+
+var tomlEscapes = map[byte]string{'b': "\b", 't': "\t", 'n': "\n", 'f': "\f", 'r': "\r", 'e': "\x1b", '"': "\"", '\\': "\\"}
+
+// parseEscape はp.iの "\" から始まるエスケープを読む
+func (p *tomlParser) parseEscape(b *strings.Builder) {
+    start := p.i
+    p.i++
+    if p.i >= len(p.src) {
+        p.fail(start, "unterminated escape sequence")
+    }
+    if s, ok := tomlEscapes[p.src[p.i]]; ok {
+        b.WriteString(s)
+        p.i++
+        return
+    }
+    size := map[byte]int{'u': 4, 'U': 8}[p.src[p.i]]
+    if size == 0 || p.i+size >= len(p.src) {
+        p.fail(start, "invalid escape sequence")
+    }
+    r, err := strconv.ParseUint(p.src[p.i+1:p.i+1+size], 16, 32)
+    if err != nil || !utf8.ValidRune(rune(r)) {
+        p.fail(start, "invalid escape sequence")
+    }
+    b.WriteRune(rune(r))
+    p.i += size + 1
+}
+
+func (p *tomlParser) parseBasicString() string {
+    start := p.i
+    var b strings.Builder
+    for p.i++; ; {
+        if p.i >= len(p.src) || p.src[p.i] == '\n' {
+            p.fail(start, "unterminated string")
+        }
+        switch c := p.src[p.i]; c {
+        case '"':
+            p.i++
+            return b.String()
+        case '\\':
+            p.parseEscape(&b)
+        default:
+            b.WriteByte(c)
+            p.i++
+        }
+    }
+}
+
+func (p *tomlParser) parseLiteralString() string {
+    start := p.i
+    end := strings.IndexAny(p.src[p.i+1:], "'\n")
+    if end < 0 || p.src[p.i+1+end] != '\'' {
+        p.fail(start, "unterminated string")
+    }
+    p.i += end + 2
+    return p.src[start+1 : p.i-1]
+}
+
+// trimFirstNewline は複数行の文字列の開始直後の改行を除く
+func (p *tomlParser) trimFirstNewline() {
+    if p.peek("\n") {
+        p.i++
+    }
+}
+
+func (p *tomlParser) parseMultilineBasicString() string {
+    start := p.i
+    var b strings.Builder
+    p.i += 3
+    p.trimFirstNewline()
+    for {
+        switch {
+        case p.i >= len(p.src):
+            p.fail(start, "unterminated string")
+        case p.peek(`"""`):
+            // 閉じる引用符の前の最大2つの引用符は内容に含める
+            extra := 0
+            for extra < 2 && p.i+3+extra < len(p.src) && p.src[p.i+3+extra] == '"' {
+                extra++
+            }
+            b.WriteString(strings.Repeat(`"`, extra))
+            p.i += 3 + extra
+            return b.String()
+        case p.src[p.i] == '\\':
+            // 行末の "\" は改行と次の空白を除く
+            rest := strings.TrimLeft(p.src[p.i+1:], " \t")
+            if strings.HasPrefix(rest, "\n") {
+                p.i = len(p.src) - len(strings.TrimLeft(rest, " \t\n"))
+                continue
+            }
+            p.parseEscape(&b)
+        default:
+            b.WriteByte(p.src[p.i])
+            p.i++
+        }
+    }
+}
+
+func (p *tomlParser) parseMultilineLiteralString() string {
+    start := p.i
+    p.i += 3
+    p.trimFirstNewline()
+    end := strings.Index(p.src[p.i:], "'''")
+    if end < 0 {
+        p.fail(start, "unterminated string")
+    }
+    // 閉じる引用符の前の最大2つの引用符は内容に含める
+    for extra := 0; extra < 2 && p.i+end+3 < len(p.src) && p.src[p.i+end+3] == '\''; extra++ {
+        end++
+    }
+    value := p.src[p.i : p.i+end]
+    p.i += end + 3
+    return value
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseTOML(t *testing.T) {
+    runParseCases(t, formatTOML, []parseCase{
+        {
+            name: "array of tables and comments",
+            src:  "# tunnels\nversion = 1\nserial = 3 # envelope\n\n[[tunnels]]\ntunnel_id = \"1\"\nvlan_id = \"100\"\n\n[[tunnels]] # second\ntunnel_id = \"2\"\nvlan_id = \"101\"\n",
+            want: `{"version":1,"serial":3,"tunnels":[{"tunnel_id":"1","vlan_id":"100"},{"tunnel_id":"2","vlan_id":"101"}]}`,
+        },
+        {
+            name: "inline tables and arrays",
+            src:  "[[tunnels]]\ntunnel_id = \"1\"\nhosts = [\"edge-*\", 'core-1',]\nlabels = {site = \"tokyo\", rack = {row = 1}}\n",
+            want: `{"tunnels":[{"tunnel_id":"1","hosts":["edge-*","core-1"],"labels":{"site":"tokyo","rack":{"row":1}}}]}`,
+        },
+        {
+            name: "subtable of array of tables",
+            src:  "[[tunnels]]\ntunnel_id = \"1\"\n[tunnels.labels]\nsite = \"tokyo\"\n[[tunnels]]\ntunnel_id = \"2\"\n",
+            want: `{"tunnels":[{"tunnel_id":"1","labels":{"site":"tokyo"}},{"tunnel_id":"2"}]}`,
+        },
+        {
+            name: "strings",
+            src:  "basic = \"tab\\there \\u00e9\"\nliteral = 'C:\\path'\nmulti = \"\"\"\nline one\nline two\"\"\"\nraw = '''\nraw \\n'''\n",
+            want: `{"basic":"tab\there é","literal":"C:\\path","multi":"line one\nline two","raw":"raw \\n"}`,
+        },
+        {
+            name: "numbers, booleans and dates",
+            src:  "int = 1_000\nhex = 0x1F\nfloat = 2.5\nbool = true\ndate = 1979-05-27T07:32:00Z\n",
+            want: `{"int":1000,"hex":31,"float":2.5,"bool":true,"date":"1979-05-27T07:32:00Z"}`,
+        },
+        {
+            name: "CRLF",
+            src:  "version = 1\r\nserial = 3\r\n\r\n[[tunnels]]\r\ntunnel_id = \"1\" # id\r\n",
+            want: `{"version":1,"serial":3,"tunnels":[{"tunnel_id":"1"}]}`,
+        },
+        {name: "duplicate key", src: "tunnel_id = \"1\"\nvlan_id = \"100\"\nvlan_id = \"101\"\n", line: 3, column: 1, wantErr: `duplicate key "vlan_id"`},
+        {name: "table defined twice", src: "[t]\nx = 1\n[t]\ny = 2\n", line: 3, column: 1, wantErr: `table "t" is already defined`},
+        {name: "array of tables over array", src: "tunnels = []\n[[tunnels]]\n", line: 2, column: 1, wantErr: `key "tunnels" is already defined and is not an array of tables`},
+        {name: "extend inline table", src: "a = {b = 1}\na.c = 2\n", line: 2, column: 1, wantErr: `key "a" is already defined as a value`},
+        {name: "trailing comma in inline table", src: "a = {b = 1,}\n", line: 1, column: 12, wantErr: "expected a key"},
+        {name: "unterminated string", src: "a = 1\nb = \"open\n", line: 2, column: 5, wantErr: "unterminated string"},
+        {name: "inf", src: "a = inf\n", line: 1, column: 5, wantErr: "inf cannot be represented in JSON"},
+        {name: "text after value", src: "a = 1 b\n", line: 1, column: 7, wantErr: "expected end of line, found 'b'"},
+        {name: "error position with CRLF", src: "a = 1\r\nb = [1,\r\n  2 3]\r\n", line: 3, column: 5, wantErr: "expected ',' or ']' in array"},
+    })
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// maxIfaceNameLen はインターフェイス名の最大長。FreeBSDとLinuxのIFNAMSIZは終端を含めて16
+const maxIfaceNameLen = 15
+
+// tunnelIDPattern はgif<ID>、bridge<ID>として作成できるトンネルID。先頭が0の番号は作成できない
+var tunnelIDPattern = regexp.MustCompile(`^(0|[1-9]\d*)$`)
+
+// ConfigProblem は設定の1つの問題
+type ConfigProblem struct {
+    Index    int    `json:"index"` // 配列の位置。ファイル全体の問題は-1
+    TunnelID string `json:"tunnel_id,omitempty"`
+    Field    string `json:"field,omitempty"`
+    Message  string `json:"message"`
+    Line     int    `json:"line,omitempty"` // 元のファイルでの位置。わからなければ0
+    Column   int    `json:"column,omitempty"`
+}
+
+// String は "line 12, column 14: [3] tunnel_id=12 vlan_id: 5000 is out of range 1-4094" の形式で問題を表す
+func (p ConfigProblem) String() string {
+    var s []string
+    if p.Index >= 0 {
+        s = append(s, fmt.Sprintf("[%d]", p.Index))
+    }
+    if p.TunnelID != "" {
+        s = append(s, "tunnel_id="+p.TunnelID)
+    }
+    if p.Field != "" {
+        s = append(s, p.Field+":")
+    } else if len(s) > 0 {
+        s[len(s)-1] += ":"
+    }
+    if p.Line > 0 {
+        s = append([]string{fmt.Sprintf("line %d, column %d:", p.Line, p.Column)}, s...)
+    }
+    return strings.Join(append(s, p.Message), " ")
+}
+
+// ValidationReport は1つのファイルの検証結果
+type ValidationReport struct {
+    Source   string          `json:"source"`
+    Kind     string          `json:"kind"` // "settings" または "config"
+    Problems []ConfigProblem `json:"problems"`
+}
+
+// validateConfigData は設定の内容をスキーマと意味の両方で検証し、すべての問題を返す
+// 名前解決やインターフェイスの参照は行わない。settingsがnilの場合はsettings.jsonに依存する確認を省く
+// 問題には、わかる場合は元のファイルでの行と桁をつける
+func validateConfigData(doc *configDocument, settings *Settings) []ConfigProblem {
+    var value any
+    if err := json.Unmarshal(doc.data, &value); err != nil {
+        return []ConfigProblem{{Index: -1, Message: fmt.Sprintf("failed to unmarshal JSON: %v", err)}}
+    }
+    schema, tunnels, envelope := tunnelListSchema(), doc.data, false
+    if object, ok := value.(map[string]any); ok {
+        schema, envelope = envelopeSchema(), true
+        tunnels, _ = json.Marshal(object["tunnels"])
+    }
+    var schemaProblems []ConfigProblem
+    for _, e := range validateSchema(schema, value, nil) {
+        // 封筒のtunnelsの中の問題はその位置のトンネルの問題、それ以外は封筒自体のフィールドの問題とする
+        path := e.Path
+        if envelope && len(path) > 1 && path[0] == "tunnels" {
+            path = path[1:]
+        } else if envelope {
+            path = append([]string{"-1"}, path...)
+        }
+        p := ConfigProblem{Index: -1, Message: e.Message}
+        if len(path) > 0 {
+            p.Index, _ = strconv.Atoi(path[0])
+        }
+        if len(path) > 1 {
+            p.Field = path[1]
+        }
+        schemaProblems = append(schemaProblems, p)
+    }
+
+    // 型が合わない設定は読み込めないので、意味の確認はそれ以外の設定だけに行う
+    var entries []json.RawMessage
+    json.Unmarshal(tunnels, &entries)
+    var configs []TunnelConfig
+    var indexes []int
+    for i, entry := range entries {
+        var config TunnelConfig
+        if json.Unmarshal(entry, &config) == nil {
+            configs = append(configs, config)
+            indexes = append(indexes, i)
+        }
+    }
+    problems := validateTunnels(configs, indexes, settings)
+
+    // 同じフィールドの問題は意味の確認のほうが理由が詳しいので、スキーマの問題は出さない
+    tunnelIDs := make(map[int]string)
+    reported := make(map[string]bool)
+    for n, i := range indexes {
+        tunnelIDs[i] = configs[n].TunnelID
+    }
+    for _, p := range problems {
+        reported[fmt.Sprintf("%d/%s", p.Index, p.Field)] = true
+        reported[fmt.Sprintf("%d/", p.Index)] = true
+    }
+    for _, p := range schemaProblems {
+        if !reported[fmt.Sprintf("%d/%s", p.Index, p.Field)] {
+            p.TunnelID = tunnelIDs[p.Index]
+            problems = append(problems, p)
+        }
+    }
+    sort.SliceStable(problems, func(i, j int) bool { return problems[i].Index < problems[j].Index })
+
+    for i, p := range problems {
+        var path []string
+        if envelope && p.Index >= 0 {
+            path = append(path, "tunnels")
+        }
+        if p.Index >= 0 {
+            path = append(path, strconv.Itoa(p.Index))
+        }
+        if p.Field != "" {
+            path = append(path, p.Field)
+        }
+        if pos, ok := doc.position(path); ok {
+            problems[i].Line, problems[i].Column = pos.Line, pos.Column
+        }
+    }
+    return problems
+}
+
+// documentProblem は設定ファイルを読み込めなかったエラーを問題にする。構文の誤りには行と桁をつける
+func documentProblem(err error) ConfigProblem {
+    var docErr *documentError
+    if errors.As(err, &docErr) {
+        return ConfigProblem{Index: -1, Line: docErr.pos.Line, Column: docErr.pos.Column, Message: fmt.Sprintf("failed to parse %s: %s", strings.ToUpper(docErr.format), docErr.msg)}
+    }
+    return ConfigProblem{Index: -1, Message: err.Error()}
+}
+
+// validateTunnels はトンネルの設定を検証する。indexesは各設定の配列の位置
+func validateTunnels(configs []TunnelConfig, indexes []int, settings *Settings) []ConfigProblem {
+    problems := []ConfigProblem{}
+    seen := map[string]map[string][]int{"tunnel_id": {}, "dst_addr": {}, "vlan_id": {}}
+
+    for n, config := range configs {
+        i := indexes[n]
+        add := func(field, format string, args ...any) {
+            problems = append(problems, ConfigProblem{Index: i, TunnelID: config.TunnelID, Field: field, Message: fmt.Sprintf(format, args...)})
+        }
+        // settings.jsonに依存する確認は、このホストに適用する設定だけに行う
+        selected := true
+        if settings != nil {
+            selected, _ = selectTunnel(config, settings)
+        }
+        validateSelector(config, add)
+
+        switch {
+        case config.TunnelID == "":
+            add("tunnel_id", "missing")
+        case !tunnelIDPattern.MatchString(config.TunnelID):
+            add("tunnel_id", "%q is not a number without leading zeros", config.TunnelID)
+        case len("bridge"+config.TunnelID) > maxIfaceNameLen:
+            add("tunnel_id", "%q is too long for interface name bridge%s", config.TunnelID, config.TunnelID)
+        }
+
+        if config.VlanID == "" {
+            add("vlan_id", "missing")
+        } else if vlan, err := strconv.Atoi(config.VlanID); err != nil || vlan < 1 || vlan > 4094 || strconv.Itoa(vlan) != config.VlanID {
+            add("vlan_id", "%q is not a number in range 1-4094", config.VlanID)
+        } else if settings != nil && selected && len(settings.PhysicalIface+"."+config.VlanID) > maxIfaceNameLen {
+            add("vlan_id", "interface name %s.%s is too long", settings.PhysicalIface, config.VlanID)
+        }
+
+        // 空の場合はアドレスから推測するので、アドレスのファミリーが揃っていればよい
+        var family string
+        switch config.IPVersion {
+        case "4", "6":
+            family = config.IPVersion
+        case "":
+        default:
+            add("ip_version", "%q is not 4 or 6", config.IPVersion)
+        }
+        for _, a := range []struct{ field, addr string }{{"src_addr", config.SrcAddr}, {"dst_addr", config.DstAddr}} {
+            if a.addr == "" {
+                continue
+            }
+            ip := net.ParseIP(a.addr)
+            if ip == nil {
+                add(a.field, "%q is not an IP address", a.addr)
+                continue
+            }
+            f := "6"
+            if ip.To4() != nil && !strings.Contains(a.addr, ":") {
+                f = "4"
+            }
+            switch {
+            case family == "":
+                family = f
+            case f != family && config.IPVersion != "":
+                add(a.field, "%s is not an IPv%s address as ip_version requires", a.addr, family)
+            case f != family:
+                add(a.field, "%s is IPv%s but src_addr is IPv%s", a.addr, f, family)
+            }
+        }
+
+        if config.SrcAddr == "" && settings != nil && selected && settings.DefaultSrcAddr == "" && settings.DefaultSrcIface == "" {
+            add("src_addr", "missing and neither default_src_addr nor default_src_iface is set")
+        }
+        if config.DstAddr == "" && config.DstHostname == "" {
+            add("dst_addr", "missing both dst_addr and dst_hostname")
+        }
+
+        // ホストがわからない場合は、同じホストに適用されうる設定どうしだけを重複とする
+        for _, d := range []struct{ field, value string }{{"tunnel_id", config.TunnelID}, {"dst_addr", config.DstAddr}, {"vlan_id", config.VlanID}} {
+            if d.value == "" || !selected {
+                continue
+            }
+            for _, m := range seen[d.field][d.value] {
+                if settings != nil || selectorsOverlap(configs[m], config) {
+                    add(d.field, "duplicate %s, also at index %d", d.value, indexes[m])
+                    break
+                }
+            }
+            seen[d.field][d.value] = append(seen[d.field][d.value], n)
+        }
+    }
+    return problems
+}
+
+// rejectedConfigError はstrict_configで設定を拒否した理由をすべて列挙したエラーを作る
+func rejectedConfigError(problems []ConfigProblem) error {
+    lines := make([]string, 0, len(problems))
+    for _, p := range problems {
+        lines = append(lines, p.String())
+    }
+    return fmt.Errorf("config rejected by strict_config, %d problem(s):\n%s", len(problems), strings.Join(lines, "\n"))
+}
+
+// validateSettingsFile はsettings.jsonを検証する。スキーマに合わない値と、loadSettingsが返すエラーを問題とする
+func validateSettingsFile(filename string) (*Settings, []ConfigProblem) {
+    problems := []ConfigProblem{}
+    if data, err := os.ReadFile(filename); err == nil {
+        var value any
+        if doc, err := parseSettingsDocument(data, filename); err == nil && json.Unmarshal(doc.data, &value) == nil {
+            for _, e := range validateSchema(settingsSchema(), value, nil) {
+                p := ConfigProblem{Index: -1, Field: strings.Join(e.Path, "."), Message: e.Message}
+                if pos, ok := doc.position(e.Path); ok {
+                    p.Line, p.Column = pos.Line, pos.Column
+                }
+                problems = append(problems, p)
+            }
+        }
+    }
+    settings, err := loadSettings(filename)
+    if err != nil {
+        return nil, append(problems, documentProblem(err))
+    }
+    if _, err := newConfigFetcher(&settings); err != nil {
+        problems = append(problems, ConfigProblem{Index: -1, Message: err.Error()})
+    }
+    return &settings, problems
+}
+
+// runValidate は "eipconf validate [FILE...]" を実行し、問題があればエラーを返す
+// ファイルを指定しない場合はsettings.jsonとそのconfig_sourceを、指定した場合はそのファイルを設定として検証する
+// settings.jsonを読めない場合、ファイルの検証ではsettings.jsonに依存する確認を省く
+func runValidate(w io.Writer, settingsFile string, settingsRequired bool, files []string, format string) error {
+    var reports []ValidationReport
+    settings, problems := validateSettingsFile(settingsFile)
+    if settingsRequired || len(files) == 0 || settings != nil {
+        reports = append(reports, ValidationReport{Source: settingsFile, Kind: "settings", Problems: problems})
+    }
+
+    targets := files
+    if settings != nil {
+        if f, err := newConfigFetcher(settings); err == nil {
+            fetcher = f
+        }
+        if len(files) == 0 {
+            targets = settings.ConfigSources
+        }
+    }
+    for _, source := range targets {
+        report := ValidationReport{Source: source, Kind: "config"}
+        body, configFmt, err := readConfigSource(source)
+        var doc *configDocument
+        if err == nil {
+            doc, err = parseConfigDocument(body, configFmt)
+        }
+        if err != nil {
+            report.Problems = []ConfigProblem{documentProblem(err)}
+        } else {
+            report.Problems = validateConfigData(doc, settings)
+        }
+        reports = append(reports, report)
+    }
+
+    total := 0
+    for _, r := range reports {
+        total += len(r.Problems)
+    }
+    switch format {
+    case "json":
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        if err := enc.Encode(reports); err != nil {
+            return err
+        }
+    default:
+        for _, r := range reports {
+            if len(r.Problems) == 0 {
+                fmt.Fprintf(w, "%s: ok\n", r.Source)
+                continue
+            }
+            for _, p := range r.Problems {
+                fmt.Fprintf(w, "%s: %s\n", r.Source, p)
+            }
+        }
+    }
+    if total > 0 {
+        return fmt.Errorf("%d problem(s) found", total)
+    }
+    return nil
+}
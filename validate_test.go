@@ -0,0 +1,173 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseConfigValidatesWithoutStrictConfig(t *testing.T) {
+    body := `[
+  {"tunnel_id": "1", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.1", "vlan_id": "100"},
+  {"tunnel_id": "2", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.2", "vlan_id": "5000"},
+  {"tunnel_id": "03", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.3", "vlan_id": "103"},
+  {"tunnel_id": "4", "src_addr": "192.0.2.10", "dst_addr": "2001:db8::4", "vlan_id": "104"}
+]`
+    doc, err := parseDocument([]byte(body), "json")
+    if err != nil {
+        t.Fatalf("parseDocument: %v", err)
+    }
+
+    // 範囲外のvlan_id、先頭に0のあるtunnel_id、ファミリーの混在したアドレスは飛ばす
+    configs, err := parseConfig(doc, nil, Settings{PhysicalIface: "em2"})
+    if err != nil {
+        t.Fatalf("parseConfig: %v", err)
+    }
+    if len(configs) != 1 || configs[0].TunnelID != "1" {
+        t.Errorf("configs = %+v, want only tunnel 1", configs)
+    }
+
+    _, err = parseConfig(doc, nil, Settings{PhysicalIface: "em2", StrictConfig: true})
+    if err == nil || !strings.Contains(err.Error(), "3 problem(s)") {
+        t.Errorf("strict_config error = %v, want 3 problems", err)
+    }
+}
+
+func TestSelectTunnel(t *testing.T) {
+    settings := &Settings{Hostname: "fw2-tokyo", Labels: map[string]string{"site": "tokyo1", "role": "edge"}}
+    tests := []struct {
+        name     string
+        config   TunnelConfig
+        selected bool
+        reason   string
+    }{
+        {name: "no selectors", config: TunnelConfig{}, selected: true, reason: noSelectorReason},
+        {name: "hosts glob", config: TunnelConfig{Hosts: []string{"fw1", "fw2-*"}}, selected: true, reason: "hostname fw2-tokyo matches fw2-*"},
+        {name: "hosts mismatch", config: TunnelConfig{Hosts: []string{"fw1", "fw2"}}, reason: "hostname fw2-tokyo matches none of hosts fw1, fw2"},
+        {name: "labels glob", config: TunnelConfig{Labels: map[string]string{"site": "tokyo*", "role": "edge"}}, selected: true,
+            reason: "label role=edge matches edge, label site=tokyo1 matches tokyo*"},
+        {name: "labels mismatch", config: TunnelConfig{Labels: map[string]string{"site": "osaka*"}}, reason: "label site=tokyo1 does not match osaka*"},
+        {name: "missing label", config: TunnelConfig{Labels: map[string]string{"rack": "*"}}, reason: "host has no label rack, wants rack=*"},
+        {name: "hosts and labels both required", config: TunnelConfig{Hosts: []string{"fw2-*"}, Labels: map[string]string{"role": "core"}},
+            reason: "label role=edge does not match core"},
+        {name: "hosts and labels", config: TunnelConfig{Hosts: []string{"fw2-*"}, Labels: map[string]string{"role": "edge"}}, selected: true,
+            reason: "hostname fw2-tokyo matches fw2-*, label role=edge matches edge"},
+        {name: "invalid glob never matches", config: TunnelConfig{Hosts: []string{"fw2-["}}, reason: "hostname fw2-tokyo matches none of hosts fw2-["},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            selected, reason := selectTunnel(tt.config, settings)
+            if selected != tt.selected || reason != tt.reason {
+                t.Errorf("selectTunnel = %v, %q, want %v, %q", selected, reason, tt.selected, tt.reason)
+            }
+        })
+    }
+}
+
+func TestValidateTunnelsSelectors(t *testing.T) {
+    tunnel := func(id, dst, vlan string, hosts ...string) TunnelConfig {
+        return TunnelConfig{TunnelID: id, SrcAddr: "192.0.2.10", DstAddr: dst, VlanID: vlan, Hosts: hosts}
+    }
+    host := &Settings{Hostname: "fw1", PhysicalIface: "em2"}
+    tests := []struct {
+        name     string
+        configs  []TunnelConfig
+        settings *Settings // nilはホストがわからない検証
+        problems []string
+    }{
+        {
+            name:    "same tunnel_id on different hosts",
+            configs: []TunnelConfig{tunnel("1", "198.51.100.1", "100", "fw1"), tunnel("1", "198.51.100.1", "100", "fw2")},
+        },
+        {
+            name:     "same tunnel_id on the same hosts",
+            configs:  []TunnelConfig{tunnel("1", "198.51.100.1", "100", "fw1", "fw2"), tunnel("1", "198.51.100.2", "101", "fw2", "fw1")},
+            problems: []string{"[1] tunnel_id=1 tunnel_id: duplicate 1, also at index 0"},
+        },
+        {
+            name:     "same tunnel_id with and without selectors",
+            configs:  []TunnelConfig{tunnel("1", "198.51.100.1", "100"), tunnel("1", "198.51.100.2", "101", "fw2")},
+            problems: []string{"[1] tunnel_id=1 tunnel_id: duplicate 1, also at index 0"},
+        },
+        {
+            name:     "same tunnel_id selected on this host",
+            configs:  []TunnelConfig{tunnel("1", "198.51.100.1", "100", "fw*"), tunnel("1", "198.51.100.2", "101", "fw1")},
+            settings: host,
+            problems: []string{"[1] tunnel_id=1 tunnel_id: duplicate 1, also at index 0"},
+        },
+        {
+            name:     "same tunnel_id not selected on this host",
+            configs:  []TunnelConfig{tunnel("1", "198.51.100.1", "100", "fw1"), tunnel("1", "198.51.100.1", "100", "fw2")},
+            settings: host,
+        },
+        {
+            name:     "settings checks only for selected entries",
+            configs:  []TunnelConfig{{TunnelID: "1", DstAddr: "198.51.100.1", VlanID: "100", Hosts: []string{"fw2"}}, {TunnelID: "2", DstAddr: "198.51.100.2", VlanID: "101"}},
+            settings: host,
+            problems: []string{"[1] tunnel_id=2 src_addr: missing and neither default_src_addr nor default_src_iface is set"},
+        },
+        {
+            name:     "format checks for every entry",
+            configs:  []TunnelConfig{tunnel("1", "198.51.100.1", "5000", "fw2")},
+            settings: host,
+            problems: []string{`[0] tunnel_id=1 vlan_id: "5000" is not a number in range 1-4094`},
+        },
+        {
+            name: "invalid selectors",
+            configs: []TunnelConfig{
+                tunnel("1", "198.51.100.1", "100", "fw[", ""),
+                {TunnelID: "2", SrcAddr: "192.0.2.10", DstAddr: "198.51.100.2", VlanID: "101", Labels: map[string]string{"": "x", "site": "tokyo["}},
+            },
+            problems: []string{
+                `[0] tunnel_id=1 hosts: "fw[" is not a valid hostname pattern`,
+                `[0] tunnel_id=1 hosts: "" is not a valid hostname pattern`,
+                `[1] tunnel_id=2 labels: label name is empty`,
+                `[1] tunnel_id=2 labels: site="tokyo[" is not a valid label pattern`,
+            },
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            indexes := make([]int, len(tt.configs))
+            for i := range indexes {
+                indexes[i] = i
+            }
+            problems := []string{}
+            for _, p := range validateTunnels(tt.configs, indexes, tt.settings) {
+                problems = append(problems, p.String())
+            }
+            if want := append([]string{}, tt.problems...); !reflect.DeepEqual(problems, want) {
+                t.Errorf("problems:\n got %q\nwant %q", problems, want)
+            }
+        })
+    }
+}
+
+func TestParseConfigSkipsUnselectedBeforeValidation(t *testing.T) {
+    body := `[
+  {"tunnel_id": "1", "dst_addr": "198.51.100.1", "vlan_id": "100", "hosts": ["fw2"]},
+  {"tunnel_id": "1", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.1", "vlan_id": "100", "hosts": ["fw1"]},
+  {"tunnel_id": "2", "src_addr": "192.0.2.10", "dst_addr": "198.51.100.2", "vlan_id": "101", "labels": {"site": "osaka"}}
+]`
+    doc, err := parseDocument([]byte(body), "json")
+    if err != nil {
+        t.Fatalf("parseDocument: %v", err)
+    }
+
+    // 他のホスト向けのsrc_addrのない設定とtunnel_idの重なりは、strict_configでも問題にしない
+    settings := Settings{Hostname: "fw1", Labels: map[string]string{"site": "tokyo"}, PhysicalIface: "em2", StrictConfig: true}
+    configs, err := parseConfig(doc, nil, settings)
+    if err != nil {
+        t.Fatalf("parseConfig: %v", err)
+    }
+    if len(configs) != 1 || configs[0].DstAddr != "198.51.100.1" || configs[0].SrcAddr != "192.0.2.10" {
+        t.Errorf("configs = %+v, want only index 1", configs)
+    }
+    var got []bool
+    for _, s := range selections.get() {
+        got = append(got, s.Selected)
+    }
+    if want := []bool{false, true, false}; !reflect.DeepEqual(got, want) {
+        t.Errorf("selections = %v, want %v", got, want)
+    }
+}
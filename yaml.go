@@ -0,0 +1,589 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// YAMLの読み込み。設定ファイルに使う範囲として、ブロックとフローのマッピングと配列、プレーン、引用符、ブロック("|"、">")のスカラー、
+// コメントと1つの文書に対応する。アンカー、エイリアス、タグ、複数の文書、複雑なキーには対応せず、エラーとする
+// スカラーの型はYAML 1.2のcoreスキーマに従う。"100" のように数値に見える文字列は引用符で囲む
+
+type yamlParser struct {
+    text *sourceText
+    src  string
+    i    int
+}
+
+// yamlFailure はパースの失敗をparseYAMLまで戻すためのpanicの値
+type yamlFailure struct {
+    err *documentError
+}
+
+func parseYAML(src string) (root *docNode, err error) {
+    p := &yamlParser{text: newSourceText(src), src: src}
+    defer func() {
+        if r := recover(); r != nil {
+            failure, ok := r.(yamlFailure)
+            if !ok {
+                panic(r)
+            }
+            root, err = nil, failure.err
+        }
+    }()
+    return p.parseDocument(), nil
+}
+
+func (p *yamlParser) fail(offset int, format string, args ...any) {
+    panic(yamlFailure{&documentError{format: formatYAML, pos: p.text.position(offset), msg: fmt.Sprintf(format, args...)}})
+}
+
+func (p *yamlParser) lineEnd(offset int) int {
+    if n := strings.IndexByte(p.src[offset:], '\n'); n >= 0 {
+        return offset + n
+    }
+    return len(p.src)
+}
+
+func (p *yamlParser) column(offset int) int {
+    return offset - (strings.LastIndexByte(p.src[:offset], '\n') + 1)
+}
+
+// nextContent は空行とコメントだけの行を飛ばし、次の内容のある行の先頭と字下げを返す。p.iは行の先頭に移す
+func (p *yamlParser) nextContent() (start, indent int, ok bool) {
+    for p.i < len(p.src) {
+        end := p.lineEnd(p.i)
+        line := p.src[p.i:end]
+        content := strings.TrimLeft(line, " ")
+        if trimmed := strings.TrimSpace(content); trimmed == "" || trimmed[0] == '#' {
+            p.i = end + 1
+            continue
+        }
+        if content[0] == '\t' {
+            p.fail(p.i+len(line)-len(content), "tabs are not allowed for indentation")
+        }
+        return p.i, len(line) - len(content), true
+    }
+    return len(p.src), 0, false
+}
+
+// skipLine は行末の空白とコメントを確かめ、次の行の先頭に移る
+func (p *yamlParser) skipLine() {
+    for p.i < len(p.src) && (p.src[p.i] == ' ' || p.src[p.i] == '\t') {
+        p.i++
+    }
+    if p.i < len(p.src) && p.src[p.i] != '\n' && p.src[p.i] != '#' {
+        p.fail(p.i, "unexpected %q after value", p.src[p.i])
+    }
+    p.i = p.lineEnd(p.i) + 1
+    if p.i > len(p.src) {
+        p.i = len(p.src)
+    }
+}
+
+// atLineEnd は行の残りが空白とコメントだけかを返す
+func (p *yamlParser) atLineEnd(offset int) bool {
+    rest := strings.TrimLeft(p.src[offset:p.lineEnd(offset)], " \t")
+    return rest == "" || rest[0] == '#'
+}
+
+func isDocumentMarker(line, marker string) bool {
+    return line == marker || strings.HasPrefix(line, marker+" ") || strings.HasPrefix(line, marker+"\t")
+}
+
+func (p *yamlParser) parseDocument() *docNode {
+    start, indent, ok := p.nextContent()
+    if ok && indent == 0 && p.src[start] == '%' {
+        p.fail(start, "directives are not supported")
+    }
+    if ok && indent == 0 && isDocumentMarker(p.src[start:p.lineEnd(start)], "---") {
+        p.i = start + 3
+        if !p.atLineEnd(p.i) {
+            p.fail(p.i, "content on the document start line is not supported")
+        }
+        p.skipLine()
+    }
+
+    // 文書の終わり("...")か次の文書("---")の行より後は読まない
+    rest := ""
+    for i := p.i; i < len(p.src); i = p.lineEnd(i) + 1 {
+        line := p.src[i:p.lineEnd(i)]
+        if isDocumentMarker(line, "---") || isDocumentMarker(line, "...") {
+            p.src, rest = p.src[:i], p.src[i:]
+            break
+        }
+    }
+    start, indent, ok = p.nextContent()
+    if !ok {
+        p.fail(len(p.src), "document is empty")
+    }
+    root := p.parseNode(start+indent, indent)
+    if start, indent, ok := p.nextContent(); ok {
+        p.fail(start+indent, "unexpected content, check the indentation")
+    }
+    if rest != "" {
+        end := len(p.src)
+        p.src += rest
+        if strings.HasPrefix(rest, "---") {
+            p.fail(end, "multiple documents are not supported")
+        }
+        p.i = end + 3
+        p.skipLine()
+        if start, _, ok := p.nextContent(); ok {
+            p.fail(start, "multiple documents are not supported")
+        }
+    }
+    return root
+}
+
+// isSeqEntry はoffsetが "- " で始まる配列の要素かを返す
+func (p *yamlParser) isSeqEntry(offset int) bool {
+    return offset < len(p.src) && p.src[offset] == '-' && (offset+1 == len(p.src) || strings.IndexByte(" \t\n", p.src[offset+1]) >= 0)
+}
+
+// keyEnd はoffsetがブロックのマッピングのキーで始まる場合、キーの後の ":" の位置を返す。そうでなければ-1
+func (p *yamlParser) keyEnd(offset int) int {
+    end := p.lineEnd(offset)
+    i := offset
+    if i < end && (p.src[i] == '"' || p.src[i] == '\'') {
+        i = p.quotedEnd(i)
+        for i < end && (p.src[i] == ' ' || p.src[i] == '\t') {
+            i++
+        }
+        if i < end && p.src[i] == ':' && (i+1 == end || p.src[i+1] == ' ' || p.src[i+1] == '\t') {
+            return i
+        }
+        return -1
+    }
+    if i < end && strings.IndexByte("[{", p.src[i]) >= 0 {
+        return -1
+    }
+    for ; i < end; i++ {
+        switch {
+        case p.src[i] == '#' && i > offset && (p.src[i-1] == ' ' || p.src[i-1] == '\t'):
+            return -1
+        case p.src[i] == ':' && (i+1 == end || p.src[i+1] == ' ' || p.src[i+1] == '\t'):
+            return i
+        }
+    }
+    return -1
+}
+
+// parseNode はoffsetから始まるブロックの値を読む。colはその値の桁
+func (p *yamlParser) parseNode(offset, col int) *docNode {
+    switch {
+    case p.isSeqEntry(offset):
+        return p.parseSeq(offset, col)
+    case p.keyEnd(offset) >= 0:
+        return p.parseMap(offset, col)
+    }
+    p.i = offset
+    node := p.parseInline(false)
+    p.skipLine()
+    return node
+}
+
+func (p *yamlParser) parseSeq(offset, col int) *docNode {
+    node := &docNode{pos: p.text.position(offset), isSeq: true, items: []*docNode{}}
+    for {
+        p.i = offset + 1
+        node.items = append(node.items, p.parseValue(offset, col, false))
+        start, indent, ok := p.nextContent()
+        if !ok || indent < col || (indent == col && !p.isSeqEntry(start+indent)) {
+            return node
+        }
+        if indent > col {
+            p.fail(start+indent, "unexpected indentation in sequence")
+        }
+        offset = start + indent
+    }
+}
+
+func (p *yamlParser) parseMap(offset, col int) *docNode {
+    node := &docNode{pos: p.text.position(offset), isMap: true}
+    for {
+        end := p.keyEnd(offset)
+        if end < 0 {
+            p.fail(offset, "expected a mapping key")
+        }
+        key := p.parseKey(offset, end)
+        if node.get(key) != nil {
+            p.fail(offset, "duplicate key %q", key)
+        }
+        p.i = end + 1
+        node.set(key, p.parseValue(offset, col, true))
+        start, indent, ok := p.nextContent()
+        if !ok || indent < col {
+            return node
+        }
+        if indent > col {
+            p.fail(start+indent, "unexpected indentation in mapping")
+        }
+        offset = start + indent
+    }
+}
+
+// parseKey はブロックのマッピングのキーを読む
+func (p *yamlParser) parseKey(offset, end int) string {
+    switch p.src[offset] {
+    case '"', '\'':
+        p.i = offset
+        return p.parseQuoted()
+    case '?':
+        p.fail(offset, "complex mapping keys are not supported")
+    case '&', '*', '!':
+        p.fail(offset, "anchors, aliases and tags are not supported")
+    }
+    return strings.TrimRight(p.src[offset:end], " \t")
+}
+
+// parseValue は "-" か "key:" の後の値を読む。p.iは指示子の直後。値がなければnullとし、位置はownerとする
+// inMapがtrueの場合、キーと同じ字下げの配列をキーの値とする
+func (p *yamlParser) parseValue(owner, col int, inMap bool) *docNode {
+    for p.i < len(p.src) && (p.src[p.i] == ' ' || p.src[p.i] == '\t') {
+        p.i++
+    }
+    if !p.atLineEnd(p.i) {
+        switch c := p.src[p.i]; {
+        case c == '|' || c == '>':
+            return p.parseBlockScalar(col)
+        case !inMap && p.isSeqEntry(p.i):
+            return p.parseSeq(p.i, p.column(p.i))
+        case !inMap && p.keyEnd(p.i) >= 0:
+            return p.parseMap(p.i, p.column(p.i))
+        }
+        node := p.parseInline(false)
+        p.skipLine()
+        return node
+    }
+    p.skipLine()
+    start, indent, ok := p.nextContent()
+    if ok && (indent > col || inMap && indent == col && p.isSeqEntry(start+indent)) {
+        return p.parseNode(start+indent, indent)
+    }
+    return &docNode{pos: p.text.position(owner), scalar: "null"}
+}
+
+// parseInline は1行のスカラーかフローの値を読む
+func (p *yamlParser) parseInline(flow bool) *docNode {
+    if p.i >= len(p.src) {
+        p.fail(p.i, "unexpected end of document")
+    }
+    start := p.i
+    switch p.src[p.i] {
+    case '[':
+        return p.parseFlowSeq()
+    case '{':
+        return p.parseFlowMap()
+    case '"', '\'':
+        return stringNode(p.text.position(start), p.parseQuoted())
+    case '&', '*':
+        p.fail(start, "anchors and aliases are not supported")
+    case '!':
+        p.fail(start, "tags are not supported")
+    case '|', '>':
+        p.fail(start, "block scalars are not allowed here")
+    case '@', '`':
+        p.fail(start, "%q cannot start a plain scalar", p.src[start])
+    }
+    return p.parsePlain(flow)
+}
+
+// parsePlain は引用符のないスカラーを読み、型を解決する
+func (p *yamlParser) parsePlain(flow bool) *docNode {
+    start := p.i
+    end := p.lineEnd(p.i)
+    for ; p.i < end; p.i++ {
+        c := p.src[p.i]
+        if c == '#' && p.i > start && (p.src[p.i-1] == ' ' || p.src[p.i-1] == '\t') {
+            break
+        }
+        next := byte('\n')
+        if p.i+1 < len(p.src) {
+            next = p.src[p.i+1]
+        }
+        if c == ':' && (next == ' ' || next == '\t' || next == '\n' || flow && strings.IndexByte(",[]{}", next) >= 0) {
+            if !flow {
+                p.fail(p.i, "mapping values are not allowed here")
+            }
+            break
+        }
+        if flow && strings.IndexByte(",[]{}", c) >= 0 {
+            break
+        }
+    }
+    value := strings.TrimRight(p.src[start:p.i], " \t")
+    p.i = start + len(value)
+    scalar, err := resolveYAMLScalar(value)
+    if err != nil {
+        p.fail(start, "%v", err)
+    }
+    return &docNode{pos: p.text.position(start), scalar: scalar, raw: value}
+}
+
+var (
+    yamlInt   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+    yamlOct   = regexp.MustCompile(`^0o[0-7]+$`)
+    yamlHex   = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+    yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+    yamlInf   = regexp.MustCompile(`^([-+]?\.(inf|Inf|INF)|\.(nan|NaN|NAN))$`)
+)
+
+// resolveYAMLScalar はプレーンなスカラーをYAML 1.2のcoreスキーマで解決し、JSONの表現を返す
+func resolveYAMLScalar(s string) (string, error) {
+    switch s {
+    case "", "~", "null", "Null", "NULL":
+        return "null", nil
+    case "true", "True", "TRUE":
+        return "true", nil
+    case "false", "False", "FALSE":
+        return "false", nil
+    }
+    var n int64
+    var err error
+    switch {
+    case yamlInt.MatchString(s):
+        n, err = strconv.ParseInt(s, 10, 64)
+    case yamlOct.MatchString(s):
+        n, err = strconv.ParseInt(s[2:], 8, 64)
+    case yamlHex.MatchString(s):
+        n, err = strconv.ParseInt(s[2:], 16, 64)
+    case yamlFloat.MatchString(s):
+        f, err := strconv.ParseFloat(s, 64)
+        if err != nil || math.IsInf(f, 0) {
+            return "", fmt.Errorf("number %s is out of range", s)
+        }
+        return strconv.FormatFloat(f, 'g', -1, 64), nil
+    case yamlInf.MatchString(s):
+        return "", fmt.Errorf("%s cannot be represented in JSON", s)
+    default:
+        return stringNode(position{}, s).scalar, nil
+    }
+    if err != nil {
+        return "", fmt.Errorf("integer %s is out of range", s)
+    }
+    return strconv.FormatInt(n, 10), nil
+}
+
+// quotedEnd は引用符で囲まれたスカラーの終わりの次の位置を返す
+func (p *yamlParser) quotedEnd(offset int) int {
+    quote := p.src[offset]
+    for i := offset + 1; i < len(p.src) && p.src[i] != '\n'; i++ {
+        switch {
+        case quote == '"' && p.src[i] == '\\':
+            i++
+        case quote == '\'' && p.src[i] == '\'' && i+1 < len(p.src) && p.src[i+1] == '\'':
+            i++
+        case p.src[i] == quote:
+            return i + 1
+        }
+    }
+    return len(p.src)
+}
+
+var yamlEscapes = map[byte]string{
+    '0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n", 'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b",
+    ' ': " ", '"': "\"", '/': "/", '\\': "\\", 'N': "\u0085", '_': " ", 'L': " ", 'P': " ",
+}
+
+// parseQuoted は1行の引用符で囲まれたスカラーを読む
+func (p *yamlParser) parseQuoted() string {
+    start := p.i
+    quote := p.src[p.i]
+    var b strings.Builder
+    for p.i++; ; p.i++ {
+        if p.i >= len(p.src) || p.src[p.i] == '\n' {
+            p.fail(start, "unterminated quoted scalar (multi-line quoted scalars are not supported)")
+        }
+        c := p.src[p.i]
+        switch {
+        case c == quote && quote == '\'' && p.i+1 < len(p.src) && p.src[p.i+1] == '\'':
+            b.WriteByte('\'')
+            p.i++
+        case c == quote:
+            p.i++
+            return b.String()
+        case c == '\\' && quote == '"':
+            p.i++
+            if p.i >= len(p.src) {
+                p.fail(p.i, "unterminated escape sequence")
+            }
+            if s, ok := yamlEscapes[p.src[p.i]]; ok {
+                b.WriteString(s)
+                continue
+            }
+            size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[p.src[p.i]]
+            if size == 0 || p.i+size >= len(p.src) {
+                p.fail(p.i-1, "invalid escape sequence")
+            }
+            r, err := strconv.ParseUint(p.src[p.i+1:p.i+1+size], 16, 32)
+            if err != nil || !utf8.ValidRune(rune(r)) {
+                p.fail(p.i-1, "invalid escape sequence")
+            }
+            b.WriteRune(rune(r))
+            p.i += size
+        default:
+            b.WriteByte(c)
+        }
+    }
+}
+
+// skipFlowSpace はフローの値の間の空白、改行とコメントを飛ばす
+func (p *yamlParser) skipFlowSpace() {
+    for p.i < len(p.src) {
+        switch c := p.src[p.i]; {
+        case c == ' ' || c == '\t' || c == '\n':
+            p.i++
+        case c == '#' && (p.i == 0 || strings.IndexByte(" \t\n", p.src[p.i-1]) >= 0):
+            p.i = p.lineEnd(p.i)
+        default:
+            return
+        }
+    }
+}
+
+// expectFlow は値の後の "," か閉じ括弧を読み、閉じたかどうかを返す
+func (p *yamlParser) expectFlow(closing byte) bool {
+    p.skipFlowSpace()
+    if p.i >= len(p.src) {
+        p.fail(p.i, "unterminated flow collection, expected %q", closing)
+    }
+    switch p.src[p.i] {
+    case ',':
+        p.i++
+        return false
+    case closing:
+        p.i++
+        return true
+    }
+    p.fail(p.i, "expected ',' or %q", closing)
+    return true
+}
+
+func (p *yamlParser) parseFlowSeq() *docNode {
+    node := &docNode{pos: p.text.position(p.i), isSeq: true, items: []*docNode{}}
+    for p.i++; ; {
+        p.skipFlowSpace()
+        if p.i < len(p.src) && p.src[p.i] == ']' {
+            p.i++
+            return node
+        }
+        node.items = append(node.items, p.parseInline(true))
+        p.skipFlowSpace()
+        if p.i < len(p.src) && p.src[p.i] == ':' {
+            p.fail(p.i, "mappings inside flow sequences are not supported")
+        }
+        if p.expectFlow(']') {
+            return node
+        }
+    }
+}
+
+func (p *yamlParser) parseFlowMap() *docNode {
+    node := &docNode{pos: p.text.position(p.i), isMap: true}
+    for p.i++; ; {
+        p.skipFlowSpace()
+        if p.i < len(p.src) && p.src[p.i] == '}' {
+            p.i++
+            return node
+        }
+        keyStart := p.i
+        keyNode := p.parseInline(true)
+        if keyNode.isMap || keyNode.isSeq {
+            p.fail(keyStart, "complex mapping keys are not supported")
+        }
+        key := p.src[keyStart:p.i]
+        if c := p.src[keyStart]; c == '"' || c == '\'' {
+            p.i = keyStart
+            key = p.parseQuoted()
+        }
+        if node.get(key) != nil {
+            p.fail(keyStart, "duplicate key %q", key)
+        }
+        p.skipFlowSpace()
+        value := &docNode{pos: p.text.position(keyStart), scalar: "null"}
+        if p.i < len(p.src) && p.src[p.i] == ':' {
+            p.i++
+            p.skipFlowSpace()
+            if p.i < len(p.src) && p.src[p.i] != ',' && p.src[p.i] != '}' {
+                value = p.parseInline(true)
+            }
+        }
+        node.set(key, value)
+        if p.expectFlow('}') {
+            return node
+        }
+    }
+}
+
+// parseBlockScalar は "|"（改行をそのまま）と ">"（改行を空白に折り返す）のスカラーを読む。colは値を持つマッピングか配列の桁
+func (p *yamlParser) parseBlockScalar(col int) *docNode {
+    start := p.i
+    literal := p.src[p.i] == '|'
+    chomp, indent := byte(0), 0
+    for p.i++; p.i < len(p.src) && strings.IndexByte("+-123456789", p.src[p.i]) >= 0; p.i++ {
+        if c := p.src[p.i]; c == '+' || c == '-' {
+            chomp = c
+        } else {
+            indent = col + int(c-'0')
+        }
+    }
+    p.skipLine()
+
+    var lines []string
+    for p.i < len(p.src) {
+        end := p.lineEnd(p.i)
+        line := p.src[p.i:end]
+        content := strings.TrimLeft(line, " ")
+        if content != "" {
+            if indent == 0 {
+                indent = len(line) - len(content)
+            }
+            if len(line)-len(content) < indent || indent <= col {
+                break
+            }
+        }
+        if len(line) >= indent {
+            lines = append(lines, line[indent:])
+        } else {
+            lines = append(lines, "")
+        }
+        p.i = end + 1
+    }
+    if p.i > len(p.src) {
+        p.i = len(p.src)
+    }
+
+    trailing := 0
+    for len(lines) > 0 && lines[len(lines)-1] == "" {
+        lines = lines[:len(lines)-1]
+        trailing++
+    }
+    var b strings.Builder
+    for i, line := range lines {
+        if i > 0 {
+            prev := lines[i-1]
+            moreIndented := strings.HasPrefix(line, " ") || strings.HasPrefix(prev, " ")
+            switch {
+            case literal || line == "" || moreIndented:
+                b.WriteByte('\n')
+            case prev != "":
+                b.WriteByte(' ')
+            }
+        }
+        b.WriteString(line)
+    }
+    value := b.String()
+    switch {
+    case chomp == '-' || len(lines) == 0 && chomp != '+':
+    case chomp == '+':
+        value += strings.Repeat("\n", trailing+1)
+    default:
+        value += "\n"
+    }
+    return stringNode(p.text.position(start), value)
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestParseYAML(t *testing.T) {
+    runParseCases(t, formatYAML, []parseCase{
+        {
+            name: "block collections and comments",
+            src:  "# tunnels\nversion: 1 # envelope\nserial: 3\ntunnels:\n  # first\n  - tunnel_id: \"1\"\n    vlan_id: \"100\"\n\n  - tunnel_id: \"2\"   # second\n    vlan_id: \"101\"\n",
+            want: `{"version":1,"serial":3,"tunnels":[{"tunnel_id":"1","vlan_id":"100"},{"tunnel_id":"2","vlan_id":"101"}]}`,
+        },
+        {
+            name: "quoted scalars",
+            src:  "single: 'it''s \"quoted\"'\ndouble: \"tab\\there\\nnew line \\u00e9\"\nnumber: \"100\"\nhash: 'a # b'\n",
+            want: `{"single":"it's \"quoted\"","double":"tab\there\nnew line é","number":"100","hash":"a # b"}`,
+        },
+        {
+            name: "block scalars",
+            src:  "literal: |\n  line one\n    indented\n  line three\nfolded: >-\n  folded\n  text\n\n  paragraph\nlast: x\n",
+            want: `{"literal":"line one\n  indented\nline three\n","folded":"folded text\nparagraph","last":"x"}`,
+        },
+        {
+            name: "core schema scalars",
+            src:  "int: 100\nhex: 0x1F\nfloat: 2.5\nbool: true\nnull1: null\nnull2: ~\nempty:\nstring: 2001:db8::1\n",
+            want: `{"int":100,"hex":31,"float":2.5,"bool":true,"null1":null,"null2":null,"empty":null,"string":"2001:db8::1"}`,
+        },
+        {
+            name: "flow collections",
+            src:  "hosts: [edge-*, \"core-1\"]\nlabels: {site: tokyo, rack: 'r1'}\n",
+            want: `{"hosts":["edge-*","core-1"],"labels":{"site":"tokyo","rack":"r1"}}`,
+        },
+        {
+            name: "CRLF and BOM",
+            src:  "\ufefftunnels:\r\n  - tunnel_id: \"1\"\r\n    description: |\r\n      two\r\n      lines\r\n",
+            want: `{"tunnels":[{"tunnel_id":"1","description":"two\nlines\n"}]}`,
+        },
+        {name: "anchor", src: "base: &base\n  vlan_id: \"100\"\n", line: 1, column: 7, wantErr: "anchors and aliases are not supported"},
+        {name: "alias", src: "a: 1\nb: *base\n", line: 2, column: 4, wantErr: "anchors and aliases are not supported"},
+        {name: "anchor in sequence", src: "- &x {a: 1}\n", line: 1, column: 3, wantErr: "anchors, aliases and tags are not supported"},
+        {name: "merge key alias", src: "a:\n  <<: *base\n", line: 2, column: 7, wantErr: "anchors and aliases are not supported"},
+        {name: "tag", src: "a: !!str 1\n", line: 1, column: 4, wantErr: "tags are not supported"},
+        {name: "duplicate key", src: "tunnel_id: \"1\"\nvlan_id: \"100\"\nvlan_id: \"101\"\n", line: 3, column: 1, wantErr: `duplicate key "vlan_id"`},
+        {name: "tab indentation", src: "a:\n\t- 1\n", line: 2, column: 1, wantErr: "tabs are not allowed for indentation"},
+        {name: "multi-line quoted scalar", src: "a: 1\nb: \"multi\n  line\"\n", line: 2, column: 4, wantErr: "multi-line quoted scalars are not supported"},
+        {name: "multiple documents", src: "a: 1\n---\nb: 2\n", line: 2, column: 1, wantErr: "multiple documents are not supported"},
+        {name: "text after quoted scalar", src: "a: 'x' y\n", line: 1, column: 8, wantErr: "unexpected 'y' after value"},
+        {name: "error position with CRLF", src: "a: 1\r\nb: 2\r\nb: 3\r\n", line: 3, column: 1, wantErr: `duplicate key "b"`},
+    })
+}